@@ -0,0 +1,207 @@
+package main
+
+// Control-flow graph
+//
+// The IR of a function is split into basic blocks. A basic block is a
+// sequence of instructions that is entered only at the beginning and
+// left only at the end. A block begins at a label or after a jump,
+// and it either ends with a jump or falls through to the next block.
+// Blocks are kept in the original order of instructions, so that
+// falling through to the next block remains valid.
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+func new_bb() *BB {
+	bb := new(BB)
+	bb.ir = new_vec()
+	bb.succ = new_vec()
+	bb.pred = new_vec()
+	return bb
+}
+
+func is_terminator(ir *IR) bool {
+	switch ir.op {
+	case IR_JMP, IR_IF, IR_UNLESS, IR_JMP_TABLE, IR_RETURN, IR_FRETURN, IR_SRETURN:
+		return true
+	}
+	return false
+}
+
+func add_edge(from, to *BB) {
+	for i := 0; i < from.succ.len; i++ {
+		if from.succ.data[i] == to {
+			return
+		}
+	}
+	vec_push(from.succ, to)
+}
+
+// Maps labels to the blocks that start with them.
+func label_map(bbs *Vector) map[int]*BB {
+	m := make(map[int]*BB)
+	for i := 0; i < bbs.len; i++ {
+		bb := bbs.data[i].(*BB)
+		for j := 0; j < bb.ir.len; j++ {
+			if ir := bb.ir.data[j].(*IR); ir.op == IR_LABEL {
+				m[ir.lhs] = bb
+			}
+		}
+	}
+	return m
+}
+
+// Sets successors of each block from its last instruction.
+func add_edges(bbs *Vector) {
+	label_bb := label_map(bbs)
+
+	for i := 0; i < bbs.len; i++ {
+		bb := bbs.data[i].(*BB)
+		var next *BB
+		if i+1 < bbs.len {
+			next = bbs.data[i+1].(*BB)
+		}
+
+		if bb.ir.len == 0 {
+			if next != nil {
+				add_edge(bb, next)
+			}
+			continue
+		}
+
+		ir := vec_last(bb.ir).(*IR)
+		switch ir.op {
+		case IR_JMP:
+			add_edge(bb, label_bb[ir.lhs])
+		case IR_IF, IR_UNLESS:
+			add_edge(bb, label_bb[ir.rhs])
+			if next != nil {
+				add_edge(bb, next)
+			}
+		case IR_JMP_TABLE:
+			add_edge(bb, label_bb[ir.rhs])
+			for _, l := range ir.labels {
+				add_edge(bb, label_bb[l])
+			}
+		case IR_RETURN, IR_FRETURN, IR_SRETURN:
+		default:
+			if next != nil {
+				add_edge(bb, next)
+			}
+		}
+	}
+}
+
+func mark_reachable(bb *BB, seen map[*BB]bool) {
+	if seen[bb] {
+		return
+	}
+	seen[bb] = true
+	for i := 0; i < bb.succ.len; i++ {
+		mark_reachable(bb.succ.data[i].(*BB), seen)
+	}
+}
+
+// Removes blocks that cannot be reached from the entry block, such
+// as code after a return statement. A block that falls through to the
+// next one keeps it, so the order of the rest doesn't change.
+func remove_unreachable(bbs *Vector) *Vector {
+	seen := make(map[*BB]bool)
+	mark_reachable(bbs.data[0].(*BB), seen)
+
+	v := new_vec()
+	for i := 0; i < bbs.len; i++ {
+		bb := bbs.data[i].(*BB)
+		if seen[bb] {
+			bb.id = v.len
+			vec_push(v, bb)
+		}
+	}
+
+	for i := 0; i < v.len; i++ {
+		bb := v.data[i].(*BB)
+		for j := 0; j < bb.succ.len; j++ {
+			vec_push(bb.succ.data[j].(*BB).pred, bb)
+		}
+	}
+	return v
+}
+
+// Sets edges between blocks and returns reachable ones. This is
+// also used to update the graph after blocks have been changed.
+func link_bbs(bbs *Vector) *Vector {
+	for i := 0; i < bbs.len; i++ {
+		bb := bbs.data[i].(*BB)
+		bb.succ = new_vec()
+		bb.pred = new_vec()
+	}
+	add_edges(bbs)
+	return remove_unreachable(bbs)
+}
+
+// Splits IR instructions into basic blocks and returns reachable ones.
+func build_cfg(code *Vector) *Vector {
+	bbs := new_vec()
+
+	var bb *BB
+	for i := 0; i < code.len; i++ {
+		ir := code.data[i].(*IR)
+		if bb == nil || (ir.op == IR_LABEL && bb.ir.len > 0) {
+			bb = new_bb()
+			vec_push(bbs, bb)
+		}
+		vec_push(bb.ir, ir)
+		if is_terminator(ir) {
+			bb = nil
+		}
+	}
+
+	// An empty function has one empty block.
+	if bbs.len == 0 {
+		vec_push(bbs, new_bb())
+		return bbs
+	}
+	return link_bbs(bbs)
+}
+
+// Escapes a string for a label of Graphviz DOT.
+func dot_escape(s string) string {
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	s = strings.Replace(s, "\"", "\\\"", -1)
+	return strings.Replace(s, "\t", "  ", -1)
+}
+
+// Prints control-flow graphs of functions in Graphviz DOT. Each
+// function is a cluster whose nodes are basic blocks.
+func dump_cfg(fns *Vector) {
+	w := os.Stderr
+	fmt.Fprintf(w, "digraph CFG {\n")
+	fmt.Fprintf(w, "  node [shape=box, fontname=monospace];\n")
+	for i := 0; i < fns.len; i++ {
+		fn := fns.data[i].(*Function)
+		fmt.Fprintf(w, "  subgraph cluster_%d {\n", i)
+		fmt.Fprintf(w, "    label=\"%s()\";\n", fn.name)
+
+		for j := 0; j < fn.bbs.len; j++ {
+			bb := fn.bbs.data[j].(*BB)
+			sb := new_sb()
+			sb_append(sb, format("bb%d:\\l", bb.id))
+			for k := 0; k < bb.ir.len; k++ {
+				s := strings.TrimRight(tostr(bb.ir.data[k].(*IR)), "\n")
+				sb_append(sb, dot_escape(s)+"\\l")
+			}
+			fmt.Fprintf(w, "    f%d_bb%d [label=\"%s\"];\n", i, bb.id, sb_get(sb))
+		}
+		for j := 0; j < fn.bbs.len; j++ {
+			bb := fn.bbs.data[j].(*BB)
+			for k := 0; k < bb.succ.len; k++ {
+				fmt.Fprintf(w, "    f%d_bb%d -> f%d_bb%d;\n", i, bb.id, i, bb.succ.data[k].(*BB).id)
+			}
+		}
+		fmt.Fprintf(w, "  }\n")
+	}
+	fmt.Fprintf(w, "}\n")
+}
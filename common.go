@@ -23,9 +23,10 @@ type StringBuilder struct {
 }
 
 type Type struct {
-	ty    int
-	size  int // sizeof
-	align int // alignof
+	ty          int
+	size        int  // sizeof
+	align       int  // alignof
+	is_unsigned bool // Integer
 
 	// Pointer
 	ptr_to *Type
@@ -34,33 +35,51 @@ type Type struct {
 	ary_of *Type
 	len    int
 
-	// Struct
-	members *Vector
-	offset  int
+	// Struct or union. Members of a union share the same offset.
+	members  *Vector
+	offset   int
+	is_union bool
 
-	// Function
-	returning *Type
+	// Function. params is nil if parameters are not declared.
+	returning   *Type
+	params      *Vector
+	is_variadic bool
 }
 
 // token.go
 
 const (
 	TK_NUM       = iota + 256 // Number literal
+	TK_FNUM                   // Floating-point literal
 	TK_STR                    // String literal
 	TK_IDENT                  // Identifier
 	TK_ARROW                  // ->
 	TK_EXTERN                 // "extern"
+	TK_STATIC                 // "static"
 	TK_TYPEDEF                // "typedef"
 	TK_INT                    // "int"
 	TK_CHAR                   // "char"
+	TK_SHORT                  // "short"
+	TK_LONG                   // "long"
+	TK_SIGNED                 // "signed"
+	TK_UNSIGNED               // "unsigned"
+	TK_FLOAT                  // "float"
+	TK_DOUBLE                 // "double"
 	TK_VOID                   // "void"
 	TK_STRUCT                 // "struct"
+	TK_UNION                  // "union"
+	TK_ENUM                   // "enum"
 	TK_IF                     // "if"
 	TK_ELSE                   // "else"
 	TK_FOR                    // "for"
 	TK_DO                     // "do"
 	TK_WHILE                  // "while"
 	TK_BREAK                  // "break"
+	TK_SWITCH                 // "switch"
+	TK_CASE                   // "case"
+	TK_DEFAULT                // "default"
+	TK_CONTINUE               // "continue"
+	TK_GOTO                   // "goto"
 	TK_EQ                     // ==
 	TK_NE                     // !=
 	TK_LE                     // <=
@@ -84,6 +103,8 @@ const (
 	TK_RETURN                 // "return"
 	TK_SIZEOF                 // "sizeof"
 	TK_ALIGNOF                // "_Alignof"
+	TK_ELLIPSIS               // ...
+	TK_HASHHASH               // ##
 	TK_PARAM                  // Function-like macro parameter
 	TK_EOF                    // End marker
 )
@@ -94,18 +115,34 @@ type Token struct {
 	val  int    // Number literal
 	name string // Identifier
 
+	// Number literal suffix ("U" or "L")
+	is_unsigned bool
+	is_long     bool
+
+	// Floating-point literal. is_float is true if it has an "F" suffix.
+	fval     float64
+	is_float bool
+
 	// String literal
 	str string
 	len int
 
-	// For preprocessor
+	// For preprocessor. A token made by macro expansion has a set of
+	// macro names that must not be expanded again (hideset), and the
+	// macro invocation it comes from (origin).
 	stringize bool
+	hideset   *Map
+	origin    *Token
 
 	// For error reporting
 	buf   string
 	path  string
 	start string
 	end   string
+
+	// For -E. line may be changed by #line.
+	line      int
+	has_space bool
 }
 
 // parse.go
@@ -122,6 +159,16 @@ const (
 	ND_FOR                    // "for"
 	ND_DO_WHILE               // do ... while
 	ND_BREAK                  // break
+	ND_SWITCH                 // "switch"
+	ND_CASE                   // "case"
+	ND_DEFAULT                // "default"
+	ND_CONTINUE               // continue
+	ND_GOTO                   // "goto"
+	ND_LABEL                  // Labeled statement
+	ND_INIT_LIST              // Brace-enclosed initializer list
+	ND_INIT                   // Initializer of a scalar member
+	ND_DESIG                  // Designated initializer
+	ND_CAST                   // Type cast
 	ND_ADDR                   // address-of operator ("&")
 	ND_DEREF                  // pointer dereference ("*")
 	ND_DOT                    // Struct member access
@@ -149,6 +196,9 @@ const (
 	ND_RETURN                 // "return"
 	ND_SIZEOF                 // "sizeof"
 	ND_ALIGNOF                // "_Alignof"
+	ND_VA_START               // __builtin_va_start
+	ND_VA_ARG                 // __builtin_va_arg
+	ND_VA_COPY                // __builtin_va_copy
 	ND_CALL                   // Function call
 	ND_FUNC                   // Function definition
 	ND_COMP_STMT              // Compound statement
@@ -160,11 +210,16 @@ const (
 const (
 	INT = iota
 	CHAR
+	SHORT
+	LONG
+	FLOAT
+	DOUBLE
 	VOID
 	PTR
 	ARY
 	STRUCT
 	FUNC
+	ERR // The type of an erroneous expression
 )
 
 type Node struct {
@@ -173,13 +228,15 @@ type Node struct {
 	lhs   *Node   // left-hand side
 	rhs   *Node   // right-hand side
 	val   int     // Number literal
+	fval  float64 // Floating-point literal
 	expr  *Node   // "return" or expression stmt
 	stmts *Vector // Compound statement
 
 	name string // Identifier
 
-	// Global variable
+	// Global variable or function
 	is_extern bool
+	is_static bool
 	data      string
 	len       int
 
@@ -192,6 +249,9 @@ type Node struct {
 	body *Node
 	inc  *Node
 
+	// Flattened initializer of a variable
+	inits *Vector
+
 	// Function definition
 	stacksize int
 	globals   *Vector
@@ -201,6 +261,19 @@ type Node struct {
 
 	// Function call
 	args *Vector
+
+	// "switch" ( cond ) body
+	// "case" and "default" labels in the body are also in cases.
+	cases *Vector
+
+	// Label number of "case", "default" or a labeled statement
+	label int
+
+	// "goto" target
+	target *Node
+
+	// For error reporting
+	tok *Token
 }
 
 // sema.go
@@ -215,8 +288,18 @@ type Var struct {
 	// global
 	name      string
 	is_extern bool
+	is_static bool
 	data      string
 	len       int
+
+	// Initial values of a global variable. Each element is an ND_INIT
+	// node that has an integer value or an address of a label.
+	// If nil, the variable is zero-filled.
+	inits *Vector
+
+	// For -Wunused-variable
+	tok  *Token
+	used bool
 }
 
 // ir_dump.go
@@ -238,6 +321,7 @@ const (
 	IR_MOV
 	IR_RETURN
 	IR_CALL
+	IR_ICALL // Indirect call to the address in rhs
 	IR_LABEL
 	IR_LABEL_ADDR
 	IR_EQ
@@ -254,10 +338,37 @@ const (
 	IR_JMP
 	IR_IF
 	IR_UNLESS
+	IR_JMP_TABLE
+	IR_CAST
 	IR_LOAD
 	IR_STORE
 	IR_STORE_ARG
-	IR_KILL
+	IR_STORE_STACK_ARG
+	IR_FIMM
+	IR_FMOV
+	IR_FADD
+	IR_FSUB
+	IR_FMUL
+	IR_FDIV
+	IR_FNEG
+	IR_FEQ
+	IR_FNE
+	IR_FLT
+	IR_FLE
+	IR_FLOAD
+	IR_FSTORE
+	IR_FSTORE_ARG
+	IR_FRETURN
+	IR_SRETURN
+	IR_MEMCPY
+	IR_I2F
+	IR_F2I
+	IR_F2F
+	IR_LOAD_SPILL  // Load a spilled register from a stack slot at rbp-rhs
+	IR_STORE_SPILL // Store a spilled register to a stack slot at rbp-rhs
+	IR_FLOAD_SPILL
+	IR_FSTORE_SPILL
+	IR_PHI
 	IR_NOP
 )
 
@@ -272,10 +383,43 @@ type IR struct {
 	// For binary operator. If true, rhs is an immediate.
 	is_imm bool
 
-	// Function call
-	name  string
-	nargs int
-	args  [6]int
+	// If true, operands are treated as unsigned by division, right
+	// shift and comparison. Load and cast zero-extend values.
+	is_unsigned bool
+
+	// Function call. A function is called by name, or through a
+	// pointer in rhs by ICALL. Floating-point arguments are passed in
+	// fargs.
+	// Arguments that don't fit in registers are passed on the stack.
+	// They are stored to stack slots at rbp-offset in stack_args.
+	// If is_fp is true, the return value is a floating-point number.
+	name       string
+	args       []int
+	fargs      []int
+	stack_args []int
+	is_fp      bool
+
+	// A struct returned in registers. sse has a flag for each
+	// eightbyte that is true if it is in an SSE register. A function
+	// call stores a returned struct to a stack slot at rbp-ret_buf.
+	sse     []bool
+	ret_buf int
+
+	// Floating-point registers that are live across a function call.
+	// They are saved by the caller because no XMM register is
+	// callee-saved.
+	live_fp []int
+
+	// Floating-point comparison. The result is set to an integer
+	// register dst.
+	dst int
+
+	// Jump table. rhs is the default label.
+	labels []int
+
+	// Phi node in SSA form. args[i] is the value of lhs when control
+	// comes from preds[i]. is_fp is true for floating-point values.
+	preds []*BB
 }
 
 const (
@@ -292,11 +436,50 @@ const (
 	IR_TY_STORE_ARG
 	IR_TY_REG_LABEL
 	IR_TY_CALL
+	IR_TY_JMP_TABLE
+	IR_TY_CAST
+	IR_TY_FIMM
+	IR_TY_FREG
+	IR_TY_FREG_FREG
+	IR_TY_FREG_REG
+	IR_TY_REG_FREG
+	IR_TY_FCMP
+	IR_TY_FREG_IMM
+	IR_TY_PHI
 )
 
+// cfg.go
+
+// A basic block. succ and pred are vectors of *BB.
+type BB struct {
+	id   int
+	ir   *Vector
+	succ *Vector
+	pred *Vector
+}
+
 type Function struct {
 	name      string
+	is_static bool
 	stacksize int
 	globals   *Vector
-	ir        *Vector
+	bbs       *Vector // Basic blocks. The first one is the entry.
+
+	// Offsets of local variables from BP to their sizes
+	lvars map[int]int
+
+	// Offset of the register save area of a variadic function from
+	// BP, or 0 if the function is not variadic.
+	reg_save_area int
+}
+
+// gen_x86.go
+
+// A line of the assembly output. The code of a function is kept as a
+// list of them until it is written, so that it can be optimized.
+type Insn struct {
+	op    string   // Mnemonic. Empty for a label or a directive.
+	args  []string // Operands in the Intel syntax order
+	label string   // Name of a label
+	text  string   // Directive
 }
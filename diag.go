@@ -0,0 +1,190 @@
+package main
+
+// Diagnostics
+//
+// Errors in a source file are reported through a collector instead of
+// terminating the process, so that a single run can find more than
+// one problem. The parser skips to the end of a broken statement or
+// declaration, and sema gives an erroneous expression the error type
+// to avoid cascading errors. The compiler stops before generating
+// code if any error has been reported.
+//
+// Warnings belong to named categories that are turned on and off by
+// -W<name> and -Wno-<name>. -Werror turns warnings into errors.
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	SEV_WARNING = iota
+	SEV_ERROR
+)
+
+type Diag struct {
+	sev  int
+	path string
+	line int
+	col  int
+	src  string // The source line
+	msg  string
+}
+
+var (
+	diags   []*Diag
+	nerrors int
+
+	// -fmax-errors=N. The compiler stops after N errors if N > 0.
+	max_errors int
+
+	// -Werror
+	werror bool
+)
+
+// Warning categories and whether they are enabled. The ones enabled
+// by default are the same as gcc's.
+var warnings = map[string]bool{
+	"implicit-function-declaration": true,
+	"int-conversion":                true,
+	"return-type":                   false,
+	"unused-variable":               false,
+	"shadow":                        false,
+	"sign-compare":                  false,
+}
+
+// Categories enabled by -Wall and -Wextra
+var (
+	wall   = []string{"implicit-function-declaration", "int-conversion", "return-type", "unused-variable"}
+	wextra = []string{"sign-compare"}
+)
+
+// Makes a diagnostic at a given position in a buffer.
+func new_diag(sev int, buf, path, pos, msg string) *Diag {
+	d := &Diag{sev: sev, path: path, msg: msg}
+	before := buf[:len(buf)-len(pos)]
+	start := strings.LastIndexByte(before, '\n') + 1
+	end := strings.IndexByte(buf[start:], '\n')
+	if end < 0 {
+		end = len(buf) - start
+	}
+	d.line = strings.Count(before, "\n") + 1
+	d.col = len(before) - start + 1
+	d.src = buf[start : start+end]
+	return d
+}
+
+func print_diag(d *Diag) {
+	sev := "error"
+	if d.sev == SEV_WARNING {
+		sev = "warning"
+	}
+	if d.path == "" {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", sev, d.msg)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%s:%d:%d: %s: %s\n", d.path, d.line, d.col, sev, d.msg)
+	fmt.Fprintf(os.Stderr, "%s\n%s^\n", d.src, strings.Repeat(" ", d.col-1))
+}
+
+// Records and prints a diagnostic. The same diagnostic as the last one
+// is dropped, which happens when the parser gives up on nested blocks
+// at the end of a file.
+func report(d *Diag) {
+	if len(diags) > 0 && *diags[len(diags)-1] == *d {
+		return
+	}
+	diags = append(diags, d)
+	print_diag(d)
+
+	if d.sev != SEV_ERROR {
+		return
+	}
+	nerrors++
+	if max_errors > 0 && nerrors >= max_errors {
+		fmt.Fprintf(os.Stderr, "compilation terminated due to -fmax-errors=%d.\n", max_errors)
+		os.Exit(1)
+	}
+}
+
+func tok_diag(sev int, t *Token, msg string) *Diag {
+	if t == nil || t.buf == "" {
+		return &Diag{sev: sev, msg: msg}
+	}
+	d := new_diag(sev, t.buf, t.path, t.start, msg)
+	if t.line > 0 {
+		d.line = t.line
+	}
+	return d
+}
+
+// Reports an error at a given token and continues.
+func error_at(t *Token, format string, a ...interface{}) {
+	report(tok_diag(SEV_ERROR, t, fmt.Sprintf(format, a...)))
+}
+
+// Reports an error at a given position of the input and exits. This
+// is used by the tokenizer and the preprocessor, which don't recover
+// from errors.
+func error_pos(buf, path, pos, msg string) {
+	report(new_diag(SEV_ERROR, buf, path, pos, msg))
+	os.Exit(1)
+}
+
+func bad_token(t *Token, msg string) {
+	error_at(t, "%s", msg)
+	os.Exit(1)
+}
+
+// Handles a -W option without "-W". Returns false if the option is
+// unknown.
+func warning_opt(opt string) bool {
+	switch opt {
+	case "error":
+		werror = true
+		return true
+	case "no-error":
+		werror = false
+		return true
+	case "all":
+		for _, name := range wall {
+			warnings[name] = true
+		}
+		return true
+	case "extra":
+		for _, name := range wextra {
+			warnings[name] = true
+		}
+		return true
+	}
+
+	on := !strings.HasPrefix(opt, "no-")
+	name := strings.TrimPrefix(opt, "no-")
+	if _, ok := warnings[name]; !ok {
+		return false
+	}
+	warnings[name] = on
+	return true
+}
+
+// Reports a warning of a given category at a given token if the
+// category is enabled.
+func warn(t *Token, name, format string, a ...interface{}) {
+	if !warnings[name] {
+		return
+	}
+	msg := fmt.Sprintf(format, a...)
+	if werror {
+		report(tok_diag(SEV_ERROR, t, msg+" [-Werror="+name+"]"))
+		return
+	}
+	report(tok_diag(SEV_WARNING, t, msg+" [-W"+name+"]"))
+}
+
+// Exits with a non-zero status if any error has been reported.
+func check_errors() {
+	if nerrors > 0 {
+		os.Exit(1)
+	}
+}
@@ -1,7 +1,6 @@
 // How to run:
 //
-//   $ ./9ccgo examples/nqueen.c > tmp-nqueen.s
-//   $ gcc -static -o tmp-nqueen tmp-nqueen.s
+//   $ ./9ccgo -o tmp-nqueen examples/nqueen.c
 //   $ ./tmp-nqueen
 
 int print_board(int board[][10]) {
@@ -0,0 +1,387 @@
+package main
+
+// Constant folding
+//
+// The evaluator in this file computes the values of integer constant
+// expressions by the C rules: an operation is done in the common type
+// of its operands, and its result wraps around to the width of that
+// type. An expression whose value is undefined, such as a division by
+// zero or a shift by the width of a type or more, is not a constant.
+//
+// The parser uses the evaluator for enumerators and array sizes, and
+// sema uses it for case labels. After sema, fold_constants replaces
+// constant expressions in function bodies with numbers and removes
+// operations with identity elements, such as x*1 and x+0.
+
+// Evaluates a given node as an integer constant expression and
+// returns its value and type. The value is converted to the type,
+// so an unsigned value narrower than 8 bytes is never negative.
+//
+// The parser evaluates expressions that sema has not seen, in which
+// operators have no types and operands are not converted, so the
+// usual conversions are done here as well. The type is returned even
+// if the value is not constant, because `?:` needs the types of both
+// arms. It is nil if it is unknown.
+func eval_int(node *Node) (int, *Type, bool) {
+	switch node.op {
+	case ND_NUM:
+		if is_flonum(node.ty) {
+			return 0, node.ty, false
+		}
+		return node.val, node.ty, true
+	case ND_CAST:
+		{
+			if node.expr == nil || !is_integer(node.ty) {
+				return 0, node.ty, false
+			}
+			if node.expr.ty != nil && is_flonum(node.expr.ty) {
+				f, ok := eval_flonum(node.expr)
+				if node.ty.is_unsigned && node.ty.size == 8 {
+					return int(uint64(f)), node.ty, ok
+				}
+				return wrap_int(int(f), node.ty), node.ty, ok
+			}
+			val, _, ok := eval_int(node.expr)
+			return wrap_int(val, node.ty), node.ty, ok
+		}
+	case ND_NEG, '~':
+		{
+			val, ty, ok := eval_int(node.expr)
+			if ty == nil || !is_integer(ty) {
+				return 0, ty, false
+			}
+			ty = int_promote(ty)
+			if node.op == ND_NEG {
+				return wrap_int(-val, ty), ty, ok
+			}
+			return wrap_int(^val, ty), ty, ok
+		}
+	case '!':
+		{
+			val, _, ok := eval_int(node.expr)
+			return bool_to_int(val == 0), int_tyf(), ok
+		}
+	case ND_LOGAND, ND_LOGOR:
+		{
+			// The rhs is not evaluated if the lhs decides the result.
+			lhs, _, ok := eval_int(node.lhs)
+			if !ok {
+				return 0, int_tyf(), false
+			}
+			if (lhs != 0) == (node.op == ND_LOGOR) {
+				return bool_to_int(lhs != 0), int_tyf(), true
+			}
+			rhs, _, ok := eval_int(node.rhs)
+			return bool_to_int(rhs != 0), int_tyf(), ok
+		}
+	case '?':
+		{
+			cond, _, ok := eval_int(node.cond)
+			val1, t1, ok1 := eval_int(node.then)
+			val2, t2, ok2 := eval_int(node.els)
+
+			ty := node.ty
+			if ty == nil && t1 != nil && t2 != nil && is_arith(t1) && is_arith(t2) {
+				ty = arith_conv(t1, t2)
+			}
+			if ty == nil || !is_integer(ty) || !ok {
+				return 0, ty, false
+			}
+			if cond != 0 {
+				return wrap_int(val1, ty), ty, ok1
+			}
+			return wrap_int(val2, ty), ty, ok2
+		}
+	case ',':
+		{
+			_, _, ok1 := eval_int(node.lhs)
+			val, ty, ok2 := eval_int(node.rhs)
+			return val, ty, ok1 && ok2
+		}
+	case '+', '-', '*', '/', '%', '&', '|', '^', ND_SHL, ND_SHR, '<', ND_LE, ND_EQ, ND_NE:
+		return eval_binop(node)
+	}
+	return 0, node.ty, false
+}
+
+func eval_binop(node *Node) (int, *Type, bool) {
+	lhs, t1, ok1 := eval_int(node.lhs)
+	rhs, t2, ok2 := eval_int(node.rhs)
+	if t1 == nil || t2 == nil || !is_integer(t1) || !is_integer(t2) {
+		return 0, node.ty, false
+	}
+
+	// The type in which the operation is done. A shift is done in the
+	// promoted type of its lhs.
+	var ty *Type
+	if node.op == ND_SHL || node.op == ND_SHR {
+		ty = int_promote(t1)
+	} else {
+		ty = arith_conv(t1, t2)
+		rhs = wrap_int(rhs, ty)
+	}
+	lhs = wrap_int(lhs, ty)
+
+	ret_ty := ty
+	if node.op == '<' || node.op == ND_LE || node.op == ND_EQ || node.op == ND_NE {
+		ret_ty = int_tyf()
+	}
+	if !ok1 || !ok2 {
+		return 0, ret_ty, false
+	}
+
+	var val int
+	switch node.op {
+	case '+':
+		val = lhs + rhs
+	case '-':
+		val = lhs - rhs
+	case '*':
+		val = lhs * rhs
+	case '/', '%':
+		if rhs == 0 {
+			return 0, ty, false
+		}
+		if ty.is_unsigned {
+			if node.op == '/' {
+				val = int(uint64(lhs) / uint64(rhs))
+			} else {
+				val = int(uint64(lhs) % uint64(rhs))
+			}
+			break
+		}
+		// The minimum value divided by -1 overflows.
+		if rhs == -1 && lhs == -1<<uint(ty.size*8-1) {
+			return 0, ty, false
+		}
+		if node.op == '/' {
+			val = lhs / rhs
+		} else {
+			val = lhs % rhs
+		}
+	case '&':
+		val = lhs & rhs
+	case '|':
+		val = lhs | rhs
+	case '^':
+		val = lhs ^ rhs
+	case ND_SHL, ND_SHR:
+		if rhs < 0 || rhs >= ty.size*8 {
+			return 0, ty, false
+		}
+		if node.op == ND_SHL {
+			val = lhs << uint(rhs)
+		} else if ty.is_unsigned {
+			val = int(uint64(lhs) >> uint(rhs))
+		} else {
+			val = lhs >> uint(rhs)
+		}
+	case '<':
+		if ty.is_unsigned {
+			val = bool_to_int(uint64(lhs) < uint64(rhs))
+		} else {
+			val = bool_to_int(lhs < rhs)
+		}
+	case ND_LE:
+		if ty.is_unsigned {
+			val = bool_to_int(uint64(lhs) <= uint64(rhs))
+		} else {
+			val = bool_to_int(lhs <= rhs)
+		}
+	case ND_EQ:
+		val = bool_to_int(lhs == rhs)
+	case ND_NE:
+		val = bool_to_int(lhs != rhs)
+	}
+	return wrap_int(val, ret_ty), ret_ty, true
+}
+
+// Evaluates a given node as an integer constant expression.
+// The second return value is false if the node is not a constant.
+func eval(node *Node) (int, bool) {
+	val, _, ok := eval_int(node)
+	return val, ok
+}
+
+// Evaluates a given node as an arithmetic constant expression and
+// returns its value as a floating-point number.
+func eval_flonum(node *Node) (float64, bool) {
+	if is_integer(node.ty) {
+		val, ok := eval(node)
+		if node.ty.is_unsigned && node.ty.size == 8 {
+			return float64(uint64(val)), ok
+		}
+		return float64(val), ok
+	}
+
+	switch node.op {
+	case ND_NUM:
+		return node.fval, true
+	case ND_CAST:
+		{
+			f, ok := eval_flonum(node.expr)
+			if node.ty.ty == FLOAT {
+				f = float64(float32(f))
+			}
+			return f, ok
+		}
+	case ND_NEG:
+		{
+			f, ok := eval_flonum(node.expr)
+			return -f, ok
+		}
+	case '?':
+		{
+			cond, ok := eval(node.cond)
+			if !ok {
+				return 0, false
+			}
+			if cond != 0 {
+				return eval_flonum(node.then)
+			}
+			return eval_flonum(node.els)
+		}
+	case '+', '-', '*', '/':
+		{
+			lhs, ok1 := eval_flonum(node.lhs)
+			rhs, ok2 := eval_flonum(node.rhs)
+			if !ok1 || !ok2 {
+				return 0, false
+			}
+			var f float64
+			switch node.op {
+			case '+':
+				f = lhs + rhs
+			case '-':
+				f = lhs - rhs
+			case '*':
+				f = lhs * rhs
+			default:
+				f = lhs / rhs
+			}
+			if node.ty.ty == FLOAT {
+				f = float64(float32(f))
+			}
+			return f, true
+		}
+	}
+	return 0, false
+}
+
+func bool_to_int(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func is_num(node *Node, val int) bool {
+	return node.op == ND_NUM && !is_flonum(node.ty) && node.val == val
+}
+
+// Replaces an operation whose result is one of its operands, such as
+// x*1 or `1 ? x : y`, with that operand. Sema has converted the
+// operands to the type of the result.
+func simplify(node *Node) *Node {
+	if node.ty == nil || !is_integer(node.ty) && node.ty.ty != PTR {
+		return node
+	}
+
+	switch node.op {
+	case '?':
+		if node.cond.op == ND_NUM {
+			if node.cond.val != 0 {
+				return node.then
+			}
+			return node.els
+		}
+	case '*':
+		if is_num(node.rhs, 1) {
+			return node.lhs
+		}
+		if is_num(node.lhs, 1) {
+			return node.rhs
+		}
+	case '/':
+		if is_num(node.rhs, 1) {
+			return node.lhs
+		}
+	case '+', '|', '^':
+		if is_num(node.rhs, 0) {
+			return node.lhs
+		}
+		if is_num(node.lhs, 0) {
+			return node.rhs
+		}
+	case '-', ND_SHL, ND_SHR:
+		if is_num(node.rhs, 0) {
+			return node.lhs
+		}
+	}
+	return node
+}
+
+// Returns true if the operands of a given node are numbers, so that
+// the node may be a constant. Only the first operand of `?:`, && and
+// || has to be a number because the others may not be evaluated.
+func has_const_operands(node *Node) bool {
+	switch node.op {
+	case '?':
+		return node.cond.op == ND_NUM
+	case ND_LOGAND, ND_LOGOR:
+		return node.lhs.op == ND_NUM
+	}
+	for _, n := range []*Node{node.lhs, node.rhs, node.expr} {
+		if n != nil && n.op != ND_NUM {
+			return false
+		}
+	}
+	return true
+}
+
+// Folds a given tree bottom-up and returns the node that replaces it.
+func fold_node(node *Node) *Node {
+	if node == nil {
+		return nil
+	}
+
+	node.lhs = fold_node(node.lhs)
+	node.rhs = fold_node(node.rhs)
+	node.expr = fold_node(node.expr)
+	node.cond = fold_node(node.cond)
+	node.then = fold_node(node.then)
+	node.els = fold_node(node.els)
+	node.init = fold_node(node.init)
+	node.body = fold_node(node.body)
+	node.inc = fold_node(node.inc)
+	for _, v := range []*Vector{node.stmts, node.args, node.inits} {
+		if v == nil {
+			continue
+		}
+		for i := 0; i < v.len; i++ {
+			v.data[i] = fold_node(v.data[i].(*Node))
+		}
+	}
+
+	if node.op == ND_NUM || node.ty == nil || !is_integer(node.ty) {
+		return simplify(node)
+	}
+	if has_const_operands(node) {
+		if val, ok := eval(node); ok {
+			ret := new_int(val)
+			ret.ty = node.ty
+			ret.tok = node.tok
+			return ret
+		}
+	}
+	return simplify(node)
+}
+
+func fold_constants(nodes *Vector) {
+	for i := 0; i < nodes.len; i++ {
+		node := nodes.data[i].(*Node)
+		if node.op == ND_FUNC {
+			node.body = fold_node(node.body)
+		}
+	}
+}
@@ -5,11 +5,16 @@ package main
 //
 // IR resembles the real x86-64 instruction set, but it has infinite
 // number of registers. We don't try too hard to reuse registers in
-// this pass. Instead, we "kill" registers to mark them as dead when
-// we are done with them and use new registers.
+// this pass. Instead, we use new registers whenever we need them.
 //
 // Such infinite number of registers are mapped to a finite registers
-// in a later pass.
+// in a later pass, which finds out where each register is live.
+//
+// Floating-point values live in a separate class of registers. They
+// are handled by IR instructions whose names start with "F", and
+// converted from and to integers by I2F and F2I.
+
+import "math"
 
 var (
 	code         *Vector
@@ -17,7 +22,34 @@ var (
 	nlabel       = 1
 	return_label int
 	return_reg   int
+	ret_ptr      int
 	break_label  int
+	cont_label   int
+
+	// Size of the current stack frame. Temporary stack slots are
+	// allocated at the end of the frame.
+	frame_size int
+
+	// Local variables of the current function. Offsets to sizes.
+	lvars map[int]int
+
+	// Where the variable arguments of the current function start.
+	// Named arguments occupy the first gp_offset bytes and the first
+	// fp_offset bytes of the register save area, and nstack_args
+	// slots on the stack.
+	reg_save_area int
+	gp_offset     int
+	fp_offset     int
+	nstack_args   int
+)
+
+const (
+	num_argregs  = 6
+	num_fargregs = 8
+
+	// Size of the register save area of a variadic function. Integer
+	// registers are followed by 16-byte slots of SSE registers.
+	reg_save_size = num_argregs*8 + num_fargregs*16
 )
 
 func add(op, lhs, rhs int) *IR {
@@ -35,10 +67,6 @@ func add_imm(op, lhs, rhs int) *IR {
 	return ir
 }
 
-func kill(r int) {
-	add(IR_KILL, r, -1)
-}
-
 func label(x int) {
 	add(IR_LABEL, x, -1)
 }
@@ -47,21 +75,298 @@ func jmp(x int) {
 	add(IR_JMP, x, -1)
 }
 
+// A struct is handled by its address because it doesn't fit in a
+// register. Loading a struct is a no-op and storing it copies memory.
 func load(node *Node, dst, src int) {
-	ir := add(IR_LOAD, dst, src)
+	op := IR_LOAD
+	if is_flonum(node.ty) {
+		op = IR_FLOAD
+	}
+	ir := add(op, dst, src)
 	ir.size = node.ty.size
+	ir.is_unsigned = is_unsigned(node.ty)
+}
+
+// Loads a value of a given node from an address. A floating-point
+// value is loaded to a new register because it belongs to a different
+// register class than the address.
+func gen_load(node *Node, addr int) int {
+	if node.ty.ty == STRUCT {
+		return addr
+	}
+	if !is_flonum(node.ty) {
+		load(node, addr, addr)
+		return addr
+	}
+	r := nreg
+	nreg++
+	load(node, r, addr)
+	return r
+}
+
+// Sets a floating-point constant of a given type to a register.
+// The constant is represented as its bit pattern.
+func gen_fimm(r int, val float64, ty *Type) {
+	ir := add(IR_FIMM, r, int(math.Float64bits(val)))
+	if ty.ty == FLOAT {
+		ir.rhs = int(math.Float32bits(float32(val)))
+	}
+	ir.size = ty.size
+}
+
+// Applies a floating-point operator to a register and a constant.
+func add_fimm(op, r int, val float64, ty *Type) {
+	r2 := nreg
+	nreg++
+	gen_fimm(r2, val, ty)
+	ir := add(op, r, r2)
+	ir.size = ty.size
+}
+
+// Values of integer types narrower than 64 bits are kept sign- or
+// zero-extended to 64 bits in registers. This function restores that
+// invariant for a value of a given type after an operation that may
+// overflow, or converts a value to a narrower type.
+func gen_wrap(r int, ty *Type) {
+	if !is_integer(ty) || ty.size == 8 {
+		return
+	}
+	ir := add(IR_CAST, r, -1)
+	ir.size = ty.size
+	ir.is_unsigned = ty.is_unsigned
+}
+
+// Converts a value in a given register from one type to another and
+// returns the register that has the result. Widening an integer needs
+// no code because the value is already extended to 64 bits.
+func gen_conv(r int, from, to *Type) int {
+	if is_flonum(from) && is_flonum(to) {
+		if from.size != to.size {
+			ir := add(IR_F2F, r, -1)
+			ir.size = to.size
+		}
+		return r
+	}
+
+	// Only unsigned long needs special care because other unsigned
+	// values fit in a signed 64-bit integer.
+	if is_flonum(from) && is_arith(to) {
+		r2 := nreg
+		nreg++
+		ir := add(IR_F2I, r2, r)
+		ir.size = from.size
+		ir.is_unsigned = to.is_unsigned && to.size == 8
+		gen_wrap(r2, to)
+		return r2
+	}
+	if is_flonum(to) {
+		r2 := nreg
+		nreg++
+		ir := add(IR_I2F, r2, r)
+		ir.size = to.size
+		ir.is_unsigned = from.is_unsigned && from.size == 8
+		return r2
+	}
+
+	if !is_integer(to) {
+		return r
+	}
+	if is_integer(from) && from.size < to.size && (from.is_unsigned || !to.is_unsigned) {
+		return r
+	}
+	if is_integer(from) && from.size == to.size && from.is_unsigned == to.is_unsigned {
+		return r
+	}
+	gen_wrap(r, to)
+	return r
 }
 
 func store(node *Node, dst, src int) {
-	ir := add(IR_STORE, dst, src)
+	op := IR_STORE
+	if is_flonum(node.ty) {
+		op = IR_FSTORE
+	} else if node.ty.ty == STRUCT {
+		op = IR_MEMCPY
+	}
+	ir := add(op, dst, src)
 	ir.size = node.ty.size
 }
 
+func alloc_temp(size int) int {
+	frame_size = roundup(frame_size+size, 8)
+	return frame_size
+}
+
+// Copies a struct at a given address to a new stack slot whose size
+// is a multiple of 8 bytes, so that the struct can be read in 8-byte
+// chunks. Returns the offset of the slot.
+func copy_to_temp(r int, ty *Type) int {
+	off := alloc_temp(roundup(ty.size, 8))
+	dst := nreg
+	nreg++
+	add(IR_BPREL, dst, off)
+	ir := add(IR_MEMCPY, dst, r)
+	ir.size = ty.size
+	return off
+}
+
+// In the System V ABI, a struct of up to 16 bytes is split into
+// eightbytes. Each of them is passed in an SSE register if it only
+// has floating-point members, or in a general-purpose register
+// otherwise. Returns the classes of eightbytes, or nil if a struct is
+// passed in memory.
+func classify(ty *Type) []bool {
+	if ty.size > 16 {
+		return nil
+	}
+	var sse []bool
+	for off := 0; off < ty.size; off += 8 {
+		sse = append(sse, is_sse(ty, off, off+8, 0))
+	}
+	return sse
+}
+
+// Returns true if all scalars of a given type placed at off overlapping
+// with [lo, hi) are floating-point numbers.
+func is_sse(ty *Type, lo, hi, off int) bool {
+	switch ty.ty {
+	case STRUCT:
+		for i := 0; i < ty.members.len; i++ {
+			m := ty.members.data[i].(*Node)
+			if !is_sse(m.ty, lo, hi, off+m.ty.offset) {
+				return false
+			}
+		}
+		return true
+	case ARY:
+		for i := 0; i < ty.len; i++ {
+			if !is_sse(ty.ary_of, lo, hi, off+ty.ary_of.size*i) {
+				return false
+			}
+		}
+		return true
+	}
+	return off+ty.size <= lo || hi <= off || is_flonum(ty)
+}
+
+// Returns the numbers of general-purpose and SSE registers to pass a
+// struct of given classes.
+func count_regs(sse []bool) (int, int) {
+	n, nf := 0, 0
+	for _, s := range sse {
+		if s {
+			nf++
+		} else {
+			n++
+		}
+	}
+	return n, nf
+}
+
 func store_arg(node *Node, bpoff, argreg int) {
-	ir := add(IR_STORE_ARG, bpoff, argreg)
+	op := IR_STORE_ARG
+	if is_flonum(node.ty) {
+		op = IR_FSTORE_ARG
+	}
+	ir := add(op, bpoff, argreg)
 	ir.size = node.ty.size
 }
 
+// Loads a field of a va_list pointed to by ap.
+func load_field(ap, off, size int) int {
+	r := nreg
+	nreg++
+	add(IR_MOV, r, ap)
+	add_imm(IR_ADD, r, off)
+	ir := add(IR_LOAD, r, r)
+	ir.size = size
+	ir.is_unsigned = true
+	return r
+}
+
+// Stores a value to a field of a va_list.
+func store_field(ap, off, r, size int) {
+	addr := nreg
+	nreg++
+	add(IR_MOV, addr, ap)
+	add_imm(IR_ADD, addr, off)
+	ir := add(IR_STORE, addr, r)
+	ir.size = size
+}
+
+func gen_va_start(node *Node) int {
+	ap := gen_expr(node.expr)
+
+	r := nreg
+	nreg++
+	add(IR_IMM, r, gp_offset)
+	store_field(ap, 0, r, 4)
+
+	r = nreg
+	nreg++
+	add(IR_IMM, r, fp_offset)
+	store_field(ap, 4, r, 4)
+
+	// Arguments on the stack are above the return address.
+	r = nreg
+	nreg++
+	add(IR_BPREL, r, -(16 + nstack_args*8))
+	store_field(ap, 8, r, 8)
+
+	r = nreg
+	nreg++
+	add(IR_BPREL, r, reg_save_area)
+	store_field(ap, 16, r, 8)
+	return ap
+}
+
+// Takes the next argument from the register save area if there is
+// any left in the class of a given type, or from the stack otherwise.
+func gen_va_arg(node *Node) int {
+	off, limit, step := 0, num_argregs*8, 8
+	if is_flonum(node.ty) {
+		off, limit, step = 4, reg_save_size, 16
+	}
+
+	x := nlabel
+	nlabel++
+	y := nlabel
+	nlabel++
+	ap := gen_expr(node.expr)
+
+	r := load_field(ap, off, 4)
+	r2 := nreg
+	nreg++
+	add(IR_IMM, r2, limit)
+	add(IR_LT, r, r2)
+	add(IR_UNLESS, r, x)
+
+	addr := load_field(ap, 16, 8)
+	r = load_field(ap, off, 4)
+	add(IR_ADD, addr, r)
+	add_imm(IR_ADD, r, step)
+	store_field(ap, off, r, 4)
+	jmp(y)
+
+	label(x)
+	r = load_field(ap, 8, 8)
+	add(IR_MOV, addr, r)
+	add_imm(IR_ADD, r, 8)
+	store_field(ap, 8, r, 8)
+	label(y)
+
+	return gen_load(node, addr)
+}
+
+func gen_va_copy(node *Node) int {
+	dst := gen_expr(node.lhs)
+	src := gen_expr(node.rhs)
+	for off := 0; off < 24; off += 8 {
+		store_field(dst, off, load_field(src, off, 8), 8)
+	}
+	return dst
+}
+
 // In C, all expressions that can be written on the left-hand side of
 // the '=' operator must habe an address in memory. IN other words, if
 // you can apply the '&' operator to take an address of some
@@ -96,6 +401,12 @@ func gen_lval(node *Node) int {
 		add(IR_BPREL, r, node.offset)
 		return r
 	}
+	// A struct returned by a function call or other expressions
+	// is already in memory.
+	if node.op != ND_GVAR && node.ty.ty == STRUCT {
+		return gen_expr(node)
+	}
+
 	// assert(node.op == ND_GVAR)
 	r := nreg
 	nreg++
@@ -104,10 +415,54 @@ func gen_lval(node *Node) int {
 	return r
 }
 
+// Returns the floating-point counterpart of an integer IR operator.
+func to_fp_op(op int) int {
+	switch op {
+	case IR_ADD:
+		return IR_FADD
+	case IR_SUB:
+		return IR_FSUB
+	case IR_MUL:
+		return IR_FMUL
+	case IR_DIV:
+		return IR_FDIV
+	case IR_EQ:
+		return IR_FEQ
+	case IR_NE:
+		return IR_FNE
+	case IR_LT:
+		return IR_FLT
+	default:
+		//assert(op == IR_LE)
+		return IR_FLE
+	}
+}
+
+func gen_fbinop(op int, node *Node) int {
+	lhs, rhs := gen_expr(node.lhs), gen_expr(node.rhs)
+	ir := add(op, lhs, rhs)
+	ir.size = node.lhs.ty.size
+
+	if op == IR_FEQ || op == IR_FNE || op == IR_FLT || op == IR_FLE {
+		ir.dst = nreg
+		nreg++
+		return ir.dst
+	}
+	return lhs
+}
+
 func gen_binop(ty int, node *Node) int {
+	if is_flonum(node.lhs.ty) {
+		return gen_fbinop(to_fp_op(ty), node)
+	}
+
 	lhs, rhs := gen_expr(node.lhs), gen_expr(node.rhs)
-	add(ty, lhs, rhs)
-	kill(rhs)
+	ir := add(ty, lhs, rhs)
+	ir.is_unsigned = is_unsigned(node.lhs.ty)
+
+	if ty == IR_ADD || ty == IR_SUB || ty == IR_MUL || ty == IR_SHL {
+		gen_wrap(lhs, node.ty)
+	}
 	return lhs
 }
 
@@ -123,15 +478,24 @@ func gen_pre_inc(node *Node, num int) int {
 	val := nreg
 	nreg++
 	load(node, val, addr)
-	add_imm(IR_ADD, val, num*get_inc_scale(node))
+	if is_flonum(node.ty) {
+		add_fimm(IR_FADD, val, float64(num), node.ty)
+	} else {
+		add_imm(IR_ADD, val, num*get_inc_scale(node))
+		gen_wrap(val, node.ty)
+	}
 	store(node, addr, val)
-	kill(addr)
 	return val
 }
 
 func gen_post_inc(node *Node, num int) int {
 	val := gen_pre_inc(node, num)
+	if is_flonum(node.ty) {
+		add_fimm(IR_FSUB, val, float64(num), node.ty)
+		return val
+	}
 	add_imm(IR_SUB, val, num*get_inc_scale(node))
+	gen_wrap(val, node.ty)
 	return val
 }
 
@@ -162,19 +526,175 @@ func to_assign_op(op int) int {
 }
 
 func gen_assign_op(node *Node) int {
+	// The operation is done in the common type of both operands, or
+	// in the promoted type of lhs for shift and pointer arithmetic.
+	ty := node.rhs.ty
+	if node.op == ND_SHL_EQ || node.op == ND_SHR_EQ || node.ty.ty == PTR {
+		ty = int_promote(node.ty)
+	}
+
 	src := gen_expr(node.rhs)
 	dst := gen_lval(node.lhs)
 	val := nreg
 	nreg++
 
 	load(node, val, dst)
-	add(to_assign_op(node.op), val, src)
-	kill(src)
+	val = gen_conv(val, node.ty, ty)
+	if is_flonum(ty) {
+		ir := add(to_fp_op(to_assign_op(node.op)), val, src)
+		ir.size = ty.size
+	} else {
+		ir := add(to_assign_op(node.op), val, src)
+		ir.is_unsigned = is_unsigned(ty)
+	}
+	gen_wrap(val, ty)
+	val = gen_conv(val, ty, node.ty)
 	store(node, dst, val)
-	kill(dst)
 	return val
 }
 
+func gen_call(node *Node) int {
+	var args, fargs, stack_args []int
+	nargs, nfargs := 0, 0
+
+	// A struct returned in memory is written to a buffer whose address
+	// is passed as a hidden first argument. A struct returned in
+	// registers is stored to a buffer after the call.
+	ret_buf := 0
+	var ret_sse []bool
+	if node.ty.ty == STRUCT {
+		ret_buf = alloc_temp(roundup(node.ty.size, 8))
+		ret_sse = classify(node.ty)
+		if ret_sse == nil {
+			nargs++
+		}
+	}
+
+	// Arguments that don't fit in registers are passed on the stack.
+	// A struct is passed on the stack as a whole if it is larger than
+	// 16 bytes or if there are not enough registers for it.
+	classes := make([][]bool, node.args.len)
+	on_stack := make([]bool, node.args.len)
+	for i := 0; i < node.args.len; i++ {
+		arg := node.args.data[i].(*Node)
+		switch {
+		case arg.ty.ty == STRUCT:
+			sse := classify(arg.ty)
+			n, nf := count_regs(sse)
+			if sse == nil || nargs+n > num_argregs || nfargs+nf > num_fargregs {
+				on_stack[i] = true
+				break
+			}
+			classes[i] = sse
+			nargs += n
+			nfargs += nf
+		case is_flonum(arg.ty):
+			on_stack[i] = nfargs >= num_fargregs
+			nfargs++
+		default:
+			on_stack[i] = nargs >= num_argregs
+			nargs++
+		}
+	}
+
+	// Stack arguments are evaluated first and stored to temporary
+	// slots, so that they don't occupy registers until the call.
+	for i := 0; i < node.args.len; i++ {
+		if !on_stack[i] {
+			continue
+		}
+		arg := node.args.data[i].(*Node)
+		r := gen_expr(arg)
+		if arg.ty.ty == STRUCT {
+			off := copy_to_temp(r, arg.ty)
+			for j := 0; j < arg.ty.size; j += 8 {
+				stack_args = append(stack_args, off-j)
+			}
+			continue
+		}
+
+		off := alloc_temp(8)
+		addr := nreg
+		nreg++
+		add(IR_BPREL, addr, off)
+		if is_flonum(arg.ty) {
+			store(arg, addr, r)
+		} else {
+			ir := add(IR_STORE, addr, r)
+			ir.size = 8
+		}
+		stack_args = append(stack_args, off)
+	}
+
+	if ret_buf != 0 && ret_sse == nil {
+		r := nreg
+		nreg++
+		add(IR_BPREL, r, ret_buf)
+		args = append(args, r)
+	}
+
+	for i := 0; i < node.args.len; i++ {
+		if on_stack[i] {
+			continue
+		}
+		arg := node.args.data[i].(*Node)
+		if arg.ty.ty == STRUCT {
+			off := copy_to_temp(gen_expr(arg), arg.ty)
+			for j, sse := range classes[i] {
+				r := nreg
+				nreg++
+				add(IR_BPREL, r, off-j*8)
+				if sse {
+					fr := nreg
+					nreg++
+					ir := add(IR_FLOAD, fr, r)
+					ir.size = 8
+					fargs = append(fargs, fr)
+				} else {
+					ir := add(IR_LOAD, r, r)
+					ir.size = 8
+					args = append(args, r)
+				}
+			}
+			continue
+		}
+		if is_flonum(arg.ty) {
+			fargs = append(fargs, gen_expr(arg))
+		} else {
+			args = append(args, gen_expr(arg))
+		}
+	}
+	// A function pointer is evaluated last so that it doesn't occupy
+	// a register while evaluating arguments.
+	fp := -1
+	if node.expr != nil {
+		fp = gen_expr(node.expr)
+	}
+
+	r := nreg
+	nreg++
+
+	ir := add(IR_CALL, r, -1)
+	if fp != -1 {
+		ir.op = IR_ICALL
+		ir.rhs = fp
+	}
+	ir.name = node.name
+	ir.args = args
+	ir.fargs = fargs
+	ir.stack_args = stack_args
+	ir.is_fp = is_flonum(node.ty)
+	if ret_sse != nil {
+		ir.sse = ret_sse
+		ir.ret_buf = ret_buf
+	}
+
+	// Upper bits of a return value narrower than 64 bits
+	// are undefined in the System V ABI.
+	gen_wrap(r, node.ty)
+	return r
+}
+
 func gen_expr(node *Node) int {
 
 	switch node.op {
@@ -182,6 +702,10 @@ func gen_expr(node *Node) int {
 		{
 			r := nreg
 			nreg++
+			if is_flonum(node.ty) {
+				gen_fimm(r, node.fval, node.ty)
+				return r
+			}
 			add(IR_IMM, r, node.val)
 			return r
 		}
@@ -197,7 +721,6 @@ func gen_expr(node *Node) int {
 			add(IR_UNLESS, r1, x)
 			r2 := gen_expr(node.rhs)
 			add(IR_MOV, r1, r2)
-			kill(r2)
 			add(IR_UNLESS, r1, x)
 			add(IR_IMM, r1, 1)
 			label(x)
@@ -216,49 +739,22 @@ func gen_expr(node *Node) int {
 			label(x)
 			r2 := gen_expr(node.rhs)
 			add(IR_MOV, r1, r2)
-			kill(r2)
 			add(IR_UNLESS, r1, y)
 			add(IR_IMM, r1, 1)
 			label(y)
 			return r1
 		}
 	case ND_GVAR, ND_LVAR, ND_DOT:
-		{
-			r := gen_lval(node)
-			load(node, r, r)
-			return r
-		}
+		return gen_load(node, gen_lval(node))
 
 	case ND_CALL:
-		{
-			var args [6]int
-			for i := 0; i < node.args.len; i++ {
-				args[i] = gen_expr(node.args.data[i].(*Node))
-			}
-			r := nreg
-			nreg++
-
-			ir := add(IR_CALL, r, -1)
-			ir.name = node.name
-			ir.nargs = node.args.len
-			for i := 0; i < 6; i++ {
-				ir.args[i] = args[i]
-			}
-			for i := 0; i < ir.nargs; i++ {
-				kill(ir.args[i])
-			}
-			return r
-		}
+		return gen_call(node)
 	case ND_ADDR:
 		{
 			return gen_lval(node.expr)
 		}
 	case ND_DEREF:
-		{
-			r := gen_expr(node.expr)
-			load(node, r, r)
-			return r
-		}
+		return gen_load(node, gen_expr(node.expr))
 	case ND_STMT_EXPR:
 		{
 			orig_label := return_label
@@ -282,7 +778,9 @@ func gen_expr(node *Node) int {
 		{
 			rhs, lhs := gen_expr(node.rhs), gen_lval(node.lhs)
 			store(node, lhs, rhs)
-			kill(lhs)
+			if node.ty.ty == STRUCT {
+				return lhs
+			}
 			return rhs
 		}
 	case '+':
@@ -313,23 +811,44 @@ func gen_expr(node *Node) int {
 		{
 			r := gen_expr(node.expr)
 			add_imm(IR_XOR, r, -1)
+			gen_wrap(r, node.ty)
 			return r
 		}
 	case ND_NEG:
 		{
 			r := gen_expr(node.expr)
+			if is_flonum(node.ty) {
+				ir := add(IR_FNEG, r, -1)
+				ir.size = node.ty.size
+				return r
+			}
 			add(IR_NEG, r, -1)
+			gen_wrap(r, node.ty)
 			return r
 		}
+	case ND_VA_START:
+		return gen_va_start(node)
+	case ND_VA_ARG:
+		return gen_va_arg(node)
+	case ND_VA_COPY:
+		return gen_va_copy(node)
+	case ND_CAST:
+		{
+			return gen_conv(gen_expr(node.expr), node.expr.ty, node.ty)
+		}
 	case ND_POST_INC:
 		return gen_post_inc(node, 1)
 	case ND_POST_DEC:
 		return gen_post_inc(node, -1)
 	case ',':
-		kill(gen_expr(node.lhs))
+		gen_expr(node.lhs)
 		return gen_expr(node.rhs)
 	case '?':
 		{
+			if is_flonum(node.ty) {
+				return gen_fcond(node)
+			}
+
 			x := nlabel
 			nlabel++
 			y := nlabel
@@ -339,13 +858,11 @@ func gen_expr(node *Node) int {
 			add(IR_UNLESS, r, x)
 			r2 := gen_expr(node.then)
 			add(IR_MOV, r, r2)
-			kill(r2)
 			jmp(y)
 
 			label(x)
 			r3 := gen_expr(node.els)
 			add(IR_MOV, r, r3)
-			kill(r2)
 			label(y)
 			return r
 		}
@@ -356,7 +873,6 @@ func gen_expr(node *Node) int {
 			nreg++
 			add(IR_IMM, rhs, 0)
 			add(IR_EQ, lhs, rhs)
-			kill(rhs)
 			return lhs
 		}
 	default:
@@ -366,6 +882,199 @@ func gen_expr(node *Node) int {
 	return 0
 }
 
+// A conditional operator of a floating-point type. The result is in a
+// new register because the condition is in an integer register.
+func gen_fcond(node *Node) int {
+	x := nlabel
+	nlabel++
+	y := nlabel
+	nlabel++
+	r := nreg
+	nreg++
+
+	cond := gen_expr(node.cond)
+	add(IR_UNLESS, cond, x)
+
+	r2 := gen_expr(node.then)
+	ir := add(IR_FMOV, r, r2)
+	ir.size = node.ty.size
+	jmp(y)
+
+	label(x)
+	r3 := gen_expr(node.els)
+	ir = add(IR_FMOV, r, r3)
+	ir.size = node.ty.size
+	label(y)
+	return r
+}
+
+// A switch whose case values are dense enough is compiled to a jump
+// table. Otherwise, it is compiled to a chain of comparisons.
+const max_jump_table = 4096
+
+func is_dense(cases *Vector, min, max int) bool {
+	n := 0
+	for i := 0; i < cases.len; i++ {
+		if cases.data[i].(*Node).op == ND_CASE {
+			n++
+		}
+	}
+
+	// The span is computed in uint64 because it may not fit in int64.
+	span := uint64(max) - uint64(min)
+	return n >= 4 && span < max_jump_table && span < uint64(n*3)
+}
+
+func gen_switch(node *Node, r int) {
+	var dflt *Node
+	min, max := 0, 0
+	first := true
+
+	for i := 0; i < node.cases.len; i++ {
+		c := node.cases.data[i].(*Node)
+		c.label = nlabel
+		nlabel++
+
+		if c.op == ND_DEFAULT {
+			dflt = c
+			continue
+		}
+		if first || c.val < min {
+			min = c.val
+		}
+		if first || c.val > max {
+			max = c.val
+		}
+		first = false
+	}
+
+	// If no case matches, jump to "default" or out of the switch.
+	dflt_label := break_label
+	if dflt != nil {
+		dflt_label = dflt.label
+	}
+
+	if !first && is_dense(node.cases, min, max) {
+		labels := make([]int, max-min+1)
+		for i := range labels {
+			labels[i] = dflt_label
+		}
+		for i := 0; i < node.cases.len; i++ {
+			c := node.cases.data[i].(*Node)
+			if c.op == ND_CASE {
+				labels[c.val-min] = c.label
+			}
+		}
+
+		idx := nreg
+		nreg++
+		add(IR_MOV, idx, r)
+		add_imm(IR_SUB, idx, min)
+		ir := add(IR_JMP_TABLE, idx, dflt_label)
+		ir.labels = labels
+		return
+	}
+
+	for i := 0; i < node.cases.len; i++ {
+		c := node.cases.data[i].(*Node)
+		if c.op != ND_CASE {
+			continue
+		}
+		r2 := nreg
+		nreg++
+		add(IR_IMM, r2, c.val)
+		add(IR_EQ, r2, r)
+		add(IR_IF, r2, c.label)
+	}
+	jmp(dflt_label)
+}
+
+// Members of a local variable that are not explicitly initialized are
+// initialized with zeros. Zeros are stored with as few stores as
+// possible before the explicit initializers are stored.
+func gen_zero_fill(node *Node) {
+	used := make([]bool, node.ty.size)
+	for i := 0; i < node.inits.len; i++ {
+		init := node.inits.data[i].(*Node)
+		for j := 0; j < init.ty.size; j++ {
+			used[init.offset+j] = true
+		}
+	}
+
+	zero := -1
+	for off := 0; off < node.ty.size; {
+		if used[off] {
+			off++
+			continue
+		}
+
+		size := 1
+		for _, sz := range []int{8, 4} {
+			if off%sz == 0 && off+sz <= node.ty.size && !any_used(used[off:off+sz]) {
+				size = sz
+				break
+			}
+		}
+
+		if zero == -1 {
+			zero = nreg
+			nreg++
+			add(IR_IMM, zero, 0)
+		}
+		addr := nreg
+		nreg++
+		add(IR_BPREL, addr, node.offset-off)
+		ir := add(IR_STORE, addr, zero)
+		ir.size = size
+		off += size
+	}
+	if zero != -1 {
+	}
+}
+
+func any_used(used []bool) bool {
+	for _, u := range used {
+		if u {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the IR label of a labeled statement. A label number is
+// assigned on first use because a goto may precede its target.
+func get_label(node *Node) int {
+	if node.label == 0 {
+		node.label = nlabel
+		nlabel++
+	}
+	return node.label
+}
+
+// Returns a struct at a given address. A struct returned in memory is
+// copied to a buffer given by the caller, whose address is returned in
+// rax.
+func gen_return_struct(node *Node, r int) {
+	sse := classify(node.ty)
+	if sse == nil {
+		dst := nreg
+		nreg++
+		add(IR_BPREL, dst, ret_ptr)
+		ir := add(IR_LOAD, dst, dst)
+		ir.size = 8
+		ir = add(IR_MEMCPY, dst, r)
+		ir.size = node.ty.size
+		add(IR_RETURN, dst, -1)
+		return
+	}
+
+	addr := nreg
+	nreg++
+	add(IR_BPREL, addr, copy_to_temp(r, node.ty))
+	ir := add(IR_SRETURN, addr, -1)
+	ir.sse = sse
+}
+
 func gen_stmt(node *Node) {
 	switch node.op {
 	case ND_NULL:
@@ -373,16 +1082,20 @@ func gen_stmt(node *Node) {
 
 	case ND_VARDEF:
 		{
-			if node.init == nil {
+			lvars[node.offset] = node.ty.size
+			if node.inits == nil {
 				return
 			}
-			rhs := gen_expr(node.init)
-			lhs := nreg
-			nreg++
-			add(IR_BPREL, lhs, node.offset)
-			store(node, lhs, rhs)
-			kill(lhs)
-			kill(rhs)
+			gen_zero_fill(node)
+
+			for i := 0; i < node.inits.len; i++ {
+				init := node.inits.data[i].(*Node)
+				rhs := gen_expr(init.expr)
+				lhs := nreg
+				nreg++
+				add(IR_BPREL, lhs, node.offset-init.offset)
+				store(init, lhs, rhs)
+			}
 			return
 		}
 	case ND_IF:
@@ -394,7 +1107,6 @@ func gen_stmt(node *Node) {
 				nlabel++
 				r := gen_expr(node.cond)
 				add(IR_UNLESS, r, x)
-				kill(r)
 				gen_stmt(node.then)
 				jmp(y)
 				label(x)
@@ -406,7 +1118,6 @@ func gen_stmt(node *Node) {
 			nlabel++
 			r := gen_expr(node.cond)
 			add(IR_UNLESS, r, x)
-			kill(r)
 			gen_stmt(node.then)
 			label(x)
 			return
@@ -417,48 +1128,78 @@ func gen_stmt(node *Node) {
 			nlabel++
 			y := nlabel
 			nlabel++
-			orig := break_label
+			orig_break := break_label
+			orig_cont := cont_label
 			break_label = nlabel
 			nlabel++
+			cont_label = nlabel
+			nlabel++
 
 			gen_stmt(node.init)
 			label(x)
 			if node.cond != nil {
 				r := gen_expr(node.cond)
 				add(IR_UNLESS, r, y)
-				kill(r)
 			}
 			gen_stmt(node.body)
+			label(cont_label)
 			if node.inc != nil {
 				gen_stmt(node.inc)
 			}
 			jmp(x)
 			label(y)
 			label(break_label)
-			break_label = orig
+			break_label = orig_break
+			cont_label = orig_cont
 			return
 		}
 	case ND_DO_WHILE:
 		{
 			x := nlabel
 			nlabel++
-			orig := break_label
+			orig_break := break_label
+			orig_cont := cont_label
 			break_label = nlabel
 			nlabel++
+			cont_label = nlabel
+			nlabel++
 			label(x)
 			gen_stmt(node.body)
+			label(cont_label)
 			r := gen_expr(node.cond)
 			add(IR_IF, r, x)
-			kill(r)
+			label(break_label)
+			break_label = orig_break
+			cont_label = orig_cont
+			return
+		}
+	case ND_SWITCH:
+		{
+			orig := break_label
+			break_label = nlabel
+			nlabel++
+
+			r := gen_expr(node.cond)
+			gen_switch(node, r)
+
+			gen_stmt(node.body)
 			label(break_label)
 			break_label = orig
 			return
 		}
+	case ND_CASE, ND_DEFAULT:
+		label(node.label)
+		gen_stmt(node.body)
+		return
 	case ND_BREAK:
-		if break_label == 0 {
-			error("stray 'break' statement")
-		}
 		jmp(break_label)
+	case ND_CONTINUE:
+		jmp(cont_label)
+	case ND_GOTO:
+		jmp(get_label(node.target))
+	case ND_LABEL:
+		label(get_label(node))
+		gen_stmt(node.body)
 	case ND_RETURN:
 		{
 			r := gen_expr(node.expr)
@@ -466,18 +1207,26 @@ func gen_stmt(node *Node) {
 			// Statement expression (GNU extension)
 			if return_label != 0 {
 				add(IR_MOV, return_reg, r)
-				kill(r)
 				jmp(return_label)
 				return
 			}
 
-			add(IR_RETURN, r, -1)
-			kill(r)
+			if node.expr.ty.ty == STRUCT {
+				gen_return_struct(node.expr, r)
+				return
+			}
+
+			if is_flonum(node.expr.ty) {
+				ir := add(IR_FRETURN, r, -1)
+				ir.size = node.expr.ty.size
+			} else {
+				add(IR_RETURN, r, -1)
+			}
 			return
 		}
 	case ND_EXPR_STMT:
 		{
-			kill(gen_expr(node.expr))
+			gen_expr(node.expr)
 			return
 		}
 	case ND_COMP_STMT:
@@ -506,17 +1255,81 @@ func gen_ir(nodes *Vector) *Vector {
 		//assert(node.op == ND_FUNC)
 		code = new_vec()
 
+		frame_size = node.stacksize
+		lvars = make(map[int]int)
+
+		// Integer and floating-point parameters are passed in
+		// different sets of registers. The rest of them are passed
+		// on the stack in order.
+		nargs, nfargs, nstack := 0, 0, 0
+		if ty := node.ty.returning; ty.ty == STRUCT && classify(ty) == nil {
+			ret_ptr = alloc_temp(8)
+			ir := add(IR_STORE_ARG, ret_ptr, 0)
+			ir.size = 8
+			nargs++
+		}
+
 		for i := 0; i < node.args.len; i++ {
 			arg := node.args.data[i].(*Node)
-			store_arg(arg, arg.offset, i)
+			lvars[arg.offset] = arg.ty.size
+			if arg.ty.ty == STRUCT {
+				sse := classify(arg.ty)
+				n, nf := count_regs(sse)
+				if sse == nil || nargs+n > num_argregs || nfargs+nf > num_fargregs {
+					for j := 0; j < arg.ty.size; j += 8 {
+						ir := add(IR_STORE_STACK_ARG, arg.offset-j, nstack)
+						ir.size = 8
+						nstack++
+					}
+					continue
+				}
+				for j, s := range sse {
+					if s {
+						ir := add(IR_FSTORE_ARG, arg.offset-j*8, nfargs)
+						ir.size = 8
+						nfargs++
+					} else {
+						ir := add(IR_STORE_ARG, arg.offset-j*8, nargs)
+						ir.size = 8
+						nargs++
+					}
+				}
+				continue
+			}
+
+			if is_flonum(arg.ty) && nfargs < num_fargregs {
+				store_arg(arg, arg.offset, nfargs)
+				nfargs++
+			} else if !is_flonum(arg.ty) && nargs < num_argregs {
+				store_arg(arg, arg.offset, nargs)
+				nargs++
+			} else {
+				ir := add(IR_STORE_STACK_ARG, arg.offset, nstack)
+				ir.size = arg.ty.size
+				nstack++
+			}
+		}
+
+		// A variadic function saves all argument registers so that
+		// va_arg can read them.
+		reg_save_area = 0
+		if node.ty.is_variadic {
+			frame_size = roundup(frame_size+reg_save_size, 16)
+			reg_save_area = frame_size
+			gp_offset = nargs * 8
+			fp_offset = num_argregs*8 + nfargs*16
+			nstack_args = nstack
 		}
 
 		gen_stmt(node.body)
 
 		fn := new(Function)
 		fn.name = node.name
-		fn.stacksize = node.stacksize
-		fn.ir = code
+		fn.is_static = node.is_static
+		fn.stacksize = frame_size
+		fn.reg_save_area = reg_save_area
+		fn.lvars = lvars
+		fn.bbs = build_cfg(code)
 		fn.globals = node.globals
 		vec_push(v, fn)
 	}
@@ -4,18 +4,32 @@ package main
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 )
 
 var (
 	n         int
 	glabel    int
 	regs      = []string{"r10", "r11", "rbx", "r12", "r13", "r14", "r15"}
-	regs8     = []string{"r10b", "r11b", "b1", "r12b", "r13b", "r14b", "r15b"}
+	regs8     = []string{"r10b", "r11b", "bl", "r12b", "r13b", "r14b", "r15b"}
+	regs16    = []string{"r10w", "r11w", "bx", "r12w", "r13w", "r14w", "r15w"}
 	regs32    = []string{"r10d", "r11d", "ebx", "r12d", "r13d", "r14d", "r15d"}
 	argregs   = []string{"rdi", "rsi", "rdx", "rcx", "r8", "r9"}
 	argregs8  = []string{"dil", "sil", "dl", "cl", "r8b", "r9b"}
+	argregs16 = []string{"di", "si", "dx", "cx", "r8w", "r9w"}
 	argregs32 = []string{"edi", "esi", "edx", "ecx", "r8d", "r9d"}
 	num_regs  = len(regs)
+
+	// Integer eightbytes of a struct are returned in these registers.
+	retregs = []string{"rax", "rdx"}
+
+	// xmm0 is used as a scratch register except for function calls.
+	fregs     = []string{"xmm8", "xmm9", "xmm10", "xmm11", "xmm12", "xmm13", "xmm14", "xmm15"}
+	num_fregs = len(fregs)
+
+	// Lines that are not written to the output yet
+	insns []*Insn
 )
 
 func backslash_escape(s string, length int) string {
@@ -57,6 +71,9 @@ func argreg(r, size int) string {
 	if size == 1 {
 		return argregs8[r]
 	}
+	if size == 2 {
+		return argregs16[r]
+	}
 	if size == 4 {
 		return argregs32[r]
 	}
@@ -70,8 +87,51 @@ func gen_label() string {
 	return buf
 }
 
+// Emits an instruction or an indented directive.
 func emit(format string, a ...interface{}) {
-	fmt.Printf("\t"+format+"\n", a...)
+	s := fmt.Sprintf(format, a...)
+	if s[0] == '.' {
+		insns = append(insns, &Insn{text: "\t" + s})
+		return
+	}
+
+	insn := &Insn{}
+	op, args, ok := strings.Cut(s, " ")
+	insn.op = op
+	if ok {
+		insn.args = strings.Split(args, ", ")
+	}
+	insns = append(insns, insn)
+}
+
+func emit_label(name string) {
+	insns = append(insns, &Insn{label: name})
+}
+
+// Emits a line that is not indented, such as a section directive.
+func emit_line(format string, a ...interface{}) {
+	insns = append(insns, &Insn{text: fmt.Sprintf(format, a...)})
+}
+
+func print_insn(insn *Insn) {
+	switch {
+	case insn.label != "":
+		fmt.Fprintf(out, "%s:\n", insn.label)
+	case insn.op == "":
+		fmt.Fprintf(out, "%s\n", insn.text)
+	case insn.args == nil:
+		fmt.Fprintf(out, "\t%s\n", insn.op)
+	default:
+		fmt.Fprintf(out, "\t%s %s\n", insn.op, strings.Join(insn.args, ", "))
+	}
+}
+
+// Writes pending lines to the output.
+func flush_insns() {
+	for _, insn := range insns {
+		print_insn(insn)
+	}
+	insns = nil
 }
 
 func emit_cmp(ir *IR, insn string) {
@@ -80,10 +140,192 @@ func emit_cmp(ir *IR, insn string) {
 	emit("movzb %s, %s", regs[ir.lhs], regs8[ir.lhs])
 }
 
+// Sign- or zero-extends a value of a given size in a register to
+// 64 bits. A 32-bit mov implicitly zero-extends the result.
+func emit_ext(r, size int, is_unsigned bool) {
+	if size == 4 {
+		if is_unsigned {
+			emit("mov %s, %s", regs32[r], regs32[r])
+		} else {
+			emit("movsxd %s, %s", regs[r], regs32[r])
+		}
+		return
+	}
+	if is_unsigned {
+		emit("movzx %s, %s", regs[r], reg(r, size))
+	} else {
+		emit("movsx %s, %s", regs[r], reg(r, size))
+	}
+}
+
+// Divides lhs by rhs. The quotient is in rax and the remainder is in rdx.
+func emit_div(ir *IR) {
+	emit("mov rax, %s", regs[ir.lhs])
+	if ir.is_unsigned {
+		emit("xor edx, edx")
+		emit("div %s", regs[ir.rhs])
+	} else {
+		emit("cqo")
+		emit("idiv %s", regs[ir.rhs])
+	}
+}
+
+// Returns the suffix of a scalar SSE instruction for a given size.
+func sse(size int) string {
+	if size == 4 {
+		return "ss"
+	}
+	return "sd"
+}
+
+// Sets a floating-point bit pattern to xmm0 via rax.
+func emit_fconst(bits string, size int) {
+	if size == 4 {
+		emit("mov eax, %s", bits)
+		emit("movd xmm0, eax")
+		return
+	}
+	emit("mov rax, %s", bits)
+	emit("movq xmm0, rax")
+}
+
+func emit_fcmp(ir *IR) {
+	dst, dst8 := regs[ir.dst], regs8[ir.dst]
+	lhs, rhs := fregs[ir.lhs], fregs[ir.rhs]
+
+	// An unordered comparison with NaN sets ZF, PF and CF.
+	switch ir.op {
+	case IR_FEQ:
+		emit("ucomi%s %s, %s", sse(ir.size), lhs, rhs)
+		emit("sete %s", dst8)
+		emit("setnp al")
+		emit("and %s, al", dst8)
+	case IR_FNE:
+		emit("ucomi%s %s, %s", sse(ir.size), lhs, rhs)
+		emit("setne %s", dst8)
+		emit("setp al")
+		emit("or %s, al", dst8)
+	case IR_FLT:
+		emit("ucomi%s %s, %s", sse(ir.size), rhs, lhs)
+		emit("seta %s", dst8)
+	case IR_FLE:
+		emit("ucomi%s %s, %s", sse(ir.size), rhs, lhs)
+		emit("setae %s", dst8)
+	}
+	emit("movzx %s, %s", dst, dst8)
+}
+
+// Converts an integer to a floating-point number. A value of type
+// unsigned long that doesn't fit in a signed integer is halved
+// before conversion and doubled after that. The lowest bit is kept
+// for correct rounding.
+func emit_i2f(ir *IR) {
+	dst, src := fregs[ir.lhs], regs[ir.rhs]
+	if !ir.is_unsigned {
+		emit("cvtsi2%s %s, %s", sse(ir.size), dst, src)
+		return
+	}
+
+	big := local_label()
+	end := local_label()
+	emit("test %s, %s", src, src)
+	emit("js %s", big)
+	emit("cvtsi2%s %s, %s", sse(ir.size), dst, src)
+	emit("jmp %s", end)
+	emit_label(big)
+	emit("mov rax, %s", src)
+	emit("shr rax, 1")
+	emit("mov rdx, %s", src)
+	emit("and edx, 1")
+	emit("or rax, rdx")
+	emit("cvtsi2%s %s, rax", sse(ir.size), dst)
+	emit("add%s %s, %s", sse(ir.size), dst, dst)
+	emit_label(end)
+}
+
+// Converts a floating-point number to an integer. A value that is not
+// less than 2^63 is converted to unsigned long by subtracting 2^63
+// before conversion and setting the highest bit after that.
+func emit_f2i(ir *IR) {
+	dst, src := regs[ir.lhs], fregs[ir.rhs]
+	if !ir.is_unsigned {
+		emit("cvtt%s2si %s, %s", sse(ir.size), dst, src)
+		return
+	}
+
+	pow63, neg_pow63 := "0x43e0000000000000", "0xc3e0000000000000"
+	if ir.size == 4 {
+		pow63, neg_pow63 = "0x5f000000", "0xdf000000"
+	}
+
+	big := local_label()
+	end := local_label()
+	emit_fconst(pow63, ir.size)
+	emit("ucomi%s %s, xmm0", sse(ir.size), src)
+	emit("jae %s", big)
+	emit("cvtt%s2si %s, %s", sse(ir.size), dst, src)
+	emit("jmp %s", end)
+	emit_label(big)
+	emit_fconst(neg_pow63, ir.size)
+	emit("add%s xmm0, %s", sse(ir.size), src)
+	emit("cvtt%s2si %s, xmm0", sse(ir.size), dst)
+	emit("btc %s, 63", dst)
+	emit_label(end)
+}
+
+func local_label() string {
+	s := format(".Lcvt%d", glabel)
+	glabel++
+	return s
+}
+
+func mem_ptr(size int) string {
+	switch size {
+	case 1:
+		return "byte ptr"
+	case 2:
+		return "word ptr"
+	case 4:
+		return "dword ptr"
+	}
+	return "qword ptr"
+}
+
+func emit_load(ir *IR) {
+	dst, src := regs[ir.lhs], regs[ir.rhs]
+	switch {
+	case ir.size == 8:
+		emit("mov %s, [%s]", dst, src)
+	case ir.size == 4 && ir.is_unsigned:
+		emit("mov %s, [%s]", regs32[ir.lhs], src)
+	case ir.size == 4:
+		emit("movsxd %s, %s [%s]", dst, mem_ptr(ir.size), src)
+	case ir.is_unsigned:
+		emit("movzx %s, %s [%s]", dst, mem_ptr(ir.size), src)
+	default:
+		emit("movsx %s, %s [%s]", dst, mem_ptr(ir.size), src)
+	}
+}
+
+func reg_rax(size int) string {
+	switch size {
+	case 1:
+		return "al"
+	case 2:
+		return "ax"
+	case 4:
+		return "eax"
+	}
+	return "rax"
+}
+
 func reg(r, size int) string {
 	if size == 1 {
 		return regs8[r]
 	}
+	if size == 2 {
+		return regs16[r]
+	}
 	if size == 4 {
 		return regs32[r]
 	}
@@ -91,23 +333,38 @@ func reg(r, size int) string {
 	return regs[r]
 }
 
-func gen(fn *Function) {
-
-	ret := format(".Lend%d", glabel)
-	glabel++
+// Copies size bytes using rax as a scratch register.
+func emit_memcpy(dst, src string, size int) {
+	for off := 0; off < size; {
+		n := 8
+		for n > size-off {
+			n /= 2
+		}
+		emit("mov %s, [%s+%d]", reg_rax(n), src, off)
+		emit("mov [%s+%d], %s", dst, off, reg_rax(n))
+		off += n
+	}
+}
 
-	fmt.Printf(".global %s\n", fn.name)
-	fmt.Printf("%s:\n", fn.name)
-	emit("push rbp")
-	emit("mov rbp, rsp")
-	emit("sub rsp, %d", roundup(fn.stacksize, 16))
-	emit("push r12")
-	emit("push r13")
-	emit("push r14")
-	emit("push r15")
+// Stores a struct returned in registers to a buffer.
+func emit_ret_buf(ir *IR) {
+	gp, fp := 0, 0
+	for i, sse := range ir.sse {
+		if sse {
+			emit("movsd [rbp-%d], xmm%d", ir.ret_buf-i*8, fp)
+			fp++
+		} else {
+			emit("mov [rbp-%d], %s", ir.ret_buf-i*8, retregs[gp])
+			gp++
+		}
+	}
+}
 
-	for i := 0; i < fn.ir.len; i++ {
-		ir := fn.ir.data[i].(*IR)
+// Emits the instructions of a basic block. ret is the label of the
+// function epilogue.
+func gen_bb(bb *BB, ret string) {
+	for i := 0; i < bb.ir.len; i++ {
+		ir := bb.ir.data[i].(*IR)
 		lhs := ir.lhs
 		rhs := ir.rhs
 
@@ -115,27 +372,87 @@ func gen(fn *Function) {
 		case IR_IMM:
 			emit("mov %s, %d", regs[lhs], rhs)
 		case IR_BPREL:
-			emit("lea %s, [rbp-%d]", regs[lhs], rhs)
+			emit("lea %s, [rbp%+d]", regs[lhs], -rhs)
 		case IR_MOV:
 			emit("mov %s, %s", regs[lhs], regs[rhs])
+		case IR_MEMCPY:
+			emit_memcpy(regs[lhs], regs[rhs], ir.size)
+		case IR_SRETURN:
+			gp, fp := 0, 0
+			for i, sse := range ir.sse {
+				if sse {
+					emit("movsd xmm%d, [%s+%d]", fp, regs[lhs], i*8)
+					fp++
+				} else {
+					emit("mov %s, [%s+%d]", retregs[gp], regs[lhs], i*8)
+					gp++
+				}
+			}
+			emit("jmp %s", ret)
 		case IR_RETURN:
 			emit("mov rax, %s", regs[lhs])
 			emit("jmp %s", ret)
-		case IR_CALL:
+		case IR_CALL, IR_ICALL:
 			{
-				for i := 0; i < ir.nargs; i++ {
-					emit("mov %s, %s", argregs[i], regs[ir.args[i]])
+				for i, r := range ir.args {
+					emit("mov %s, %s", argregs[i], regs[r])
+				}
+				for i, r := range ir.fargs {
+					emit("movaps xmm%d, %s", i, fregs[r])
+				}
+
+				// The stack pointer is kept aligned to 16 bytes.
+				save := roundup(len(ir.live_fp)*8, 16)
+				if save > 0 {
+					emit("sub rsp, %d", save)
+				}
+				for i, r := range ir.live_fp {
+					emit("movsd [rsp+%d], %s", i*8, fregs[r])
 				}
 				emit("push r10")
 				emit("push r11")
-				emit("mov rax, 0")
-				emit("call %s", ir.name)
+
+				// Stack arguments are pushed in reverse order, so that
+				// the first one is at the lowest address.
+				pad := 8 * (len(ir.stack_args) % 2)
+				if pad > 0 {
+					emit("sub rsp, %d", pad)
+				}
+				for i := len(ir.stack_args) - 1; i >= 0; i-- {
+					emit("push qword ptr [rbp-%d]", ir.stack_args[i])
+				}
+
+				// The number of vector registers used by a call to a
+				// variadic function is passed in al.
+				emit("mov rax, %d", len(ir.fargs))
+				if ir.op == IR_ICALL {
+					emit("call %s", regs[rhs])
+				} else {
+					emit("call %s", ir.name)
+				}
+				if n := 8*len(ir.stack_args) + pad; n > 0 {
+					emit("add rsp, %d", n)
+				}
 				emit("pop r11")
 				emit("pop r10")
-				emit("mov %s, rax", regs[lhs])
+				for i, r := range ir.live_fp {
+					emit("movsd %s, [rsp+%d]", fregs[r], i*8)
+				}
+				if save > 0 {
+					emit("add rsp, %d", save)
+				}
+
+				if ir.sse != nil {
+					emit_ret_buf(ir)
+					emit("lea %s, [rbp-%d]", regs[lhs], ir.ret_buf)
+				} else if ir.is_fp {
+					emit("movaps %s, xmm0", fregs[lhs])
+				} else {
+					emit("mov %s, rax", regs[lhs])
+				}
 			}
 		case IR_LABEL:
-			fmt.Printf(".L%d:\n", lhs)
+			emit_label(format(".L%d", lhs))
 		case IR_LABEL_ADDR:
 			emit("lea %s, %s", regs[lhs], ir.name)
 		case IR_NEG:
@@ -145,9 +462,17 @@ func gen(fn *Function) {
 		case IR_NE:
 			emit_cmp(ir, "setne")
 		case IR_LT:
-			emit_cmp(ir, "setl")
+			if ir.is_unsigned {
+				emit_cmp(ir, "setb")
+			} else {
+				emit_cmp(ir, "setl")
+			}
 		case IR_LE:
-			emit_cmp(ir, "setle")
+			if ir.is_unsigned {
+				emit_cmp(ir, "setbe")
+			} else {
+				emit_cmp(ir, "setle")
+			}
 		case IR_AND:
 			emit("and %s, %s", regs[lhs], regs[rhs])
 		case IR_OR:
@@ -163,7 +488,11 @@ func gen(fn *Function) {
 			emit("shl %s, cl", regs[lhs])
 		case IR_SHR:
 			emit("mov cl, %s", regs8[rhs])
-			emit("shr %s, cl", regs[lhs])
+			if ir.is_unsigned {
+				emit("shr %s, cl", regs[lhs])
+			} else {
+				emit("sar %s, cl", regs[lhs])
+			}
 		case IR_JMP:
 			emit("jmp .L%d", lhs)
 		case IR_IF:
@@ -172,15 +501,36 @@ func gen(fn *Function) {
 		case IR_UNLESS:
 			emit("cmp %s, 0", regs[lhs])
 			emit("je .L%d", rhs)
-		case IR_LOAD:
-			emit("mov %s, [%s]", reg(lhs, ir.size), regs[rhs])
-			if ir.size == 1 {
-				emit("movzb %s, %s", regs[lhs], regs8[lhs])
+		case IR_JMP_TABLE:
+			{
+				// Values out of the table range, including negative
+				// ones, are caught by the unsigned comparison.
+				tbl := format(".Ltbl%d", glabel)
+				glabel++
+				emit("cmp %s, %d", regs[lhs], len(ir.labels))
+				emit("jae .L%d", rhs)
+				emit("jmp qword ptr [%s*8+%s]", regs[lhs], tbl)
+				emit_line(".section .rodata")
+				emit(".align 8")
+				emit_label(tbl)
+				for _, l := range ir.labels {
+					emit(".quad .L%d", l)
+				}
+				emit_line(".text")
 			}
+		case IR_LOAD:
+			emit_load(ir)
+		case IR_CAST:
+			emit_ext(lhs, ir.size, ir.is_unsigned)
 		case IR_STORE:
 			emit("mov [%s], %s", regs[lhs], reg(rhs, ir.size))
 		case IR_STORE_ARG:
 			emit("mov [rbp-%d], %s", lhs, argreg(rhs, ir.size))
+		case IR_STORE_STACK_ARG:
+			// Stack arguments are above the return address and the
+			// saved base pointer.
+			emit("mov rax, [rbp+%d]", 16+rhs*8)
+			emit("mov [rbp-%d], %s", lhs, reg_rax(ir.size))
 		case IR_ADD:
 			if ir.is_imm {
 				emit("add %s, %d", regs[lhs], rhs)
@@ -208,47 +558,236 @@ func gen(fn *Function) {
 			emit("mul %s", regs[lhs])
 			emit("mov %s, rax", regs[lhs])
 		case IR_DIV:
-			emit("mov rax, %s", regs[lhs])
-			emit("cqo")
-			emit("div %s", regs[rhs])
+			emit_div(ir)
 			emit("mov %s, rax", regs[lhs])
 		case IR_MOD:
-			emit("mov rax, %s", regs[lhs])
-			emit("cqo")
-			emit("div %s", regs[rhs])
+			emit_div(ir)
 			emit("mov %s, rdx", regs[lhs])
+		case IR_FIMM:
+			if ir.size == 4 {
+				emit("mov eax, %d", rhs)
+				emit("movd %s, eax", fregs[lhs])
+			} else {
+				emit("mov rax, %d", rhs)
+				emit("movq %s, rax", fregs[lhs])
+			}
+		case IR_FMOV:
+			emit("movaps %s, %s", fregs[lhs], fregs[rhs])
+		case IR_FADD:
+			emit("add%s %s, %s", sse(ir.size), fregs[lhs], fregs[rhs])
+		case IR_FSUB:
+			emit("sub%s %s, %s", sse(ir.size), fregs[lhs], fregs[rhs])
+		case IR_FMUL:
+			emit("mul%s %s, %s", sse(ir.size), fregs[lhs], fregs[rhs])
+		case IR_FDIV:
+			emit("div%s %s, %s", sse(ir.size), fregs[lhs], fregs[rhs])
+		case IR_FNEG:
+			if ir.size == 4 {
+				emit_fconst("0x80000000", 4)
+				emit("xorps %s, xmm0", fregs[lhs])
+			} else {
+				emit_fconst("0x8000000000000000", 8)
+				emit("xorpd %s, xmm0", fregs[lhs])
+			}
+		case IR_FEQ, IR_FNE, IR_FLT, IR_FLE:
+			emit_fcmp(ir)
+		case IR_FLOAD:
+			emit("mov%s %s, [%s]", sse(ir.size), fregs[lhs], regs[rhs])
+		case IR_FSTORE:
+			emit("mov%s [%s], %s", sse(ir.size), regs[lhs], fregs[rhs])
+		case IR_FSTORE_ARG:
+			emit("mov%s [rbp-%d], xmm%d", sse(ir.size), lhs, rhs)
+		case IR_FRETURN:
+			emit("movaps xmm0, %s", fregs[lhs])
+			emit("jmp %s", ret)
+		case IR_I2F:
+			emit_i2f(ir)
+		case IR_F2I:
+			emit_f2i(ir)
+		case IR_F2F:
+			if ir.size == 8 {
+				emit("cvtss2sd %s, %s", fregs[lhs], fregs[lhs])
+			} else {
+				emit("cvtsd2ss %s, %s", fregs[lhs], fregs[lhs])
+			}
+		case IR_LOAD_SPILL:
+			emit("mov %s, [rbp-%d]", regs[lhs], rhs)
+		case IR_STORE_SPILL:
+			emit("mov [rbp-%d], %s", rhs, regs[lhs])
+		case IR_FLOAD_SPILL:
+			emit("movsd %s, [rbp-%d]", fregs[lhs], rhs)
+		case IR_FSTORE_SPILL:
+			emit("movsd [rbp-%d], %s", rhs, fregs[lhs])
 		case IR_NOP:
 			break
 		default:
 			//assert(0 && "unknown operator")
 		}
 	}
+}
+
+func gen(fn *Function) {
+
+	ret := format(".Lend%d", glabel)
+	glabel++
+
+	if !fn.is_static {
+		emit_line(".global %s", fn.name)
+	}
+	emit_label(fn.name)
+	emit("push rbp")
+	emit("mov rbp, rsp")
+	// rbx and r12-r15 are callee-saved. The extra 8 bytes keep the
+	// stack pointer aligned to 16 bytes after pushing them.
+	emit("sub rsp, %d", roundup(fn.stacksize, 16)+8)
+	emit("push rbx")
+	emit("push r12")
+	emit("push r13")
+	emit("push r14")
+	emit("push r15")
 
-	fmt.Printf("%s:\n", ret)
+	if fn.reg_save_area != 0 {
+		off := fn.reg_save_area
+		for i := 0; i < num_argregs; i++ {
+			emit("mov [rbp-%d], %s", off-i*8, argregs[i])
+		}
+		for i := 0; i < num_fargregs; i++ {
+			emit("movaps [rbp-%d], xmm%d", off-num_argregs*8-i*16, i)
+		}
+	}
+
+	for i := 0; i < fn.bbs.len; i++ {
+		gen_bb(fn.bbs.data[i].(*BB), ret)
+	}
+
+	emit_label(ret)
 	emit("pop r15")
 	emit("pop r14")
 	emit("pop r13")
 	emit("pop r12")
+	emit("pop rbx")
 	emit("mov rsp, rbp")
 	emit("pop rbp")
 	emit("ret")
+
+	if opt_level > 0 {
+		insns = peephole(insns)
+	}
+	flush_insns()
+}
+
+func data_directive(size int) string {
+	switch size {
+	case 1:
+		return ".byte"
+	case 2:
+		return ".short"
+	case 4:
+		return ".long"
+	}
+	// assert(size == 8)
+	return ".quad"
+}
+
+// Emits initial values of a global variable. Gaps between
+// initialized members are filled with zeros.
+func emit_inits(v *Var) {
+	inits := make([]*Node, v.inits.len)
+	for i := range inits {
+		inits[i] = v.inits.data[i].(*Node)
+	}
+	sort.SliceStable(inits, func(i, j int) bool {
+		return inits[i].offset < inits[j].offset
+	})
+
+	off := 0
+	for i, init := range inits {
+		// A later initializer for the same member overrides earlier ones.
+		if i+1 < len(inits) && inits[i+1].offset == init.offset {
+			continue
+		}
+		if init.offset < off {
+			continue
+		}
+		if init.offset > off {
+			emit(".zero %d", init.offset-off)
+		}
+
+		if init.name != "" && init.val != 0 {
+			emit("%s %s%+d", data_directive(init.ty.size), init.name, init.val)
+		} else if init.name != "" {
+			emit("%s %s", data_directive(init.ty.size), init.name)
+		} else {
+			emit("%s %d", data_directive(init.ty.size), init.val)
+		}
+		off = init.offset + init.ty.size
+	}
+	if off < v.ty.size {
+		emit(".zero %d", v.ty.size-off)
+	}
+}
+
+// Returns true if a global variable has an initializer whose bytes
+// are all zero and which has no relocations.
+func is_zero_init(v *Var) bool {
+	if v.inits == nil {
+		return false
+	}
+	for i := 0; i < v.inits.len; i++ {
+		init := v.inits.data[i].(*Node)
+		if init.name != "" || init.val != 0 {
+			return false
+		}
+	}
+	return true
 }
 
 func gen_x86(globals, fns *Vector) {
 
-	fmt.Printf(".intel_syntax noprefix\n")
+	emit_line(".intel_syntax noprefix")
 
-	fmt.Printf(".data\n")
+	emit_line(".data")
 	for i := 0; i < globals.len; i++ {
 		v := globals.data[i].(*Var)
-		if v.is_extern {
+		if v.is_extern || (v.inits == nil && v.len == 0) || is_zero_init(v) {
 			continue
 		}
-		fmt.Printf("%s:\n", v.name)
-		emit(".ascii \"%s\"", backslash_escape(v.data, v.len))
+		emit(".align %d", v.ty.align)
+		if !v.is_static {
+			emit_line(".global %s", v.name)
+		}
+		emit_label(v.name)
+		if v.inits != nil {
+			emit_inits(v)
+		} else {
+			emit(".ascii \"%s\"", backslash_escape(v.data, v.len))
+		}
+	}
+
+	// Zero-filled variables don't occupy space in the object file.
+	emit_line(".bss")
+	for i := 0; i < globals.len; i++ {
+		v := globals.data[i].(*Var)
+		if v.is_extern || v.len != 0 || v.inits != nil && !is_zero_init(v) {
+			continue
+		}
+
+		// A tentative definition is emitted as a common symbol, so
+		// that it can be defined in more than one file.
+		if v.inits == nil && !v.is_static {
+			emit(".comm %s, %d, %d", v.name, v.ty.size, v.ty.align)
+			continue
+		}
+		emit(".align %d", v.ty.align)
+		if !v.is_static {
+			emit_line(".global %s", v.name)
+		}
+		emit_label(v.name)
+		emit(".zero %d", v.ty.size)
 	}
 
-	fmt.Printf(".text\n")
+	emit_line(".text")
+	flush_insns()
 	for i := 0; i < fns.len; i++ {
 		gen(fns.data[i].(*Function))
 	}
@@ -2,41 +2,85 @@ package main
 
 import (
 	"fmt"
+	"math"
 	"os"
+	"strings"
 )
 
 var irinfo = map[int]IRInfo{
-	IR_ADD:        {name: "ADD", ty: IR_TY_BINARY},
-	IR_CALL:       {name: "CALL", ty: IR_TY_CALL},
-	IR_DIV:        {name: "DIV", ty: IR_TY_REG_REG},
-	IR_IMM:        {name: "IMM", ty: IR_TY_REG_IMM},
-	IR_JMP:        {name: "JMP", ty: IR_TY_JMP},
-	IR_KILL:       {name: "KILL", ty: IR_TY_REG},
-	IR_LABEL:      {name: "", ty: IR_TY_LABEL},
-	IR_LABEL_ADDR: {name: "LABEL_ADDR", ty: IR_TY_LABEL_ADDR},
-	IR_EQ:         {name: "EQ", ty: IR_TY_REG_REG},
-	IR_NE:         {name: "NE", ty: IR_TY_REG_REG},
-	IR_LE:         {name: "LE", ty: IR_TY_REG_REG},
-	IR_LT:         {name: "LT", ty: IR_TY_REG_REG},
-	IR_AND:        {name: "AND", ty: IR_TY_REG_REG},
-	IR_OR:         {name: "OR", ty: IR_TY_REG_REG},
-	IR_XOR:        {name: "XOR", ty: IR_TY_BINARY},
-	IR_SHL:        {name: "SHL", ty: IR_TY_REG_REG},
-	IR_SHR:        {name: "SHR", ty: IR_TY_REG_REG},
-	IR_LOAD:       {name: "LOAD", ty: IR_TY_MEM},
-	IR_MOD:        {name: "MOD", ty: IR_TY_REG_REG},
-	IR_NEG:        {name: "NEG", ty: IR_TY_REG},
-	IR_MOV:        {name: "MOV", ty: IR_TY_REG_REG},
-	IR_MUL:        {name: "MUL", ty: IR_TY_BINARY},
-	IR_NOP:        {name: "NOP", ty: IR_TY_NOARG},
-	IR_RETURN:     {name: "RET", ty: IR_TY_REG},
-	IR_STORE:      {name: "STORE", ty: IR_TY_MEM},
-	IR_STORE_ARG:  {name: "STORE_ARG", ty: IR_TY_STORE_ARG},
-	IR_SUB:        {name: "SUB", ty: IR_TY_BINARY},
-	IR_BPREL:      {name: "BPREL", ty: IR_TY_REG_IMM},
-	IR_IF:         {name: "IF", ty: IR_TY_REG_LABEL},
-	IR_UNLESS:     {name: "UNLESS", ty: IR_TY_REG_LABEL},
-	0:             {name: "", ty: 0},
+	IR_ADD:             {name: "ADD", ty: IR_TY_BINARY},
+	IR_CALL:            {name: "CALL", ty: IR_TY_CALL},
+	IR_ICALL:           {name: "ICALL", ty: IR_TY_CALL},
+	IR_DIV:             {name: "DIV", ty: IR_TY_REG_REG},
+	IR_IMM:             {name: "IMM", ty: IR_TY_REG_IMM},
+	IR_JMP:             {name: "JMP", ty: IR_TY_JMP},
+	IR_LABEL:           {name: "", ty: IR_TY_LABEL},
+	IR_LABEL_ADDR:      {name: "LABEL_ADDR", ty: IR_TY_LABEL_ADDR},
+	IR_EQ:              {name: "EQ", ty: IR_TY_REG_REG},
+	IR_NE:              {name: "NE", ty: IR_TY_REG_REG},
+	IR_LE:              {name: "LE", ty: IR_TY_REG_REG},
+	IR_LT:              {name: "LT", ty: IR_TY_REG_REG},
+	IR_AND:             {name: "AND", ty: IR_TY_REG_REG},
+	IR_OR:              {name: "OR", ty: IR_TY_REG_REG},
+	IR_XOR:             {name: "XOR", ty: IR_TY_BINARY},
+	IR_SHL:             {name: "SHL", ty: IR_TY_REG_REG},
+	IR_SHR:             {name: "SHR", ty: IR_TY_REG_REG},
+	IR_LOAD:            {name: "LOAD", ty: IR_TY_MEM},
+	IR_MOD:             {name: "MOD", ty: IR_TY_REG_REG},
+	IR_NEG:             {name: "NEG", ty: IR_TY_REG},
+	IR_MOV:             {name: "MOV", ty: IR_TY_REG_REG},
+	IR_MUL:             {name: "MUL", ty: IR_TY_BINARY},
+	IR_NOP:             {name: "NOP", ty: IR_TY_NOARG},
+	IR_RETURN:          {name: "RET", ty: IR_TY_REG},
+	IR_STORE:           {name: "STORE", ty: IR_TY_MEM},
+	IR_STORE_ARG:       {name: "STORE_ARG", ty: IR_TY_STORE_ARG},
+	IR_STORE_STACK_ARG: {name: "STORE_STACK_ARG", ty: IR_TY_STORE_ARG},
+	IR_SUB:             {name: "SUB", ty: IR_TY_BINARY},
+	IR_BPREL:           {name: "BPREL", ty: IR_TY_REG_IMM},
+	IR_IF:              {name: "IF", ty: IR_TY_REG_LABEL},
+	IR_UNLESS:          {name: "UNLESS", ty: IR_TY_REG_LABEL},
+	IR_JMP_TABLE:       {name: "JMP_TABLE", ty: IR_TY_JMP_TABLE},
+	IR_CAST:            {name: "CAST", ty: IR_TY_CAST},
+	IR_FIMM:            {name: "FIMM", ty: IR_TY_FIMM},
+	IR_FMOV:            {name: "FMOV", ty: IR_TY_FREG_FREG},
+	IR_FADD:            {name: "FADD", ty: IR_TY_FREG_FREG},
+	IR_FSUB:            {name: "FSUB", ty: IR_TY_FREG_FREG},
+	IR_FMUL:            {name: "FMUL", ty: IR_TY_FREG_FREG},
+	IR_FDIV:            {name: "FDIV", ty: IR_TY_FREG_FREG},
+	IR_FNEG:            {name: "FNEG", ty: IR_TY_FREG},
+	IR_FEQ:             {name: "FEQ", ty: IR_TY_FCMP},
+	IR_FNE:             {name: "FNE", ty: IR_TY_FCMP},
+	IR_FLT:             {name: "FLT", ty: IR_TY_FCMP},
+	IR_FLE:             {name: "FLE", ty: IR_TY_FCMP},
+	IR_FLOAD:           {name: "FLOAD", ty: IR_TY_FREG_REG},
+	IR_FSTORE:          {name: "FSTORE", ty: IR_TY_REG_FREG},
+	IR_FSTORE_ARG:      {name: "FSTORE_ARG", ty: IR_TY_STORE_ARG},
+	IR_FRETURN:         {name: "FRET", ty: IR_TY_FREG},
+	IR_I2F:             {name: "I2F", ty: IR_TY_FREG_REG},
+	IR_F2I:             {name: "F2I", ty: IR_TY_REG_FREG},
+	IR_F2F:             {name: "F2F", ty: IR_TY_FREG},
+	IR_SRETURN:         {name: "SRET", ty: IR_TY_REG},
+	IR_MEMCPY:          {name: "MEMCPY", ty: IR_TY_MEM},
+	IR_LOAD_SPILL:      {name: "LOAD_SPILL", ty: IR_TY_REG_IMM},
+	IR_STORE_SPILL:     {name: "STORE_SPILL", ty: IR_TY_REG_IMM},
+	IR_FLOAD_SPILL:     {name: "FLOAD_SPILL", ty: IR_TY_FREG_IMM},
+	IR_FSTORE_SPILL:    {name: "FSTORE_SPILL", ty: IR_TY_FREG_IMM},
+	IR_PHI:             {name: "PHI", ty: IR_TY_PHI},
+	0:                  {name: "", ty: 0},
+}
+
+func unsigned_suffix(ir *IR) string {
+	if ir.is_unsigned {
+		return "U"
+	}
+	return ""
+}
+
+func fimm_str(ir *IR) string {
+	if ir.size == 4 {
+		return format("%g", math.Float32frombits(uint32(ir.rhs)))
+	}
+	return format("%g", math.Float64frombits(uint64(ir.rhs)))
 }
 
 func tostr(ir *IR) string {
@@ -60,23 +104,77 @@ func tostr(ir *IR) string {
 	case IR_TY_REG_REG:
 		return format("\t%s r%d, r%d", info.name, ir.lhs, ir.rhs)
 	case IR_TY_MEM:
-		return format("\t%s%d r%d, r%d", info.name, ir.size, ir.lhs, ir.rhs)
+		return format("\t%s%d%s r%d, r%d", info.name, ir.size, unsigned_suffix(ir), ir.lhs, ir.rhs)
+	case IR_TY_CAST:
+		return format("\t%s%d%s r%d", info.name, ir.size, unsigned_suffix(ir), ir.lhs)
 	case IR_TY_REG_IMM:
 		return format("\t%s r%d, %d", info.name, ir.lhs, ir.rhs)
 	case IR_TY_STORE_ARG:
 		return format("\t%s%d %d, %d", info.name, ir.size, ir.lhs, ir.rhs)
 	case IR_TY_REG_LABEL:
 		return format("\t%s r%d, .L%d", info.name, ir.lhs, ir.rhs)
-	case IR_TY_CALL:
+	case IR_TY_FIMM:
+		return format("\t%s%d f%d, %s", info.name, ir.size, ir.lhs, fimm_str(ir))
+	case IR_TY_FREG_IMM:
+		return format("\t%s f%d, %d", info.name, ir.lhs, ir.rhs)
+	case IR_TY_FREG:
+		return format("\t%s%d f%d", info.name, ir.size, ir.lhs)
+	case IR_TY_FREG_FREG:
+		return format("\t%s%d f%d, f%d", info.name, ir.size, ir.lhs, ir.rhs)
+	case IR_TY_FREG_REG:
+		return format("\t%s%d%s f%d, r%d", info.name, ir.size, unsigned_suffix(ir), ir.lhs, ir.rhs)
+	case IR_TY_REG_FREG:
+		return format("\t%s%d%s r%d, f%d", info.name, ir.size, unsigned_suffix(ir), ir.lhs, ir.rhs)
+	case IR_TY_FCMP:
+		return format("\t%s%d r%d, f%d, f%d", info.name, ir.size, ir.dst, ir.lhs, ir.rhs)
+	case IR_TY_JMP_TABLE:
 		{
 			sb := new_sb()
-			sb_append(sb, format("r%d = %s(", ir.lhs, ir.name))
-			for i := 0; i < ir.nargs; i++ {
+			sb_append(sb, format("\t%s r%d, .L%d, [", info.name, ir.lhs, ir.rhs))
+			for i, l := range ir.labels {
 				if i != 0 {
 					sb_append(sb, ", ")
 				}
-				sb_append(sb, format("r%d", ir.args[i]))
+				sb_append(sb, format(".L%d", l))
+			}
+			sb_append(sb, "]")
+			return sb_get(sb)
+		}
+	case IR_TY_PHI:
+		{
+			r := "r"
+			if ir.is_fp {
+				r = "f"
 			}
+			var args []string
+			for i, a := range ir.args {
+				args = append(args, format("%s%d bb%d", r, a, ir.preds[i].id))
+			}
+			return format("\t%s %s%d, [%s]", info.name, r, ir.lhs, strings.Join(args, ", "))
+		}
+	case IR_TY_CALL:
+		{
+			sb := new_sb()
+			name := ir.name
+			if ir.op == IR_ICALL {
+				name = format("*r%d", ir.rhs)
+			}
+			if ir.is_fp {
+				sb_append(sb, format("f%d = %s(", ir.lhs, name))
+			} else {
+				sb_append(sb, format("r%d = %s(", ir.lhs, name))
+			}
+			var args []string
+			for _, a := range ir.args {
+				args = append(args, format("r%d", a))
+			}
+			for _, a := range ir.fargs {
+				args = append(args, format("f%d", a))
+			}
+			for _, off := range ir.stack_args {
+				args = append(args, format("[rbp-%d]", off))
+			}
+			sb_append(sb, strings.Join(args, ", "))
 			sb_append(sb, ")\n")
 			return sb_get(sb)
 		}
@@ -84,15 +182,17 @@ func tostr(ir *IR) string {
 		//asset(info.ty == IR_TY_NOARG)
 		return format("\t%s", info.name)
 	}
-	return ""
 }
 
 func dump_ir(irv *Vector) {
 	for i := 0; i < irv.len; i++ {
 		fn := irv.data[i].(*Function)
 		fmt.Fprintf(os.Stderr, "%s():\n", fn.name)
-		for j := 0; j < fn.ir.len; j++ {
-			fmt.Fprintf(os.Stderr, "%s\n", tostr(fn.ir.data[j].(*IR)))
+		for j := 0; j < fn.bbs.len; j++ {
+			bb := fn.bbs.data[j].(*BB)
+			for k := 0; k < bb.ir.len; k++ {
+				fmt.Fprintf(os.Stderr, "%s\n", tostr(bb.ir.data[k].(*IR)))
+			}
 		}
 	}
 }
@@ -1,56 +1,394 @@
 package main
 
 import (
+	"bufio"
+	"fmt"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
 )
 
-func main() {
+// The value of __9CCGO__
+const version = "1"
 
-	debug := false
-	if len(os.Args) == 1 {
-		usage()
+// A -D or -U option. They are processed in the order given.
+type Macro_opt struct {
+	undef bool
+	arg   string
+}
+
+var (
+	// Output of the compiler: assembly, or preprocessed source for -E.
+	out *bufio.Writer
+
+	opt_o     string
+	opt_E     bool
+	opt_S     bool
+	opt_c     bool
+	opt_cc1   bool
+	dump_ir1  bool
+	dump_ir2  bool
+	dump_cfg_ bool
+
+	// -O<n>. The optimizer runs if this is not zero.
+	opt_level int
+
+	macro_opts []Macro_opt
+	inputs     []string
+
+	// Options passed through to the compiler proper (-cc1) and the
+	// linker.
+	cc1_args []string
+	ld_args  []string
+
+	tmpfiles []string
+
+	// True if compiling an input has failed. The remaining inputs
+	// are still compiled to report their errors, but nothing is
+	// linked.
+	failed bool
+)
+
+// Options that take an argument. The argument is either attached to
+// the option or given as the next word.
+var arg_opts = []string{"-o", "-I", "-isystem", "-D", "-U", "-L", "-l"}
+
+func usage() {
+	error("Usage: 9ccgo [-test] [-E] [-S] [-c] [-o <file>] [-dump-ir1] [-dump-ir2] [-dump-cfg] [-O<n>] [-fmax-errors=<n>] [-W[no-]<warning>] [-Werror] [-I<dir>] [-isystem <dir>] [-D<name>[=<val>]] [-U<name>] [-L<dir>] [-l<lib>] <file>...")
+}
+
+func parse_args(args []string) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+
+		opt := ""
+		for _, o := range arg_opts {
+			if strings.HasPrefix(arg, o) {
+				opt = o
+				break
+			}
+		}
+
+		if opt != "" {
+			val := arg[len(opt):]
+			if val == "" {
+				if i+1 == len(args) {
+					error("argument to '%s' is missing", arg)
+				}
+				i++
+				val = args[i]
+			}
+
+			switch opt {
+			case "-o":
+				opt_o = val
+			case "-I":
+				include_paths = append(include_paths, val)
+				cc1_args = append(cc1_args, "-I", val)
+			case "-isystem":
+				system_include_paths = append(system_include_paths, val)
+				cc1_args = append(cc1_args, "-isystem", val)
+			case "-D", "-U":
+				macro_opts = append(macro_opts, Macro_opt{opt == "-U", val})
+				cc1_args = append(cc1_args, opt, val)
+			case "-L":
+				ld_args = append(ld_args, "-L"+val)
+			case "-l":
+				// Libraries are linked in the order of inputs.
+				inputs = append(inputs, "-l"+val)
+			}
+			continue
+		}
+
+		switch {
+		case arg == "-cc1":
+			opt_cc1 = true
+		case arg == "-E":
+			opt_E = true
+		case arg == "-S":
+			opt_S = true
+		case arg == "-c":
+			opt_c = true
+		case arg == "-dump-ir1":
+			dump_ir1 = true
+			cc1_args = append(cc1_args, arg)
+		case arg == "-dump-ir2":
+			dump_ir2 = true
+			cc1_args = append(cc1_args, arg)
+		case arg == "-dump-cfg":
+			dump_cfg_ = true
+			cc1_args = append(cc1_args, arg)
+		case strings.HasPrefix(arg, "-O"):
+			opt_level = 1
+			if arg != "-O" {
+				n, err := strconv.Atoi(arg[2:])
+				if err != nil || n < 0 {
+					error("invalid argument: %s", arg)
+				}
+				opt_level = n
+			}
+			cc1_args = append(cc1_args, arg)
+		case strings.HasPrefix(arg, "-fmax-errors="):
+			n, err := strconv.Atoi(arg[len("-fmax-errors="):])
+			if err != nil || n < 0 {
+				error("invalid argument: %s", arg)
+			}
+			max_errors = n
+			cc1_args = append(cc1_args, arg)
+		case strings.HasPrefix(arg, "-W"):
+			if !warning_opt(arg[2:]) {
+				error("unknown warning option: %s", arg)
+			}
+			cc1_args = append(cc1_args, arg)
+		case arg == "-static":
+		case arg != "-" && strings.HasPrefix(arg, "-"):
+			error("unknown argument: %s", arg)
+		default:
+			inputs = append(inputs, arg)
+		}
 	}
-	if len(os.Args) == 2 && os.Args[1] == "-test" {
-		util_test()
-		os.Exit(0)
+
+	if len(inputs) == 0 {
+		error("no input files")
+	}
+}
+
+func cleanup() {
+	for _, path := range tmpfiles {
+		os.Remove(path)
+	}
+}
+
+func create_tmpfile(ext string) string {
+	f, err := os.CreateTemp("", "9ccgo-*"+ext)
+	if err != nil {
+		cleanup()
+		error("cannot create a temporary file: %s", err)
 	}
+	f.Close()
+	tmpfiles = append(tmpfiles, f.Name())
+	return f.Name()
+}
 
-	path := ""
-	dump_ir1 := false
-	dump_ir2 := false
+// Reports an error of the driver and records the failure.
+func driver_error(format string, a ...interface{}) {
+	fmt.Fprintf(os.Stderr, format, a...)
+	fmt.Fprintf(os.Stderr, "\n")
+	failed = true
+}
 
-	if len(os.Args) == 3 && os.Args[1] == "-dump-ir1" {
-		dump_ir1 = true
-		path = os.Args[2]
-	} else if len(os.Args) == 3 && os.Args[1] == "-dump-ir2" {
-		dump_ir2 = true
-		path = os.Args[2]
-	} else {
-		if len(os.Args) != 2 {
-			usage()
+// Runs a command. Returns false if it fails.
+func run(name string, args ...string) bool {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			driver_error("%s: %s", name, err)
 		}
-		path = os.Args[1]
+		failed = true
+		return false
+	}
+	return true
+}
+
+// Runs the compiler proper in a child process, so that each input
+// file is compiled with fresh global state.
+func run_cc1(input, output string) bool {
+	self, err := os.Executable()
+	if err != nil {
+		self = os.Args[0]
+	}
+
+	args := []string{"-cc1"}
+	args = append(args, cc1_args...)
+	if opt_E {
+		args = append(args, "-E")
+	}
+	args = append(args, "-o", output, input)
+	return run(self, args...)
+}
+
+func assemble(input, output string) bool {
+	return run("as", "-o", output, input)
+}
+
+// Generated code is not position-independent, so it is linked
+// statically.
+func link(inputs []string, output string) bool {
+	args := []string{"-static", "-o", output}
+	args = append(args, ld_args...)
+	args = append(args, inputs...)
+	return run("cc", args...)
+}
+
+// Returns the output path for a given input when -o is not given.
+// For example, "foo/bar.c" becomes "bar.o" for -c. The output of -E
+// goes to stdout ("-").
+func output_path(input, ext string) string {
+	if opt_o != "" {
+		return opt_o
+	}
+	if ext == "-" {
+		return ext
+	}
+	base := filepath.Base(input)
+	return strings.TrimSuffix(base, filepath.Ext(base)) + ext
+}
+
+func open_output() *os.File {
+	f := os.Stdout
+	if opt_o != "" && opt_o != "-" {
+		f2, err := os.Create(opt_o)
+		if err != nil {
+			error("cannot open output file: %s: %s", opt_o, err)
+		}
+		f = f2
+	}
+	out = bufio.NewWriter(f)
+	return f
+}
+
+// Compiles a C file to assembly, or preprocesses it for -E. The
+// output file is opened after the whole file has been compiled, so
+// an error does not leave a partial output.
+func cc1() {
+	if len(inputs) != 1 {
+		error("-cc1 takes exactly one input file")
+	}
+	path := inputs[0]
+
+	init_macros()
+	for _, o := range macro_opts {
+		if o.undef {
+			undef_cmdline(o.arg)
+		} else {
+			define_cmdline(o.arg)
+		}
+	}
+
+	if opt_E {
+		tokens := preprocess(scan_file(path, false), path, -1)
+		f := open_output()
+		print_preprocessed(tokens)
+		out.Flush()
+		f.Close()
+		return
 	}
 
 	// Tokenize and parse.
 	tokens := tokenize(path, true)
-	if debug {
-		print_tokens(tokens)
-	}
 	nodes := parse(tokens)
 	globals := sema(nodes)
+	check_errors()
+	fold_constants(nodes)
 	fns := gen_ir(nodes)
+	if opt_level > 0 {
+		optimize(fns)
+	}
 
 	if dump_ir1 {
 		dump_ir(fns)
 	}
+	if dump_cfg_ {
+		dump_cfg(fns)
+	}
 
 	alloc_regs(fns)
 	if dump_ir2 {
 		dump_ir(fns)
 	}
 
+	f := open_output()
 	gen_x86(globals, fns)
+	out.Flush()
+	f.Close()
 }
 
-func usage() { error("Usage: 9ccgo [-test] [-dump-ir1] [-dump-ir2] <file>") }
+func main() {
+	if len(os.Args) == 1 {
+		usage()
+	}
+	if len(os.Args) == 2 && os.Args[1] == "-test" {
+		util_test()
+		os.Exit(0)
+	}
+
+	parse_args(os.Args[1:])
+	if opt_cc1 {
+		cc1()
+		return
+	}
+
+	if len(inputs) > 1 && opt_o != "" && (opt_c || opt_S || opt_E) {
+		error("cannot specify '-o' with '-c', '-S' or '-E' with multiple files")
+	}
+
+	var ld_inputs []string
+	for _, input := range inputs {
+		if strings.HasPrefix(input, "-l") {
+			ld_inputs = append(ld_inputs, input)
+			continue
+		}
+
+		// "-" is C source from stdin.
+		ext := filepath.Ext(input)
+		if input == "-" {
+			ext = ".c"
+		}
+
+		switch ext {
+		case ".o", ".a", ".so":
+			ld_inputs = append(ld_inputs, input)
+		case ".s":
+			if opt_E || opt_S {
+				continue
+			}
+			if opt_c {
+				assemble(input, output_path(input, ".o"))
+				continue
+			}
+			obj := create_tmpfile(".o")
+			if assemble(input, obj) {
+				ld_inputs = append(ld_inputs, obj)
+			}
+		case ".c", ".i":
+			if opt_E {
+				run_cc1(input, output_path(input, "-"))
+				continue
+			}
+			if opt_S {
+				run_cc1(input, output_path(input, ".s"))
+				continue
+			}
+			asm := create_tmpfile(".s")
+			if !run_cc1(input, asm) {
+				continue
+			}
+			if opt_c {
+				assemble(asm, output_path(input, ".o"))
+				continue
+			}
+			obj := create_tmpfile(".o")
+			if assemble(asm, obj) {
+				ld_inputs = append(ld_inputs, obj)
+			}
+		default:
+			driver_error("%s: unknown file type", input)
+		}
+	}
+
+	if !failed && !opt_E && !opt_S && !opt_c {
+		if opt_o == "" {
+			opt_o = "a.out"
+		}
+		link(ld_inputs, opt_o)
+	}
+	cleanup()
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,571 @@
+package main
+
+// Optimizer
+//
+// With -O1, each function is converted to SSA form and optimized by
+// the following passes before it is converted back:
+//
+//  - Sparse conditional constant propagation finds registers whose
+//    values are constant and branches that are never taken, and
+//    removes blocks that cannot be executed.
+//
+//  - Global value numbering replaces a computation with the result of
+//    the same computation in a dominating block. Copies are removed
+//    by replacing the uses of their results with their operands.
+//
+//  - Dead code elimination removes instructions whose results are
+//    never used.
+
+import "math"
+
+// Sparse conditional constant propagation
+
+const (
+	LAT_TOP    = iota // No value is known yet
+	LAT_CONST         // The value is constant
+	LAT_BOTTOM        // The value is not constant
+)
+
+type Lattice struct {
+	state int
+	val   int
+}
+
+func meet(a, b Lattice) Lattice {
+	if a.state == LAT_TOP {
+		return b
+	}
+	if b.state == LAT_TOP {
+		return a
+	}
+	if a.state == LAT_CONST && b.state == LAT_CONST && a.val == b.val {
+		return a
+	}
+	return Lattice{state: LAT_BOTTOM}
+}
+
+// Computes the result of an integer instruction as x86-64 does.
+// Returns false if it cannot be computed at compile time, such as
+// division by zero.
+func fold(ir *IR, a, b int) (int, bool) {
+	ua, ub := uint64(a), uint64(b)
+	switch ir.op {
+	case IR_ADD:
+		return a + b, true
+	case IR_SUB:
+		return a - b, true
+	case IR_MUL:
+		return a * b, true
+	case IR_DIV, IR_MOD:
+		if b == 0 || (!ir.is_unsigned && a == math.MinInt64 && b == -1) {
+			return 0, false
+		}
+		switch {
+		case ir.op == IR_DIV && ir.is_unsigned:
+			return int(ua / ub), true
+		case ir.op == IR_DIV:
+			return a / b, true
+		case ir.is_unsigned:
+			return int(ua % ub), true
+		}
+		return a % b, true
+	case IR_AND:
+		return a & b, true
+	case IR_OR:
+		return a | b, true
+	case IR_XOR:
+		return a ^ b, true
+	case IR_SHL:
+		return a << (ub & 63), true
+	case IR_SHR:
+		if ir.is_unsigned {
+			return int(ua >> (ub & 63)), true
+		}
+		return a >> (ub & 63), true
+	case IR_EQ:
+		return bool_to_int(a == b), true
+	case IR_NE:
+		return bool_to_int(a != b), true
+	case IR_LT:
+		if ir.is_unsigned {
+			return bool_to_int(ua < ub), true
+		}
+		return bool_to_int(a < b), true
+	case IR_LE:
+		if ir.is_unsigned {
+			return bool_to_int(ua <= ub), true
+		}
+		return bool_to_int(a <= b), true
+	case IR_NEG:
+		return -a, true
+	case IR_CAST:
+		ty := new_prim_ty(INT, ir.size)
+		ty.is_unsigned = ir.is_unsigned
+		return wrap_int(a, ty), true
+	}
+	return 0, false
+}
+
+type Edge struct {
+	from, to *BB
+}
+
+func sccp(fn *Function) {
+	where := make(map[*IR]*BB)
+	users := make(map[int][]*IR)
+	for i := 0; i < fn.bbs.len; i++ {
+		bb := fn.bbs.data[i].(*BB)
+		for j := 0; j < bb.ir.len; j++ {
+			ir := bb.ir.data[j].(*IR)
+			where[ir] = bb
+			for _, op := range ssa_operands(ir) {
+				if op.is_use {
+					users[*op.r] = append(users[*op.r], ir)
+				}
+			}
+		}
+	}
+
+	label_bb := label_map(fn.bbs)
+	lat := make(map[int]Lattice)
+	exec_bb := make(map[*BB]bool)
+	exec_edge := make(map[Edge]bool)
+	var flow []Edge
+	var ssa_work []int
+
+	set := func(r int, x Lattice) {
+		if lat[r] != x {
+			lat[r] = x
+			ssa_work = append(ssa_work, r)
+		}
+	}
+
+	mark := func(from, to *BB) {
+		e := Edge{from, to}
+		if !exec_edge[e] {
+			exec_edge[e] = true
+			flow = append(flow, e)
+		}
+	}
+
+	// Marks edges to the blocks that can follow a given block.
+	visit_jump := func(bb *BB) {
+		var next *BB
+		if bb.id+1 < fn.bbs.len {
+			next = fn.bbs.data[bb.id+1].(*BB)
+		}
+		if bb.ir.len == 0 {
+			mark(bb, next)
+			return
+		}
+
+		ir := vec_last(bb.ir).(*IR)
+		switch ir.op {
+		case IR_JMP:
+			mark(bb, label_bb[ir.lhs])
+		case IR_IF, IR_UNLESS:
+			c := lat[ir.lhs]
+			switch {
+			case c.state == LAT_BOTTOM:
+				mark(bb, label_bb[ir.rhs])
+				mark(bb, next)
+			case c.state == LAT_CONST && (c.val != 0) == (ir.op == IR_IF):
+				mark(bb, label_bb[ir.rhs])
+			case c.state == LAT_CONST:
+				mark(bb, next)
+			}
+		case IR_JMP_TABLE, IR_RETURN, IR_FRETURN, IR_SRETURN:
+			for i := 0; i < bb.succ.len; i++ {
+				mark(bb, bb.succ.data[i].(*BB))
+			}
+		default:
+			mark(bb, next)
+		}
+	}
+
+	operand := func(r int) Lattice { return lat[r] }
+	imm := func(x int) Lattice { return Lattice{LAT_CONST, x} }
+	bottom := Lattice{state: LAT_BOTTOM}
+
+	visit := func(ir *IR) {
+		bb := where[ir]
+		if ir.op == IR_PHI {
+			x := Lattice{}
+			for i, p := range ir.preds {
+				if exec_edge[Edge{p, bb}] {
+					x = meet(x, operand(ir.args[i]))
+				}
+			}
+			set(ir.lhs, x)
+			return
+		}
+		if is_terminator(ir) {
+			visit_jump(bb)
+			return
+		}
+
+		def := ssa_def(ir)
+		if def == nil {
+			return
+		}
+		if def.is_fp {
+			set(*def.r, bottom)
+			return
+		}
+
+		var a, b Lattice
+		switch ir.op {
+		case IR_IMM:
+			set(ir.lhs, imm(ir.rhs))
+			return
+		case IR_MOV:
+			set(ir.lhs, operand(ir.rhs))
+			return
+		case IR_ADD, IR_SUB, IR_MUL, IR_XOR:
+			a = operand(ir.lhs)
+			if ir.is_imm {
+				b = imm(ir.rhs)
+			} else {
+				b = operand(ir.rhs)
+			}
+		case IR_DIV, IR_MOD, IR_AND, IR_OR, IR_SHL, IR_SHR, IR_EQ, IR_NE, IR_LT, IR_LE:
+			a, b = operand(ir.lhs), operand(ir.rhs)
+		case IR_NEG, IR_CAST:
+			a, b = operand(ir.lhs), imm(0)
+		default:
+			set(*def.r, bottom)
+			return
+		}
+
+		switch {
+		case a.state == LAT_BOTTOM || b.state == LAT_BOTTOM:
+			set(*def.r, bottom)
+		case a.state == LAT_TOP || b.state == LAT_TOP:
+		default:
+			if val, ok := fold(ir, a.val, b.val); ok {
+				set(*def.r, imm(val))
+			} else {
+				set(*def.r, bottom)
+			}
+		}
+	}
+
+	visit_bb := func(bb *BB) {
+		for i := 0; i < bb.ir.len; i++ {
+			visit(bb.ir.data[i].(*IR))
+		}
+		if bb.ir.len == 0 || !is_terminator(vec_last(bb.ir).(*IR)) {
+			visit_jump(bb)
+		}
+	}
+
+	entry := fn.bbs.data[0].(*BB)
+	exec_bb[entry] = true
+	visit_bb(entry)
+
+	for len(flow) > 0 || len(ssa_work) > 0 {
+		if len(flow) > 0 {
+			e := flow[len(flow)-1]
+			flow = flow[:len(flow)-1]
+			if e.to == nil {
+				continue
+			}
+			if !exec_bb[e.to] {
+				exec_bb[e.to] = true
+				visit_bb(e.to)
+				continue
+			}
+			for i := 0; i < e.to.ir.len; i++ {
+				if ir := e.to.ir.data[i].(*IR); ir.op == IR_PHI {
+					visit(ir)
+				}
+			}
+			continue
+		}
+
+		r := ssa_work[len(ssa_work)-1]
+		ssa_work = ssa_work[:len(ssa_work)-1]
+		for _, ir := range users[r] {
+			if exec_bb[where[ir]] {
+				visit(ir)
+			}
+		}
+	}
+
+	// Replace constants with immediates and fold branches. Blocks
+	// that are never executed become unreachable and are removed.
+	for i := 0; i < fn.bbs.len; i++ {
+		bb := fn.bbs.data[i].(*BB)
+		if !exec_bb[bb] {
+			continue
+		}
+
+		head, body := new_vec(), new_vec()
+		for j := 0; j < bb.ir.len; j++ {
+			ir := bb.ir.data[j].(*IR)
+			if ir.op == IR_IF || ir.op == IR_UNLESS {
+				if c := lat[ir.lhs]; c.state == LAT_CONST {
+					if (c.val != 0) == (ir.op == IR_IF) {
+						vec_push(body, &IR{op: IR_JMP, lhs: ir.rhs})
+					}
+					continue
+				}
+			}
+
+			def := ssa_def(ir)
+			if def == nil || def.is_fp || ir.op == IR_IMM || lat[*def.r].state != LAT_CONST {
+				if ir.op == IR_LABEL || ir.op == IR_PHI {
+					vec_push(head, ir)
+				} else {
+					vec_push(body, ir)
+				}
+				continue
+			}
+			vec_push(body, &IR{op: IR_IMM, lhs: *def.r, rhs: lat[*def.r].val})
+		}
+
+		for j := 0; j < body.len; j++ {
+			vec_push(head, body.data[j])
+		}
+		bb.ir = head
+	}
+
+	fn.bbs = link_bbs(fn.bbs)
+	prune_phis(fn)
+}
+
+// Removes arguments of phi nodes that come from blocks that are no
+// longer predecessors.
+func prune_phis(fn *Function) {
+	for i := 0; i < fn.bbs.len; i++ {
+		bb := fn.bbs.data[i].(*BB)
+		is_pred := make(map[*BB]bool)
+		for j := 0; j < bb.pred.len; j++ {
+			is_pred[bb.pred.data[j].(*BB)] = true
+		}
+
+		for j := 0; j < bb.ir.len; j++ {
+			phi := bb.ir.data[j].(*IR)
+			if phi.op != IR_PHI {
+				continue
+			}
+			var args []int
+			var preds []*BB
+			for k, p := range phi.preds {
+				if is_pred[p] {
+					args = append(args, phi.args[k])
+					preds = append(preds, p)
+				}
+			}
+			phi.args, phi.preds = args, preds
+		}
+	}
+}
+
+// Global value numbering
+
+// The value computed by an instruction. Instructions that compute the
+// same Expr from the same registers have the same value.
+type Expr struct {
+	op          int
+	size        int
+	is_imm      bool
+	is_unsigned bool
+	lhs         int
+	rhs         int
+	name        string
+}
+
+func is_commutative(op int) bool {
+	switch op {
+	case IR_ADD, IR_MUL, IR_AND, IR_OR, IR_XOR, IR_EQ, IR_NE, IR_FADD, IR_FMUL:
+		return true
+	}
+	return false
+}
+
+// Returns the value of an instruction that has no side effects, or
+// false if it has or reads memory.
+func expr_of(ir *IR) (Expr, bool) {
+	e := Expr{op: ir.op, size: ir.size, is_imm: ir.is_imm, is_unsigned: ir.is_unsigned}
+	switch ir.op {
+	case IR_IMM, IR_BPREL, IR_FIMM:
+		e.rhs = ir.rhs
+	case IR_LABEL_ADDR:
+		e.name = ir.name
+	case IR_ADD, IR_SUB, IR_MUL, IR_DIV, IR_MOD, IR_AND, IR_OR, IR_XOR, IR_SHL, IR_SHR,
+		IR_EQ, IR_NE, IR_LT, IR_LE, IR_FADD, IR_FSUB, IR_FMUL, IR_FDIV,
+		IR_FEQ, IR_FNE, IR_FLT, IR_FLE:
+		e.lhs, e.rhs = ir.lhs, ir.rhs
+		if !ir.is_imm && is_commutative(ir.op) && e.lhs > e.rhs {
+			e.lhs, e.rhs = e.rhs, e.lhs
+		}
+	case IR_NEG, IR_CAST, IR_FNEG, IR_F2F:
+		e.lhs = ir.lhs
+	case IR_I2F, IR_F2I:
+		e.rhs = ir.rhs
+	default:
+		return e, false
+	}
+	return e, true
+}
+
+func gvn(fn *Function) {
+	idom := dominators(fn.bbs)
+	kids := dom_tree(fn.bbs, idom)
+
+	// A register whose value is the same as that of another register
+	// is replaced with it.
+	leader := make(map[int]int)
+	find := func(r int) int {
+		for {
+			l, ok := leader[r]
+			if !ok {
+				return r
+			}
+			r = l
+		}
+	}
+
+	table := make(map[Expr]int)
+
+	var walk func(bb *BB)
+	walk = func(bb *BB) {
+		var added []Expr
+		v := new_vec()
+		for i := 0; i < bb.ir.len; i++ {
+			ir := bb.ir.data[i].(*IR)
+			for _, op := range ssa_operands(ir) {
+				if op.is_use {
+					*op.r = find(*op.r)
+				}
+			}
+
+			switch ir.op {
+			case IR_MOV, IR_FMOV:
+				leader[ir.lhs] = ir.rhs
+				continue
+			case IR_PHI:
+				// A phi node whose arguments are all the same is
+				// a copy.
+				same := -1
+				for _, a := range ir.args {
+					if a == ir.lhs || a == same {
+						continue
+					}
+					if same != -1 {
+						same = -2
+						break
+					}
+					same = a
+				}
+				if same >= 0 {
+					leader[ir.lhs] = same
+					continue
+				}
+			}
+
+			if e, ok := expr_of(ir); ok {
+				def := ssa_def(ir)
+				if l, ok := table[e]; ok {
+					leader[*def.r] = l
+					continue
+				}
+				table[e] = *def.r
+				added = append(added, e)
+			}
+			vec_push(v, ir)
+		}
+		bb.ir = v
+
+		for _, kid := range kids[bb.id] {
+			walk(kid)
+		}
+		for _, e := range added {
+			delete(table, e)
+		}
+	}
+	walk(fn.bbs.data[0].(*BB))
+
+	// Uses in phi nodes may come before definitions in the dominator
+	// tree, so they are replaced again.
+	for i := 0; i < fn.bbs.len; i++ {
+		bb := fn.bbs.data[i].(*BB)
+		for j := 0; j < bb.ir.len; j++ {
+			for _, op := range ssa_operands(bb.ir.data[j].(*IR)) {
+				if op.is_use {
+					*op.r = find(*op.r)
+				}
+			}
+		}
+	}
+}
+
+// Dead code elimination
+
+func has_side_effect(ir *IR) bool {
+	switch ir.op {
+	case IR_STORE, IR_FSTORE, IR_MEMCPY, IR_CALL, IR_ICALL, IR_LABEL,
+		IR_STORE_ARG, IR_FSTORE_ARG, IR_STORE_STACK_ARG:
+		return true
+	}
+	return is_terminator(ir)
+}
+
+// Removes instructions whose results are not used by instructions
+// that have side effects, directly or indirectly.
+func dce(fn *Function) {
+	def_ir := make(map[int]*IR)
+	live := make(map[*IR]bool)
+	var work []*IR
+
+	for i := 0; i < fn.bbs.len; i++ {
+		bb := fn.bbs.data[i].(*BB)
+		for j := 0; j < bb.ir.len; j++ {
+			ir := bb.ir.data[j].(*IR)
+			if def := ssa_def(ir); def != nil {
+				def_ir[*def.r] = ir
+			}
+			if has_side_effect(ir) {
+				live[ir] = true
+				work = append(work, ir)
+			}
+		}
+	}
+
+	for len(work) > 0 {
+		ir := work[len(work)-1]
+		work = work[:len(work)-1]
+		for _, op := range ssa_operands(ir) {
+			if !op.is_use {
+				continue
+			}
+			if d := def_ir[*op.r]; d != nil && !live[d] {
+				live[d] = true
+				work = append(work, d)
+			}
+		}
+	}
+
+	for i := 0; i < fn.bbs.len; i++ {
+		bb := fn.bbs.data[i].(*BB)
+		v := new_vec()
+		for j := 0; j < bb.ir.len; j++ {
+			if ir := bb.ir.data[j].(*IR); live[ir] {
+				vec_push(v, ir)
+			}
+		}
+		bb.ir = v
+	}
+}
+
+func optimize(fns *Vector) {
+	for i := 0; i < fns.len; i++ {
+		fn := fns.data[i].(*Function)
+		to_ssa(fn)
+		sccp(fn)
+		gvn(fn)
+		dce(fn)
+		from_ssa(fn)
+	}
+}
@@ -9,17 +9,23 @@ package main
 // Semantic errors are detected in a later pass.
 
 var (
-	pos        = 0
-	penv       *PEnv
-	tokens     *Vector
-	int_ty     = Type{ty: INT, size: 4, align: 4}
-	null_stmt  = Node{op: ND_NULL}
-	break_stmt = Node{op: ND_BREAK}
+	pos       = 0
+	penv      *PEnv
+	tokens    *Vector
+	switches  *Vector
+	int_ty    = Type{ty: INT, size: 4, align: 4}
+	null_stmt = Node{op: ND_NULL}
 )
 
+// Enumerators are integer constants, so they are replaced with
+// their values by the parser. Variables and functions share the name
+// space with enumerators and typedefs, so they are recorded in vars
+// to hide the ones in outer scopes.
 type PEnv struct {
 	typedefs *Map
 	tags     *Map
+	enums    *Map
+	vars     *Map
 	next     *PEnv
 }
 
@@ -27,12 +33,24 @@ func new_penv(next *PEnv) *PEnv {
 	env := new(PEnv)
 	env.typedefs = new_map()
 	env.tags = new_map()
+	env.enums = new_map()
+	env.vars = new_map()
 	env.next = next
 	return env
 }
 
+// Declares a variable or a function in the current scope.
+func declare_var(name string) {
+	if name != "" {
+		map_put(penv.vars, name, true)
+	}
+}
+
 func find_typedef(name string) *Type {
 	for e := penv; e != nil; e = e.next {
+		if map_get(e.vars, name) != nil {
+			return nil
+		}
 		ty := map_get(e.typedefs, name)
 		if ty != nil {
 			return ty.(*Type)
@@ -41,6 +59,19 @@ func find_typedef(name string) *Type {
 	return nil
 }
 
+func find_enum(name string) *Node {
+	for e := penv; e != nil; e = e.next {
+		if map_get(e.vars, name) != nil {
+			return nil
+		}
+		val := map_get(e.enums, name)
+		if val != nil {
+			return new_num(val.(int))
+		}
+	}
+	return nil
+}
+
 func find_tag(name string) *Type {
 	for e := penv; e != nil; e = e.next {
 		ty := map_get(e.tags, name)
@@ -59,11 +90,19 @@ func expect(ty int) {
 	}
 
 	if isprint(rune(ty)) {
-		bad_token(t, format("%c expected", ty))
+		bad_syntax(t, format("%c expected", ty))
 	}
 	// assert(ty == TK_WHILE)
-	//bad_token(t, format("'while' expected", ty))
-	bad_token(t, "'while' expected")
+	bad_syntax(t, "'while' expected")
+}
+
+// A syntax error unwinds the parser to the innermost statement or
+// top-level declaration, which skips the rest of it and resumes.
+type Parse_error struct{}
+
+func bad_syntax(t *Token, msg string) {
+	error_at(t, "%s", msg)
+	panic(Parse_error{})
 }
 
 func new_prim_ty(ty, size int) *Type {
@@ -74,9 +113,20 @@ func new_prim_ty(ty, size int) *Type {
 	return ret
 }
 
-func void_tyf() *Type { return new_prim_ty(VOID, 0) }
-func char_tyf() *Type { return new_prim_ty(CHAR, 1) }
-func int_tyf() *Type  { return new_prim_ty(INT, 4) }
+func void_tyf() *Type   { return new_prim_ty(VOID, 0) }
+func char_tyf() *Type   { return new_prim_ty(CHAR, 1) }
+func short_tyf() *Type  { return new_prim_ty(SHORT, 2) }
+func int_tyf() *Type    { return new_prim_ty(INT, 4) }
+func long_tyf() *Type   { return new_prim_ty(LONG, 8) }
+func float_tyf() *Type  { return new_prim_ty(FLOAT, 4) }
+func double_tyf() *Type { return new_prim_ty(DOUBLE, 8) }
+func err_tyf() *Type    { return new_prim_ty(ERR, 4) }
+
+func unsigned_of(ty *Type) *Type {
+	ret := new_prim_ty(ty.ty, ty.size)
+	ret.is_unsigned = true
+	return ret
+}
 
 func consume(ty int) bool {
 	t := tokens.data[pos].(*Token)
@@ -93,19 +143,29 @@ func is_typename() bool {
 		ret := find_typedef(t.name)
 		return ret != nil
 	}
-	return t.ty == TK_INT || t.ty == TK_CHAR || t.ty == TK_VOID || t.ty == TK_STRUCT
+	switch t.ty {
+	case TK_INT, TK_CHAR, TK_SHORT, TK_LONG, TK_SIGNED, TK_UNSIGNED, TK_FLOAT, TK_DOUBLE, TK_VOID, TK_STRUCT, TK_UNION, TK_ENUM:
+		return true
+	}
+	return false
 }
 
 func add_members(ty *Type, members *Vector) {
-	off := 0
+	off, size := 0, 0
 	for i := 0; i < members.len; i++ {
 		node := members.data[i].(*Node)
 		//assert(node.op == ND_VARDEF)
 
 		t := node.ty
+		if ty.is_union {
+			off = 0
+		}
 		off = roundup(off, t.align)
 		t.offset = off
 		off += t.size
+		if size < off {
+			size = off
+		}
 
 		if ty.align < node.ty.align {
 			ty.align = node.ty.align
@@ -113,7 +173,99 @@ func add_members(ty *Type, members *Vector) {
 	}
 
 	ty.members = members
-	ty.size = roundup(off, ty.align)
+	ty.size = roundup(size, ty.align)
+}
+
+// Reads a constant expression and returns its value.
+func const_expr() int {
+	t := tokens.data[pos].(*Token)
+	val, ok := eval(conditional())
+	if !ok {
+		bad_syntax(t, "constant expression expected")
+	}
+	return val
+}
+
+// An enum type is treated as int. An enumerator without a value is
+// one greater than the previous one.
+func enum_specifier() *Type {
+	t := tokens.data[pos].(*Token)
+	if t.ty == TK_IDENT {
+		pos++
+	}
+	if t.ty != TK_IDENT && tokens.data[pos].(*Token).ty != '{' {
+		bad_syntax(t, "bad enum definition")
+	}
+
+	ty := int_tyf()
+	if t.ty == TK_IDENT {
+		map_put(penv.tags, t.name, ty)
+	}
+	if !consume('{') {
+		return ty
+	}
+
+	val := 0
+	for !consume('}') {
+		name := ident()
+		if consume('=') {
+			val = const_expr()
+		}
+		map_put(penv.enums, name, val)
+		val++
+
+		if consume('}') {
+			break
+		}
+		expect(',')
+	}
+	return ty
+}
+
+// Integer types can be written with multiple keywords in any order,
+// e.g. "unsigned long int" or "long unsigned".
+func int_specifiers() *Type {
+	t := tokens.data[pos].(*Token)
+	nchar, nshort, nint, nlong, nsigned, nunsigned := 0, 0, 0, 0, 0, 0
+
+	for {
+		if consume(TK_CHAR) {
+			nchar++
+		} else if consume(TK_SHORT) {
+			nshort++
+		} else if consume(TK_INT) {
+			nint++
+		} else if consume(TK_LONG) {
+			nlong++
+		} else if consume(TK_SIGNED) {
+			nsigned++
+		} else if consume(TK_UNSIGNED) {
+			nunsigned++
+		} else {
+			break
+		}
+	}
+
+	if nsigned+nunsigned > 1 || nchar+nshort+nlong > 1 && !(nlong == 2 && nchar+nshort == 0) ||
+		nchar+nint > 1 || nlong > 2 {
+		bad_syntax(t, "invalid type")
+	}
+
+	var ty *Type
+	if nchar != 0 {
+		ty = char_tyf()
+	} else if nshort != 0 {
+		ty = short_tyf()
+	} else if nlong != 0 {
+		ty = long_tyf()
+	} else {
+		ty = int_tyf()
+	}
+
+	if nunsigned != 0 {
+		return unsigned_of(ty)
+	}
+	return ty
 }
 
 func decl_specifiers() *Type {
@@ -128,19 +280,30 @@ func decl_specifiers() *Type {
 		return ty
 	}
 
-	if t.ty == TK_INT {
-		return int_tyf()
-	}
-
-	if t.ty == TK_CHAR {
-		return char_tyf()
+	if t.ty == TK_INT || t.ty == TK_CHAR || t.ty == TK_SHORT || t.ty == TK_LONG ||
+		t.ty == TK_SIGNED || t.ty == TK_UNSIGNED {
+		pos--
+		return int_specifiers()
 	}
 
 	if t.ty == TK_VOID {
 		return void_tyf()
 	}
 
-	if t.ty == TK_STRUCT {
+	if t.ty == TK_FLOAT {
+		return float_tyf()
+	}
+
+	if t.ty == TK_DOUBLE {
+		return double_tyf()
+	}
+
+	if t.ty == TK_ENUM {
+		return enum_specifier()
+	}
+
+	if t.ty == TK_STRUCT || t.ty == TK_UNION {
+		is_union := t.ty == TK_UNION
 		var tag string
 		t := tokens.data[pos].(*Token)
 		if t.ty == TK_IDENT {
@@ -152,12 +315,15 @@ func decl_specifiers() *Type {
 		if consume('{') {
 			members = new_vec()
 			for !consume('}') {
-				vec_push(members, declaration())
+				node := declaration()
+				if node.op != ND_NULL {
+					vec_push(members, node)
+				}
 			}
 		}
 
 		if tag == "" && members == nil {
-			bad_token(t, "bad struct definition")
+			bad_syntax(t, "bad struct or union definition")
 		}
 
 		var ty *Type
@@ -168,6 +334,7 @@ func decl_specifiers() *Type {
 		if ty == nil {
 			ty = new(Type)
 			ty.ty = STRUCT
+			ty.is_union = is_union
 		}
 
 		if members != nil {
@@ -179,7 +346,7 @@ func decl_specifiers() *Type {
 		return ty
 	}
 
-	bad_token(t, "typename expected")
+	bad_syntax(t, "typename expected")
 	return nil
 }
 
@@ -188,6 +355,7 @@ func new_binop(op int, lhs, rhs *Node) *Node {
 	node.op = op
 	node.lhs = lhs
 	node.rhs = rhs
+	node.tok = lhs.tok
 	return node
 }
 
@@ -195,6 +363,9 @@ func new_expr(op int, expr *Node) *Node {
 	node := new(Node)
 	node.op = op
 	node.expr = expr
+	if expr != nil {
+		node.tok = expr.tok
+	}
 	return node
 }
 
@@ -206,11 +377,75 @@ func new_num(val int) *Node {
 	return node
 }
 
+// sizeof and _Alignof yield an unsigned long.
+func new_size(val int) *Node {
+	node := new_num(val)
+	node.ty = unsigned_of(long_tyf())
+	return node
+}
+
+// Returns the type of an integer literal, which is the first type
+// that can represent the value among int, long and their unsigned
+// variants allowed by its suffix and radix.
+func num_type(t *Token) *Type {
+	s := tokstr(t)
+	is_decimal := len(s) == 1 || s[0] != '0'
+	val := uint64(t.val)
+
+	if !t.is_long {
+		if t.is_unsigned && val <= 0xffffffff {
+			return unsigned_of(int_tyf())
+		}
+		if !t.is_unsigned && val <= 0x7fffffff {
+			return int_tyf()
+		}
+		if !t.is_unsigned && !is_decimal && val <= 0xffffffff {
+			return unsigned_of(int_tyf())
+		}
+	}
+
+	if t.is_unsigned || (!is_decimal && val > 0x7fffffffffffffff) {
+		return unsigned_of(long_tyf())
+	}
+	return long_tyf()
+}
+
+// type-name = decl-specifiers abstract-declarator
+//
+// An abstract declarator is a declarator without an identifier,
+// such as `*` in `(char *)p` or `(*)(int)` in `(int (*)(int))p`.
+func type_name() *Type {
+	t := tokens.data[pos].(*Token)
+	ty := decl_specifiers()
+	node := declarator(ty)
+	if node.name != "" {
+		bad_syntax(t, "unexpected identifier in type name")
+	}
+	return node.ty
+}
+
+// Returns true if the next tokens are `(` followed by a type name.
+func is_paren_typename() bool {
+	if tokens.data[pos].(*Token).ty != '(' {
+		return false
+	}
+	pos++
+	ret := is_typename()
+	pos--
+	return ret
+}
+
+func new_cast(ty *Type, expr *Node) *Node {
+	node := new_expr(ND_CAST, expr)
+	node.ty = ty
+	return node
+}
+
 func ident() string {
 	t := tokens.data[pos].(*Token)
 	pos++
 	if t.ty != TK_IDENT {
-		bad_token(t, "identifier expected")
+		bad_syntax(t, "identifier expected")
 	}
 	return t.name
 }
@@ -223,6 +458,7 @@ func primary() *Node {
 		if consume('{') {
 			node := new(Node)
 			node.op = ND_STMT_EXPR
+			node.tok = t
 			node.body = compound_stmt()
 			expect(')')
 			return node
@@ -233,8 +469,24 @@ func primary() *Node {
 	}
 
 	node := new(Node)
+	node.tok = t
 	if t.ty == TK_NUM {
-		return new_num(t.val)
+		node := new_num(t.val)
+		node.tok = t
+		if t.start != "" && t.start[0] != '\'' {
+			node.ty = num_type(t)
+		}
+		return node
+	}
+
+	if t.ty == TK_FNUM {
+		node.op = ND_NUM
+		node.ty = double_tyf()
+		if t.is_float {
+			node.ty = float_tyf()
+		}
+		node.fval = t.fval
+		return node
 	}
 
 	if t.ty == TK_STR {
@@ -249,25 +501,105 @@ func primary() *Node {
 		node.name = t.name
 
 		if !consume('(') {
+			if e := find_enum(t.name); e != nil {
+				e.tok = t
+				return e
+			}
 			node.op = ND_IDENT
 			return node
 		}
 
-		node.op = ND_CALL
-		node.args = new_vec()
-		if consume(')') {
-			return node
+		if builtin := va_builtin(t.name); builtin != nil {
+			return builtin
 		}
 
-		vec_push(node.args, assign())
-		for consume(',') {
-			vec_push(node.args, assign())
-		}
-		expect(')')
+		node.op = ND_CALL
+		read_call_args(node)
 		return node
 	}
 
-	bad_token(t, "primary expression expected")
+	bad_syntax(t, "primary expression expected")
+	return nil
+}
+
+// Reads function call arguments after '('.
+func read_call_args(node *Node) {
+	node.args = new_vec()
+	if consume(')') {
+		return
+	}
+
+	vec_push(node.args, assign())
+	for consume(',') {
+		vec_push(node.args, assign())
+	}
+	expect(')')
+}
+
+// The type of va_list in the System V ABI.
+//
+//	typedef struct {
+//	  unsigned gp_offset;
+//	  unsigned fp_offset;
+//	  void *overflow_arg_area;
+//	  void *reg_save_area;
+//	} va_list[1];
+func va_list_tyf() *Type {
+	members := new_vec()
+	add := func(name string, ty *Type) {
+		node := new(Node)
+		node.op = ND_VARDEF
+		node.name = name
+		node.ty = ty
+		vec_push(members, node)
+	}
+	add("gp_offset", unsigned_of(int_tyf()))
+	add("fp_offset", unsigned_of(int_tyf()))
+	add("overflow_arg_area", ptr_to(void_tyf()))
+	add("reg_save_area", ptr_to(void_tyf()))
+
+	ty := new(Type)
+	ty.ty = STRUCT
+	add_members(ty, members)
+	return ary_of(ty, 1)
+}
+
+// Reads the arguments of a builtin for variable arguments, whose
+// opening parenthesis has been consumed. Returns nil if a given name
+// is not such a builtin. va_end needs no code.
+func va_builtin(name string) *Node {
+	switch name {
+	case "__builtin_va_start":
+		{
+			node := new_expr(ND_VA_START, assign())
+			expect(',')
+			assign()
+			expect(')')
+			return node
+		}
+	case "__builtin_va_arg":
+		{
+			node := new_expr(ND_VA_ARG, assign())
+			expect(',')
+			node.ty = type_name()
+			expect(')')
+			return node
+		}
+	case "__builtin_va_copy":
+		{
+			node := new_binop(ND_VA_COPY, assign(), nil)
+			expect(',')
+			node.rhs = assign()
+			expect(')')
+			return node
+		}
+	case "__builtin_va_end":
+		{
+			node := new_cast(void_tyf(), assign())
+			expect(')')
+			return node
+		}
+	}
 	return nil
 }
 
@@ -302,9 +634,15 @@ func postfix() *Node {
 			expect(']')
 			continue
 		}
+
+		// A call through a function pointer
+		if consume('(') {
+			lhs = new_expr(ND_CALL, lhs)
+			read_call_args(lhs)
+			continue
+		}
 		return lhs
 	}
-	return nil
 }
 
 func unary() *Node {
@@ -324,11 +662,29 @@ func unary() *Node {
 		return new_expr('~', unary())
 	}
 	if consume(TK_SIZEOF) {
+		if is_paren_typename() {
+			expect('(')
+			ty := type_name()
+			expect(')')
+			return new_size(ty.size)
+		}
 		return new_expr(ND_SIZEOF, unary())
 	}
 	if consume(TK_ALIGNOF) {
+		if is_paren_typename() {
+			expect('(')
+			ty := type_name()
+			expect(')')
+			return new_size(ty.align)
+		}
 		return new_expr(ND_ALIGNOF, unary())
 	}
+	if is_paren_typename() {
+		expect('(')
+		ty := type_name()
+		expect(')')
+		return new_cast(ty, unary())
+	}
 
 	if consume(TK_INC) {
 		return new_binop(ND_ADD_EQ, unary(), new_num(1))
@@ -353,7 +709,6 @@ func mul() *Node {
 			return lhs
 		}
 	}
-	return lhs
 }
 
 func read_array(ty *Type) *Type {
@@ -366,11 +721,11 @@ func read_array(ty *Type) *Type {
 		}
 
 		t := tokens.data[pos].(*Token)
-		l := expr()
-		if l.op != ND_NUM {
-			bad_token(t, "number expected")
+		l := const_expr()
+		if l < 0 {
+			bad_syntax(t, "size of array is negative")
 		}
-		vec_push(v, l.val)
+		vec_push(v, l)
 		expect(']')
 	}
 	for i := v.len - 1; i >= 0; i-- {
@@ -391,7 +746,6 @@ func parse_add() *Node {
 			return lhs
 		}
 	}
-	return lhs
 }
 
 func shift() *Node {
@@ -405,7 +759,6 @@ func shift() *Node {
 			return lhs
 		}
 	}
-	return lhs
 }
 
 func relational() *Node {
@@ -487,6 +840,7 @@ func conditional() *Node {
 	node := new(Node)
 	node.op = '?'
 	node.cond = cond
+	node.tok = cond.tok
 	node.then = expr()
 	expect(':')
 	node.els = conditional()
@@ -547,6 +901,112 @@ func expr() *Node {
 	return new_binop(',', lhs, expr())
 }
 
+// A designator specifies a member (`.x`) or an element (`[3]`) to be
+// initialized. Designators can be chained, as in `.a[2].b = 1`.
+func designator() *Node {
+	node := new(Node)
+	node.op = ND_DESIG
+	node.tok = tokens.data[pos].(*Token)
+	if consume('.') {
+		node.name = ident()
+	} else {
+		expect('[')
+		node.expr = conditional()
+		expect(']')
+	}
+
+	if consume('=') {
+		node.init = initializer()
+	} else {
+		node.init = designator()
+	}
+	return node
+}
+
+// An initializer is either an expression or a brace-enclosed list of
+// initializers. The list is matched against the type of a variable
+// later in sema.
+func initializer() *Node {
+	t := tokens.data[pos].(*Token)
+	if !consume('{') {
+		return assign()
+	}
+
+	node := new(Node)
+	node.op = ND_INIT_LIST
+	node.tok = t
+	node.stmts = new_vec()
+	for !consume('}') {
+		t := tokens.data[pos].(*Token)
+		if t.ty == '.' || t.ty == '[' {
+			vec_push(node.stmts, designator())
+		} else {
+			vec_push(node.stmts, initializer())
+		}
+		if consume('}') {
+			break
+		}
+		expect(',')
+	}
+	return node
+}
+
+// Returns true if the next tokens are `(` followed by a declarator
+// rather than a parameter list.
+func is_nested_declarator() bool {
+	if tokens.data[pos].(*Token).ty != '(' {
+		return false
+	}
+	pos++
+	ret := !is_typename() && tokens.data[pos].(*Token).ty != ')'
+	pos--
+	return ret
+}
+
+// Reads a parameter list after '(' and returns a function type.
+// Parameter declarations are pushed to params.
+func read_func_params(returning *Type, params *Vector) *Type {
+	ty := new(Type)
+	ty.ty = FUNC
+	ty.returning = returning
+	if consume(')') {
+		return ty
+	}
+
+	vec_push(params, param_declaration())
+	for consume(',') {
+		if consume(TK_ELLIPSIS) {
+			ty.is_variadic = true
+			break
+		}
+		vec_push(params, param_declaration())
+	}
+	expect(')')
+
+	// f(void) takes no parameters.
+	if params.len == 1 {
+		node := params.data[0].(*Node)
+		if node.ty.ty == VOID && node.name == "" {
+			params.len = 0
+		}
+	}
+
+	ty.params = new_vec()
+	for i := 0; i < params.len; i++ {
+		vec_push(ty.params, params.data[i].(*Node).ty)
+	}
+	return ty
+}
+
+// Reads the second half of a declarator, i.e. array dimensions such as
+// `[3][5]` or a parameter list.
+func read_type_suffix(ty *Type) *Type {
+	if consume('(') {
+		return read_func_params(ty, new_vec())
+	}
+	return read_array(ty)
+}
+
 func direct_decl(ty *Type) *Node {
 	t := tokens.data[pos].(*Token)
 	var node *Node
@@ -556,20 +1016,25 @@ func direct_decl(ty *Type) *Node {
 		node = new(Node)
 		node.op = ND_VARDEF
 		node.ty = placeholder
+		node.tok = t
 		node.name = ident()
-	} else if consume('(') {
+	} else if is_nested_declarator() {
+		pos++
 		node = declarator(placeholder)
 		expect(')')
 	} else {
-		bad_token(t, "bad direct-declarator")
+		// An abstract declarator doesn't have a name.
+		node = new(Node)
+		node.op = ND_VARDEF
+		node.ty = placeholder
+		node.tok = t
 	}
 
-	// Read the second half of type name (e.g. `[3][5]`).
-	*placeholder = *read_array(ty)
+	*placeholder = *read_type_suffix(ty)
 
 	// Read an initializer.
 	if consume('=') {
-		node.init = assign()
+		node.init = initializer()
 	}
 	return node
 }
@@ -582,17 +1047,38 @@ func declarator(ty *Type) *Node {
 }
 
 func declaration() *Node {
+	t := tokens.data[pos].(*Token)
 	ty := decl_specifiers()
+	if ty == nil {
+		bad_syntax(t, "typename expected")
+	}
+
+	// A declaration without declarators such as "enum { A, B };"
+	// only declares tags or enumerators.
+	if consume(';') {
+		return &null_stmt
+	}
+
+	t = tokens.data[pos].(*Token)
 	node := declarator(ty)
+	if node.name == "" {
+		bad_syntax(t, "identifier expected")
+	}
 	expect(';')
 	return node
 }
 
 func param_declaration() *Node {
+	t := tokens.data[pos].(*Token)
 	ty := decl_specifiers()
+	if ty == nil {
+		bad_syntax(t, "typename expected")
+	}
 	node := declarator(ty)
 	if node.ty.ty == ARY {
 		node.ty = ptr_to(node.ty.ary_of)
+	} else if node.ty.ty == FUNC {
+		node.ty = ptr_to(node.ty)
 	}
 	return node
 }
@@ -606,6 +1092,7 @@ func expr_stmt() *Node {
 func stmt() *Node {
 	node := new(Node)
 	t := tokens.data[pos].(*Token)
+	node.tok = t
 	pos++
 
 	switch t.ty {
@@ -614,6 +1101,14 @@ func stmt() *Node {
 		// assert(node.name)
 		map_put(penv.typedefs, node.name, node.ty)
 		return &null_stmt
+	case TK_STATIC, TK_EXTERN:
+		node := declaration()
+		if node.op == ND_VARDEF {
+			node.is_static = t.ty == TK_STATIC
+			node.is_extern = t.ty == TK_EXTERN
+			declare_var(node.name)
+		}
+		return node
 	case TK_IF:
 		node.op = ND_IF
 		expect('(')
@@ -630,8 +1125,11 @@ func stmt() *Node {
 		node.op = ND_FOR
 		expect('(')
 
+		// A variable declared in the for statement is local to it.
+		penv = new_penv(penv)
 		if is_typename() {
 			node.init = declaration()
+			declare_var(node.init.name)
 		} else if consume(';') {
 			node.init = &null_stmt
 		} else {
@@ -649,6 +1147,7 @@ func stmt() *Node {
 		}
 
 		node.body = stmt()
+		penv = penv.next
 		return node
 	case TK_WHILE:
 		node.op = ND_FOR
@@ -668,8 +1167,48 @@ func stmt() *Node {
 		expect(')')
 		expect(';')
 		return node
+	case TK_SWITCH:
+		node.op = ND_SWITCH
+		node.cases = new_vec()
+		expect('(')
+		node.cond = expr()
+		expect(')')
+
+		vec_push(switches, node)
+		node.body = stmt()
+		vec_pop(switches)
+		return node
+	case TK_CASE, TK_DEFAULT:
+		if switches.len == 0 {
+			bad_syntax(t, "stray case")
+		}
+		if t.ty == TK_CASE {
+			node.op = ND_CASE
+			node.expr = conditional()
+		} else {
+			node.op = ND_DEFAULT
+		}
+		expect(':')
+
+		// Cases are recorded in source order, so a duplicate is
+		// reported at the later label.
+		sw := vec_last(switches).(*Node)
+		vec_push(sw.cases, node)
+		node.body = stmt()
+		return node
 	case TK_BREAK:
-		return &break_stmt
+		node.op = ND_BREAK
+		expect(';')
+		return node
+	case TK_CONTINUE:
+		node.op = ND_CONTINUE
+		expect(';')
+		return node
+	case TK_GOTO:
+		node.op = ND_GOTO
+		node.name = ident()
+		expect(';')
+		return node
 	case TK_RETURN:
 		node.op = ND_RETURN
 		node.expr = expr()
@@ -678,20 +1217,28 @@ func stmt() *Node {
 	case '{':
 		node.op = ND_COMP_STMT
 		node.stmts = new_vec()
-		for !consume('}') {
-			vec_push(node.stmts, stmt())
-		}
+		penv = new_penv(penv)
+		read_stmts(node.stmts)
+		penv = penv.next
 		return node
 	case ';':
 		return &null_stmt
 	default:
 		pos--
+		if t.ty == TK_IDENT && tokens.data[pos+1].(*Token).ty == ':' {
+			node.op = ND_LABEL
+			node.name = ident()
+			expect(':')
+			node.body = stmt()
+			return node
+		}
 		if is_typename() {
-			return declaration()
+			node := declaration()
+			declare_var(node.name)
+			return node
 		}
 		return expr_stmt()
 	}
-	return nil
 }
 
 func compound_stmt() *Node {
@@ -701,41 +1248,174 @@ func compound_stmt() *Node {
 	node.stmts = new_vec()
 
 	penv = new_penv(penv)
-	for !consume('}') {
-		vec_push(node.stmts, stmt())
-	}
+	read_stmts(node.stmts)
 	penv = penv.next
 	return node
 }
 
+// Reads statements up to the closing '}'. A statement with a syntax
+// error is skipped.
+func read_stmts(v *Vector) {
+	for !consume('}') {
+		t := tokens.data[pos].(*Token)
+		if t.ty == TK_EOF {
+			bad_syntax(t, "'}' expected")
+		}
+		vec_push(v, stmt_recover())
+	}
+}
+
+// Returns true if '{' at a given position begins an initializer list
+// or a struct body rather than a block.
+func is_brace_list(i int) bool {
+	if i == 0 {
+		return false
+	}
+	switch tokens.data[i-1].(*Token).ty {
+	case '=', ',', TK_IDENT, TK_STRUCT, TK_UNION, TK_ENUM:
+		return true
+	}
+	return false
+}
+
+// Skips tokens from start to the end of a statement or a declaration
+// that has a syntax error. It stops after a `;` or a block at the
+// same nesting level, or before a `}` closing the enclosing block.
+func resync(start int, toplevel bool) {
+	pos = start
+	depth := 0
+	paren := 0
+	is_block := false
+
+	for {
+		t := tokens.data[pos].(*Token)
+		switch t.ty {
+		case TK_EOF:
+			return
+		case '(':
+			paren++
+		case ')':
+			if paren > 0 {
+				paren--
+			}
+		case ';':
+			if depth == 0 && paren == 0 {
+				pos++
+				return
+			}
+		case '{':
+			if depth == 0 {
+				is_block = !is_brace_list(pos)
+			}
+			depth++
+		case '}':
+			if depth == 0 {
+				if toplevel {
+					pos++
+				}
+				return
+			}
+			depth--
+			if depth == 0 && is_block && tokens.data[pos+1].(*Token).ty != TK_ELSE {
+				pos++
+				return
+			}
+		}
+		pos++
+	}
+}
+
+// Reads a statement. If it has a syntax error, the statement is
+// skipped and replaced with a null statement.
+func stmt_recover() (node *Node) {
+	start := pos
+	env := penv
+	nswitches := switches.len
+
+	defer func() {
+		e := recover()
+		if e == nil {
+			return
+		}
+		if _, ok := e.(Parse_error); !ok {
+			panic(e)
+		}
+		penv = env
+		switches.len = nswitches
+		resync(start, false)
+		node = &null_stmt
+	}()
+	return stmt()
+}
+
+// Reads a top-level declaration. If it has a syntax error, the
+// declaration is skipped.
+func toplevel_recover() (node *Node) {
+	start := pos
+	env := penv
+	nswitches := switches.len
+
+	defer func() {
+		e := recover()
+		if e == nil {
+			return
+		}
+		if _, ok := e.(Parse_error); !ok {
+			panic(e)
+		}
+		penv = env
+		switches.len = nswitches
+		resync(start, true)
+		node = nil
+	}()
+	return toplevel()
+}
+
 func toplevel() *Node {
 	is_typedef := consume(TK_TYPEDEF)
 	is_extern := consume(TK_EXTERN)
+	is_static := consume(TK_STATIC)
 
 	ty := decl_specifiers()
+	if consume(';') {
+		return nil
+	}
 	for consume('*') {
 		ty = ptr_to(ty)
 	}
 
+	// A declarator in parentheses such as `int (*fp)(int)` declares
+	// a variable or a type.
+	if is_nested_declarator() {
+		node := direct_decl(ty)
+		expect(';')
+		if is_typedef {
+			map_put(penv.typedefs, node.name, node.ty)
+			return nil
+		}
+		node.is_extern = is_extern
+		node.is_static = is_static
+		declare_var(node.name)
+		return node
+	}
+
+	t := tokens.data[pos].(*Token)
 	name := ident()
 
 	// Function
 	if consume('(') {
+		// A function without a return type returns int.
+		if ty == nil {
+			ty = int_tyf()
+		}
+
 		node := new(Node)
 		node.name = name
+		node.tok = t
 		node.args = new_vec()
-
-		node.ty = new(Type)
-		node.ty.ty = FUNC
-		node.ty.returning = ty
-
-		if !consume(')') {
-			vec_push(node.args, param_declaration())
-			for consume(',') {
-				vec_push(node.args, param_declaration())
-			}
-			expect(')')
-		}
+		node.ty = read_func_params(ty, node.args)
+		node.is_static = is_static
+		declare_var(name)
 
 		if consume(';') {
 			node.op = ND_DECL
@@ -743,16 +1423,34 @@ func toplevel() *Node {
 		}
 
 		node.op = ND_FUNC
-		t := tokens.data[pos].(*Token)
+		t = tokens.data[pos].(*Token)
 		expect('{')
 		if is_typedef {
-			bad_token(t, "typedef has function definition")
+			bad_syntax(t, "typedef has function definition")
+		}
+
+		// Parameters are in the scope of the function body.
+		penv = new_penv(penv)
+		for i := 0; i < node.args.len; i++ {
+			declare_var(node.args.data[i].(*Node).name)
 		}
 		node.body = compound_stmt()
+		penv = penv.next
 		return node
 	}
 
+	// A variable without a type such as `x;` is an error, but it
+	// is kept with the error type so that it can be skipped later.
+	if ty == nil {
+		error_at(t, "type name expected")
+		ty = err_tyf()
+	}
 	ty = read_array(ty)
+
+	var init *Node
+	if consume('=') {
+		init = initializer()
+	}
 	expect(';')
 
 	if is_typedef {
@@ -761,23 +1459,24 @@ func toplevel() *Node {
 	}
 
 	// Global variable
+	declare_var(name)
 	node := new(Node)
 	node.op = ND_VARDEF
 	node.ty = ty
 	node.name = name
+	node.tok = t
 	node.is_extern = is_extern
-
-	if !is_extern {
-		node.data = ""
-		node.len = node.ty.size
-	}
+	node.is_static = is_static
+	node.init = init
 	return node
 }
 
 func parse(tokens_ *Vector) *Vector {
 	tokens = tokens_
 	pos = 0
+	switches = new_vec()
 	penv = new_penv(penv)
+	map_put(penv.typedefs, "__builtin_va_list", va_list_tyf())
 
 	v := new_vec()
 	for {
@@ -785,7 +1484,7 @@ func parse(tokens_ *Vector) *Vector {
 		if t.ty == TK_EOF {
 			return v
 		}
-		node := toplevel()
+		node := toplevel_recover()
 		if node != nil {
 			vec_push(v, node)
 		}
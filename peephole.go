@@ -0,0 +1,394 @@
+package main
+
+// Peephole optimizer
+//
+// With -O1, the instructions of each function are rewritten before
+// they are written to the output. The code generator translates each
+// IR instruction separately, which leaves redundant sequences at the
+// boundaries of instructions:
+//
+//  - mul needs its operand in rax, so `a *= b` becomes
+//    `mov rax, b; mul a; mov a, rax`. This is fused to `imul a, b`.
+//
+//  - A branch on a comparison sets a register to 0 or 1 and then
+//    compares it with 0. The branch is changed to test the flags of
+//    the first comparison, and the register is not set if it is not
+//    used later.
+//
+//  - r10 and r11 are saved around a call because they are caller-
+//    saved. They are not saved if they are not used after the call.
+//
+//  - A jump to the immediately following label and a move from a
+//    register to itself are removed.
+//
+// Whether a register is used later is found by liveness analysis of
+// general-purpose registers on the instructions.
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Names of general-purpose registers. A register is numbered by its
+// row, and the columns are its 64-, 32-, 16- and 8-bit names.
+var reg_names = [][]string{
+	{"rax", "eax", "ax", "al"},
+	{"rbx", "ebx", "bx", "bl"},
+	{"rcx", "ecx", "cx", "cl"},
+	{"rdx", "edx", "dx", "dl"},
+	{"rsi", "esi", "si", "sil"},
+	{"rdi", "edi", "di", "dil"},
+	{"rbp", "ebp", "bp", "bpl"},
+	{"rsp", "esp", "sp", "spl"},
+	{"r8", "r8d", "r8w", "r8b"},
+	{"r9", "r9d", "r9w", "r9b"},
+	{"r10", "r10d", "r10w", "r10b"},
+	{"r11", "r11d", "r11w", "r11b"},
+	{"r12", "r12d", "r12w", "r12b"},
+	{"r13", "r13d", "r13w", "r13b"},
+	{"r14", "r14d", "r14w", "r14b"},
+	{"r15", "r15d", "r15w", "r15b"},
+}
+
+// Returns the number of a register and the size of a given name of
+// it, or -1 if the name is not a general-purpose register.
+func reg_no(name string) (int, int) {
+	for i, names := range reg_names {
+		for j, s := range names {
+			if s == name {
+				return i, 8 >> uint(j)
+			}
+		}
+	}
+	return -1, 0
+}
+
+// Returns a set of registers as a bit mask.
+func reg_set(names ...string) uint32 {
+	set := uint32(0)
+	for _, name := range names {
+		if r, _ := reg_no(name); r >= 0 {
+			set |= 1 << uint(r)
+		}
+	}
+	return set
+}
+
+var (
+	call_uses    = reg_set("rdi", "rsi", "rdx", "rcx", "r8", "r9", "rax", "rsp")
+	call_clobber = reg_set("rax", "rcx", "rdx", "rsi", "rdi", "r8", "r9", "r10", "r11")
+	ret_uses     = reg_set("rax", "rdx", "rbx", "rbp", "rsp", "r12", "r13", "r14", "r15")
+	all_regs     = ^uint32(0)
+)
+
+// Instructions that write their first operand without reading it.
+// Writing the 32-bit name of a register clears its upper half, so it
+// is a write of the whole register.
+var write_only = map[string]bool{
+	"mov": true, "movzx": true, "movsx": true, "movsxd": true,
+	"movzb": true, "lea": true, "pop": true,
+	"cvttsd2si": true, "cvttss2si": true,
+}
+
+// Returns the registers that an instruction reads and writes. A
+// partial write is regarded as a read because the rest of the
+// register is kept.
+func insn_regs(insn *Insn) (use, def uint32) {
+	for i, arg := range insn.args {
+		if strings.HasSuffix(arg, "]") {
+			// Registers in an address are read.
+			fields := strings.FieldsFunc(arg, func(c rune) bool {
+				return !('a' <= c && c <= 'z' || '0' <= c && c <= '9')
+			})
+			use |= reg_set(fields...)
+			continue
+		}
+
+		r, size := reg_no(arg)
+		if r < 0 {
+			continue
+		}
+		if i == 0 && write_only[insn.op] && size >= 4 {
+			def |= 1 << uint(r)
+		} else {
+			use |= 1 << uint(r)
+		}
+	}
+
+	switch insn.op {
+	case "mul":
+		use |= reg_set("rax")
+		def |= reg_set("rax", "rdx")
+	case "div", "idiv":
+		use |= reg_set("rax", "rdx")
+		def |= reg_set("rax", "rdx")
+	case "cqo":
+		use |= reg_set("rax")
+		def |= reg_set("rdx")
+	case "call":
+		use |= call_uses
+		def |= call_clobber
+	case "ret":
+		use |= ret_uses
+	}
+	return
+}
+
+func is_jump(insn *Insn) bool {
+	return insn.op != "" && insn.op[0] == 'j'
+}
+
+// Returns true if a jump goes to a label that is not known from the
+// instruction, as with a jump table.
+func is_indirect_jump(insn *Insn) bool {
+	return is_jump(insn) && !strings.HasPrefix(insn.args[0], ".L")
+}
+
+// Returns the registers that are live after each instruction.
+func insn_liveness(insns []*Insn) []uint32 {
+	labels := make(map[string]int)
+	for i, insn := range insns {
+		if insn.label != "" {
+			labels[insn.label] = i
+		}
+	}
+
+	n := len(insns)
+	use := make([]uint32, n)
+	def := make([]uint32, n)
+	succ := make([][]int, n)
+	fixed := make([]uint32, n)
+	for i, insn := range insns {
+		use[i], def[i] = insn_regs(insn)
+
+		if is_jump(insn) {
+			target, ok := labels[insn.args[0]]
+			if !ok || is_indirect_jump(insn) {
+				fixed[i] = all_regs
+			} else {
+				succ[i] = append(succ[i], target)
+			}
+			if insn.op == "jmp" {
+				continue
+			}
+		}
+		if insn.op != "ret" && i+1 < n {
+			succ[i] = append(succ[i], i+1)
+		}
+	}
+
+	out := make([]uint32, n)
+	in := make([]uint32, n)
+	for changed := true; changed; {
+		changed = false
+		for i := n - 1; i >= 0; i-- {
+			live := fixed[i]
+			for _, s := range succ[i] {
+				live |= in[s]
+			}
+			out[i] = live
+			live = use[i] | live&^def[i]
+			if live != in[i] {
+				in[i] = live
+				changed = true
+			}
+		}
+	}
+	return out
+}
+
+func is_insn(insn *Insn, op string, args ...string) bool {
+	if insn.op != op || len(insn.args) != len(args) {
+		return false
+	}
+	for i, arg := range args {
+		if arg != "*" && insn.args[i] != arg {
+			return false
+		}
+	}
+	return true
+}
+
+func is_reg64(name string) bool {
+	_, size := reg_no(name)
+	return size == 8
+}
+
+// Fuses `mov rax, b; mul a; mov a, rax` into `imul a, b`. The upper
+// half of the product in rdx is never used.
+func fuse_mul(insns []*Insn) []*Insn {
+	var v []*Insn
+	for i := 0; i < len(insns); i++ {
+		if i+2 >= len(insns) || !is_insn(insns[i], "mov", "rax", "*") || !is_insn(insns[i+1], "mul", "*") {
+			v = append(v, insns[i])
+			continue
+		}
+		a, b := insns[i+1].args[0], insns[i].args[1]
+		if !is_insn(insns[i+2], "mov", a, "rax") || !is_reg64(a) {
+			v = append(v, insns[i])
+			continue
+		}
+
+		if is_reg64(b) {
+			v = append(v, &Insn{op: "imul", args: []string{a, b}})
+		} else if imm, err := strconv.ParseInt(b, 10, 32); err == nil {
+			v = append(v, &Insn{op: "imul", args: []string{a, a, strconv.FormatInt(imm, 10)}})
+		} else {
+			v = append(v, insns[i])
+			continue
+		}
+		i += 2
+	}
+	return v
+}
+
+// The condition codes of setcc and jcc and their negations
+var negate_cc = map[string]string{
+	"e": "ne", "ne": "e",
+	"l": "ge", "ge": "l", "le": "g", "g": "le",
+	"b": "ae", "ae": "b", "be": "a", "a": "be",
+}
+
+// Returns the condition code of a setcc instruction, or "".
+func set_cc(insn *Insn) string {
+	cc := strings.TrimPrefix(insn.op, "set")
+	if cc == insn.op || negate_cc[cc] == "" {
+		return ""
+	}
+	return cc
+}
+
+// Rewrites `cmp x, y; setcc r8; movzb r, r8; cmp r, 0; je L` to
+// branch on the flags of the first comparison. setcc and movzb don't
+// change the flags. The register is still set here, and it is
+// removed by remove_dead if it is not used.
+func fuse_cmp(insns []*Insn) []*Insn {
+	var v []*Insn
+	for i := 0; i < len(insns); i++ {
+		v = append(v, insns[i])
+		if i+4 >= len(insns) || insns[i].op != "cmp" {
+			continue
+		}
+		cc := set_cc(insns[i+1])
+		if cc == "" {
+			continue
+		}
+		r8 := insns[i+1].args[0]
+		movzb := insns[i+2]
+		if !is_insn(movzb, "movzb", "*", r8) || !is_insn(insns[i+3], "cmp", movzb.args[0], "0") {
+			continue
+		}
+
+		jcc := insns[i+4]
+		switch {
+		case is_insn(jcc, "je", "*"):
+			cc = negate_cc[cc]
+		case is_insn(jcc, "jne", "*"):
+		default:
+			continue
+		}
+		v = append(v, insns[i+1], movzb, &Insn{op: "j" + cc, args: jcc.args})
+		i += 4
+	}
+	return v
+}
+
+// Returns true if a jump at a given index goes to a label that
+// immediately follows it.
+func jumps_to_next(insns []*Insn, i int) bool {
+	for j := i + 1; j < len(insns) && insns[j].label != ""; j++ {
+		if insns[j].label == insns[i].args[0] {
+			return true
+		}
+	}
+	return false
+}
+
+// Removes jumps to the next instructions and moves from registers to
+// themselves. A 32-bit move to itself is kept because it clears the
+// upper half of the register.
+func remove_nops(insns []*Insn) []*Insn {
+	var v []*Insn
+	for i, insn := range insns {
+		if is_jump(insn) && !is_indirect_jump(insn) && jumps_to_next(insns, i) {
+			continue
+		}
+		if (insn.op == "mov" && is_reg64(insn.args[0]) || insn.op == "movaps") &&
+			len(insn.args) == 2 && insn.args[0] == insn.args[1] {
+			continue
+		}
+		v = append(v, insn)
+	}
+	return v
+}
+
+// Returns the index of the first instruction at or after i that is
+// not one of the given instructions, skipping at most n of them.
+func skip_insns(insns []*Insn, i, n int, ok func(*Insn) bool) int {
+	for ; n > 0 && i < len(insns) && ok(insns[i]); n-- {
+		i++
+	}
+	return i
+}
+
+// Removes instructions whose results are not used: setcc and movzb
+// that set a register that is dead, and pushes and pops that save r10
+// and r11 around a call if both of them are dead after the call.
+func remove_dead(insns []*Insn) []*Insn {
+	live := insn_liveness(insns)
+	dead := make([]bool, len(insns))
+	r10_r11 := reg_set("r10", "r11")
+
+	for i, insn := range insns {
+		if set_cc(insn) != "" {
+			if i+1 < len(insns) && is_insn(insns[i+1], "movzb", "*", insn.args[0]) {
+				r, _ := reg_no(insns[i+1].args[0])
+				if r >= 0 && live[i+1]&(1<<uint(r)) == 0 {
+					dead[i] = true
+					dead[i+1] = true
+				}
+			}
+			continue
+		}
+
+		if insn.op != "call" {
+			continue
+		}
+
+		// The code generator emits the following sequence for a call:
+		// push r10; push r11; [sub rsp, pad]; [push stack args];
+		// mov rax, n; call f; [add rsp, n]; pop r11; pop r10
+		j := i - 1
+		for j >= 0 && (is_insn(insns[j], "push", "*") && insns[j].args[0] != "r11" ||
+			is_insn(insns[j], "sub", "rsp", "*") || is_insn(insns[j], "mov", "rax", "*")) {
+			j--
+		}
+		k := skip_insns(insns, i+1, 1, func(insn *Insn) bool { return is_insn(insn, "add", "rsp", "*") })
+		if j < 1 || k+1 >= len(insns) ||
+			!is_insn(insns[j-1], "push", "r10") || !is_insn(insns[j], "push", "r11") ||
+			!is_insn(insns[k], "pop", "r11") || !is_insn(insns[k+1], "pop", "r10") {
+			continue
+		}
+		if live[k+1]&r10_r11 == 0 {
+			dead[j-1] = true
+			dead[j] = true
+			dead[k] = true
+			dead[k+1] = true
+		}
+	}
+
+	var v []*Insn
+	for i, insn := range insns {
+		if !dead[i] {
+			v = append(v, insn)
+		}
+	}
+	return v
+}
+
+func peephole(insns []*Insn) []*Insn {
+	insns = fuse_mul(insns)
+	insns = fuse_cmp(insns)
+	insns = remove_nops(insns)
+	return remove_dead(insns)
+}
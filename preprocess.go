@@ -1,10 +1,43 @@
 package main
 
 // C preprocessor
+//
+// Macros are expanded by the algorithm described in Dave Prosser's
+// "C Preprocessing Algorithm". Each token has a hideset, a set of
+// macro names that have been expanded to produce the token. A macro
+// is not expanded if its name is in the hideset of the name token,
+// which prevents infinite recursion. The result of an expansion is
+// pushed back to the input so that it is rescanned with the rest of
+// the input.
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
 
 var (
 	macros *Map
 	ctx_p  *Context_p
+
+	// Include search paths given by -I and -isystem. System
+	// directories are searched after them.
+	include_paths         []string
+	system_include_paths  []string
+	default_include_paths = []string{
+		"/usr/local/include",
+		"/usr/include/x86_64-linux-gnu",
+		"/usr/include",
+	}
+
+	// Files that have #pragma once, and include guard macros of
+	// files. Keys are absolute paths.
+	once_files *Map
+	guards     *Map
 )
 
 const (
@@ -17,12 +50,41 @@ type Context_p struct {
 	output *Vector
 	pos    int
 	next   *Context_p
+
+	// Tokens produced by macro expansion that are read before the
+	// rest of the input. They are stored in reverse order.
+	pending []*Token
+
+	// Nested #if groups of the current file
+	conds *Vector
+
+	// The file being preprocessed and the index of the include
+	// directory where it was found, or -1 if it was not found in
+	// include directories. Both are empty when expanding macros
+	// in a token sequence.
+	path string
+	dir  int
+}
+
+// State of a conditional directive. tok is #if, #ifdef or #ifndef
+// for error reporting. included is true if one of its groups has been
+// included.
+type Cond struct {
+	tok      *Token
+	included bool
+	in_else  bool
 }
 
+// A variadic macro has __VA_ARGS__ as its last parameter.
 type Macro struct {
-	ty     int
-	tokens *Vector
-	params *Vector
+	ty          int
+	tokens      *Vector
+	params      *Vector
+	is_variadic bool
+
+	// Builtin macros such as __LINE__ are expanded by a handler
+	// that returns the source text of the expansion.
+	handler func(t *Token) string
 }
 
 func new_ctx_p(next *Context_p, input *Vector) *Context_p {
@@ -30,6 +92,7 @@ func new_ctx_p(next *Context_p, input *Vector) *Context_p {
 	c.input = input
 	c.output = new_vec()
 	c.next = next
+	c.conds = new_vec()
 	return c
 }
 
@@ -42,6 +105,87 @@ func new_macro(ty int, name string) *Macro {
 	return m
 }
 
+func find_macro(name string) *Macro {
+	if m := map_get(macros, name); m != nil {
+		return m.(*Macro)
+	}
+	return nil
+}
+
+// Quotes a given string as a C string literal.
+func quote(s string) string {
+	sb := new_sb()
+	sb_add(sb, "\"")
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' || s[i] == '"' {
+			sb_add(sb, "\\")
+		}
+		sb_add(sb, string(s[i]))
+	}
+	sb_add(sb, "\"")
+	return sb_get(sb)
+}
+
+// Defines an object-like macro whose body is a given string.
+func define_str(name, body string) {
+	m := new_macro(OBJLIKE, name)
+	m.tokens = tokenize_str(body, "<built-in>")
+}
+
+func define_builtin(name string, fn func(t *Token) string) {
+	m := new_macro(OBJLIKE, name)
+	m.handler = fn
+}
+
+// Defines predefined macros.
+func init_macros() {
+	macros = new_map()
+	once_files = new_map()
+	guards = new_map()
+
+	define_str("__STDC__", "1")
+	define_str("__STDC_VERSION__", "201112L")
+	define_str("__STDC_HOSTED__", "1")
+	define_str("__x86_64__", "1")
+	define_str("__x86_64", "1")
+	define_str("__linux__", "1")
+	define_str("__linux", "1")
+	define_str("__unix__", "1")
+	define_str("__LP64__", "1")
+	define_str("__9CCGO__", version)
+
+	now := time.Now()
+	define_str("__DATE__", quote(now.Format("Jan _2 2006")))
+	define_str("__TIME__", quote(now.Format("15:04:05")))
+
+	define_builtin("__FILE__", func(t *Token) string {
+		return quote(origin(t).path)
+	})
+	define_builtin("__LINE__", func(t *Token) string {
+		return strconv.Itoa(line(origin(t)))
+	})
+	counter := 0
+	define_builtin("__COUNTER__", func(t *Token) string {
+		counter++
+		return strconv.Itoa(counter - 1)
+	})
+}
+
+// Processes -D and -U options. "-D NAME=VAL" is the same as
+// "#define NAME VAL", and "-D NAME" is "#define NAME 1".
+func define_cmdline(s string) {
+	if i := strings.IndexByte(s, '='); i >= 0 {
+		s = s[:i] + " " + s[i+1:]
+	} else {
+		s += " 1"
+	}
+	preprocess(scan_str("#define "+s, "<command line>"), "", -1)
+}
+
+func undef_cmdline(name string) {
+	map_put(macros, name, nil)
+}
+
 func append_p(v *Vector) {
 	for i := 0; i < v.len; i++ {
 		vec_push(ctx_p.output, v.data[i])
@@ -51,13 +195,27 @@ func append_p(v *Vector) {
 func add_p(t *Token) { vec_push(ctx_p.output, t) }
 
 func next() *Token {
+	if n := len(ctx_p.pending); n > 0 {
+		t := ctx_p.pending[n-1]
+		ctx_p.pending = ctx_p.pending[:n-1]
+		return t
+	}
 	// assert(ctx_p,pos < ctx_p.input.len)
 	t := ctx_p.input.data[ctx_p.pos].(*Token)
 	ctx_p.pos++
 	return t
 }
 
-func eof() bool { return ctx_p.pos == ctx_p.input.len }
+// Pushes back tokens so that they are read next.
+func unread(v *Vector) {
+	for i := v.len - 1; i >= 0; i-- {
+		ctx_p.pending = append(ctx_p.pending, v.data[i].(*Token))
+	}
+}
+
+func eof() bool {
+	return len(ctx_p.pending) == 0 && ctx_p.pos == ctx_p.input.len
+}
 
 func get(ty int, msg string) *Token {
 	t := next()
@@ -68,20 +226,48 @@ func get(ty int, msg string) *Token {
 }
 
 func ident_p(msg string) string {
-	t := get(TK_IDENT, "parameter name expected")
+	t := get(TK_IDENT, msg)
 	return t.name
 }
 
-func peek() *Token { return ctx_p.input.data[ctx_p.pos].(*Token) }
+func peek() *Token {
+	if n := len(ctx_p.pending); n > 0 {
+		return ctx_p.pending[n-1]
+	}
+	return ctx_p.input.data[ctx_p.pos].(*Token)
+}
+
+// Returns true if the last token read from the input is at the
+// beginning of a line.
+func is_bol() bool {
+	return ctx_p.pos < 2 || ctx_p.input.data[ctx_p.pos-2].(*Token).ty == '\n'
+}
 
 func consume_p(ty int) bool {
 	if peek().ty != ty {
 		return false
 	}
-	ctx_p.pos++
+	next()
 	return true
 }
 
+// Consumes '(' of a function-like macro invocation if it comes next.
+// Newlines before '(' are skipped only in that case.
+func consume_lparen() bool {
+	if len(ctx_p.pending) > 0 {
+		return consume_p('(')
+	}
+	i := ctx_p.pos
+	for i < ctx_p.input.len && ctx_p.input.data[i].(*Token).ty == '\n' {
+		i++
+	}
+	if i < ctx_p.input.len && ctx_p.input.data[i].(*Token).ty == '(' {
+		ctx_p.pos = i + 1
+		return true
+	}
+	return false
+}
+
 func read_until_eol() *Vector {
 	v := new_vec()
 	for !eof() {
@@ -108,10 +294,55 @@ func new_param(val int) *Token {
 	return t
 }
 
+func copy_token(t *Token) *Token {
+	t2 := new(Token)
+	*t2 = *t
+	return t2
+}
+
 func is_ident(t *Token, s string) bool {
 	return t.ty == TK_IDENT && strcmp(t.name, s) == 0
 }
 
+// Hidesets
+
+func hideset_has(hs *Map, name string) bool {
+	return hs != nil && map_get(hs, name) != nil
+}
+
+func hideset_add(hs *Map, name string) *Map {
+	hs2 := hideset_union(hs, nil)
+	map_put(hs2, name, true)
+	return hs2
+}
+
+func hideset_union(a, b *Map) *Map {
+	hs := new_map()
+	for _, m := range []*Map{a, b} {
+		if m == nil {
+			continue
+		}
+		for i := 0; i < m.keys.len; i++ {
+			map_put(hs, m.keys.data[i].(string), true)
+		}
+	}
+	return hs
+}
+
+func hideset_intersection(a, b *Map) *Map {
+	hs := new_map()
+	if a == nil || b == nil {
+		return hs
+	}
+	for i := 0; i < a.keys.len; i++ {
+		name := a.keys.data[i].(string)
+		if hideset_has(b, name) {
+			map_put(hs, name, true)
+		}
+	}
+	return hs
+}
+
 func replace_params(m *Macro) {
 	params := m.params
 	tokens := m.tokens
@@ -132,17 +363,22 @@ func replace_params(m *Macro) {
 		if n == -1 {
 			continue
 		}
-		tokens.data[i] = new_param(n)
+		p := new_param(n)
+		p.start = t.start
+		p.end = t.end
+		p.buf = t.buf
+		p.path = t.path
+		tokens.data[i] = p
 	}
 
 	// Process '#' followed by a macro parameter.
 	v := new_vec()
 	for i := 0; i < tokens.len; i++ {
 		t1 := tokens.data[i].(*Token)
-		t2 := tokens.data[i+1]
 
-		if i != tokens.len-1 && t1.ty == '#' && t2.(*Token).ty == TK_PARAM {
-			t2.(*Token).stringize = true
+		if i != tokens.len-1 && t1.ty == '#' && tokens.data[i+1].(*Token).ty == TK_PARAM {
+			t2 := tokens.data[i+1].(*Token)
+			t2.stringize = true
 			vec_push(v, t2)
 			i++
 		} else {
@@ -152,15 +388,18 @@ func replace_params(m *Macro) {
 	m.tokens = v
 }
 
-func read_one_arg() *Vector {
+func read_one_arg(all bool) *Vector {
 	v := new_vec()
 	start := peek()
 	level := 0
 
 	for !eof() {
 		t := peek()
+		if t.ty == TK_EOF {
+			break
+		}
 		if level == 0 {
-			if t.ty == ')' || t.ty == ',' {
+			if t.ty == ')' || t.ty == ',' && !all {
 				return v
 			}
 		}
@@ -171,82 +410,267 @@ func read_one_arg() *Vector {
 		} else if t.ty == ')' {
 			level--
 		}
-		vec_push(v, t)
+		if t.ty != '\n' {
+			vec_push(v, t)
+		}
 	}
-	bad_token(start, "unclosed macro argument")
+	bad_token(start, "unterminated macro argument list")
 	return nil
 }
 
-func read_args() *Vector {
+// Reads arguments of a function-like macro invocation and returns them
+// with ')'. Arguments for __VA_ARGS__ are read as one argument.
+func read_args(m *Macro, start *Token) (*Vector, *Token) {
 	v := new_vec()
-	if consume_p(')') {
-		return v
+	nparams := m.params.len
+	if nparams > 0 || peek().ty != ')' {
+		for {
+			all := m.is_variadic && v.len == nparams-1
+			vec_push(v, read_one_arg(all))
+			if !consume_p(',') {
+				break
+			}
+		}
 	}
-	vec_push(v, read_one_arg())
-	for !consume_p(')') {
-		get(',', "comma expected")
-		vec_push(v, read_one_arg())
+	rparen := get(')', "')' expected")
+
+	if m.is_variadic && v.len == nparams-1 {
+		vec_push(v, new_vec())
 	}
-	return v
+	if v.len != nparams {
+		bad_token(start, "number of parameter does not match")
+	}
+	return v, rparen
 }
 
-func stringize(tokens *Vector) *Token {
+// Whitespace between argument tokens becomes a single space.
+func stringize(tokens *Vector, at *Token) *Token {
 	sb := new_sb()
 
 	for i := 0; i < tokens.len; i++ {
 		t := tokens.data[i].(*Token)
-		if i != 0 {
+		if i != 0 && t.has_space {
 			sb_add(sb, " ")
 		}
 		sb_append(sb, tokstr(t))
 	}
 
-	t := new(Token)
-	t.ty = TK_STR
-	t.str = sb_get(sb)
-	t.len = sb.len
+	t := tokenize_str(quote(sb_get(sb)), "<built-in>").data[0].(*Token)
+	t.hideset = at.hideset
+	t.origin = at.origin
+	t.has_space = at.has_space
 	return t
 }
 
-func apply(m *Macro, start *Token) {
-	if m.ty == OBJLIKE {
-		append_p(m.tokens)
-		return
+// Concatenates two tokens by ##. The result is re-lexed and must be a
+// single token.
+func paste(lhs, rhs *Token) *Token {
+	s := tokstr(lhs) + tokstr(rhs)
+	v := tokenize_str(s, lhs.path)
+	if v.len != 1 {
+		bad_token(lhs, format("pasting \"%s\" and \"%s\" does not give a valid token", tokstr(lhs), tokstr(rhs)))
 	}
+	t := v.data[0].(*Token)
+	t.hideset = lhs.hideset
+	t.origin = lhs.origin
+	t.has_space = lhs.has_space
+	return t
+}
 
-	// Function-like macro
-	get('(', "comma expected")
-	args := read_args()
-	if m.params.len != args.len {
-		bad_token(start, "number of parameter does not match")
+// A placemarker stands for an empty argument operand of ##.
+var placemarker = &Token{}
+
+func paste_to_last(v *Vector, rhs *Token) {
+	lhs := vec_last(v).(*Token)
+	if lhs == placemarker {
+		v.data[v.len-1] = rhs
+	} else if rhs != placemarker {
+		v.data[v.len-1] = paste(lhs, rhs)
 	}
+}
 
-	for i := 0; i < m.tokens.len; i++ {
-		t := m.tokens.data[i].(*Token)
+// Returns the index of ')' that matches '(' at the i'th token.
+func find_rparen(body *Vector, i int) int {
+	level := 0
+	for ; i < body.len; i++ {
+		t := body.data[i].(*Token)
+		if t.ty == '(' {
+			level++
+		} else if t.ty == ')' {
+			level--
+			if level == 0 {
+				return i
+			}
+		}
+	}
+	bad_token(body.data[body.len-1].(*Token), "unterminated __VA_OPT__")
+	return -1
+}
+
+// Substitutes parameters in a macro body with arguments. An argument
+// is macro-expanded unless it is an operand of # or ##.
+func subst(m *Macro, body, args *Vector) *Vector {
+	v := new_vec()
+	for i := 0; i < body.len; i++ {
+		t := body.data[i].(*Token)
+		pasted := i+1 < body.len && body.data[i+1].(*Token).ty == TK_HASHHASH
 
-		if is_ident(t, "__LINE__") {
-			add_p(new_int_p(line(t)))
+		if t.ty == TK_HASHHASH {
+			if v.len == 0 || i+1 == body.len {
+				bad_token(t, "'##' cannot appear at either end of macro expansion")
+			}
+			i++
+			rhs := body.data[i].(*Token)
+			if rhs.ty != TK_PARAM {
+				paste_to_last(v, rhs)
+				continue
+			}
+			arg := args.data[rhs.val].(*Vector)
+			if rhs.stringize {
+				paste_to_last(v, stringize(arg, rhs))
+				continue
+			}
+			if arg.len == 0 {
+				paste_to_last(v, placemarker)
+				continue
+			}
+			paste_to_last(v, arg.data[0].(*Token))
+			for j := 1; j < arg.len; j++ {
+				vec_push(v, arg.data[j])
+			}
 			continue
 		}
 
 		if t.ty == TK_PARAM {
+			arg := args.data[t.val].(*Vector)
 			if t.stringize {
-				add_p(stringize(args.data[t.val].(*Vector)))
+				vec_push(v, stringize(arg, t))
+			} else if pasted {
+				if arg.len == 0 {
+					vec_push(v, placemarker)
+				}
+				append_vec(v, arg)
 			} else {
-				append_p(args.data[t.val].(*Vector))
+				append_vec(v, expand(arg))
 			}
 			continue
 		}
-		add_p(t)
+
+		// __VA_OPT__(x) is replaced with x if __VA_ARGS__ is not
+		// empty.
+		if m.is_variadic && is_ident(t, "__VA_OPT__") {
+			if i+1 == body.len || body.data[i+1].(*Token).ty != '(' {
+				bad_token(t, "'(' expected")
+			}
+			j := find_rparen(body, i+1)
+			if args.data[args.len-1].(*Vector).len > 0 {
+				inner := new_vec()
+				for k := i + 2; k < j; k++ {
+					vec_push(inner, body.data[k])
+				}
+				append_vec(v, subst(m, inner, args))
+			} else if pasted || j+1 < body.len && body.data[j+1].(*Token).ty == TK_HASHHASH {
+				vec_push(v, placemarker)
+			}
+			i = j
+			continue
+		}
+
+		vec_push(v, t)
+	}
+
+	v2 := new_vec()
+	for i := 0; i < v.len; i++ {
+		if v.data[i] != placemarker {
+			vec_push(v2, v.data[i])
+		}
+	}
+	return v2
+}
+
+func append_vec(v, v2 *Vector) {
+	for i := 0; i < v2.len; i++ {
+		vec_push(v, v2.data[i])
 	}
 }
 
+// Returns the macro invocation at the outermost level that produced
+// a given token, or the token itself.
+func origin(t *Token) *Token {
+	for t.origin != nil {
+		t = t.origin
+	}
+	return t
+}
+
+// If a given identifier is a macro invocation, pushes back its
+// expansion to the input and returns true.
+func expand_macro(t *Token) bool {
+	m := find_macro(t.name)
+	if m == nil || hideset_has(t.hideset, t.name) {
+		return false
+	}
+
+	if m.handler != nil {
+		t2 := tokenize_str(m.handler(t), "<built-in>").data[0].(*Token)
+		t2.hideset = hideset_add(t.hideset, t.name)
+		t2.origin = t
+		t2.has_space = t.has_space
+		unread_one(t2)
+		return true
+	}
+
+	var body *Vector
+	var hs *Map
+	if m.ty == OBJLIKE {
+		hs = hideset_add(t.hideset, t.name)
+		body = subst(m, m.tokens, nil)
+	} else {
+		if !consume_lparen() {
+			return false
+		}
+		args, rparen := read_args(m, t)
+		hs = hideset_add(hideset_intersection(t.hideset, rparen.hideset), t.name)
+		body = subst(m, m.tokens, args)
+	}
+
+	// Tokens in the expansion are copied to give them the hideset.
+	v := new_vec()
+	for i := 0; i < body.len; i++ {
+		t2 := copy_token(body.data[i].(*Token))
+		t2.hideset = hideset_union(t2.hideset, hs)
+		if t2.origin == nil {
+			t2.origin = t
+		}
+		if i == 0 {
+			t2.has_space = t.has_space
+		}
+		vec_push(v, t2)
+	}
+	unread(v)
+	return true
+}
+
+func unread_one(t *Token) {
+	ctx_p.pending = append(ctx_p.pending, t)
+}
+
 func funclike_macro(name string) {
 	m := new_macro(FUNCLIKE, name)
-	vec_push(m.params, ident_p("parameter name expected"))
-	for !consume_p(')') {
-		get(',', "comma expected")
-		vec_push(m.params, ident_p("parameter name expected"))
+	if !consume_p(')') {
+		for {
+			if consume_p(TK_ELLIPSIS) {
+				vec_push(m.params, "__VA_ARGS__")
+				m.is_variadic = true
+				get(')', "')' expected")
+				break
+			}
+			vec_push(m.params, ident_p("parameter name expected"))
+			if consume_p(')') {
+				break
+			}
+			get(',', "comma expected")
+		}
 	}
 	m.tokens = read_until_eol()
 	replace_params(m)
@@ -258,57 +682,755 @@ func objlike_macro(name string) {
 }
 
 func define() {
+	t := get(TK_IDENT, "macro name expected")
+
+	// A function-like macro has '(' right after its name.
+	if p := peek(); p.ty == '(' && len(t.end) == len(p.start) {
+		next()
+		funclike_macro(t.name)
+		return
+	}
+	objlike_macro(t.name)
+}
+
+func undef() {
 	name := ident_p("macro name expected")
-	if consume_p('(') {
-		funclike_macro(name)
+	expect_eol()
+	map_put(macros, name, nil)
+}
+
+// Expands macros in a given token sequence.
+func expand(v *Vector) *Vector {
+	ctx_p = new_ctx_p(ctx_p, v)
+	for !eof() {
+		t := next()
+		if t.ty == TK_IDENT && expand_macro(t) {
+			continue
+		}
+		add_p(t)
+	}
+	v = ctx_p.output
+	ctx_p = ctx_p.next
+	return v
+}
+
+func expect_eol() {
+	t := next()
+	if t.ty != '\n' {
+		bad_token(t, "extra tokens at end of directive")
+	}
+}
+
+// Replaces `defined X` and `defined(X)` with 1 or 0.
+func read_defined(v *Vector) *Vector {
+	v2 := new_vec()
+	for i := 0; i < v.len; i++ {
+		t := v.data[i].(*Token)
+		if !is_ident(t, "defined") {
+			vec_push(v2, t)
+			continue
+		}
+
+		paren := i+1 < v.len && v.data[i+1].(*Token).ty == '('
+		if paren {
+			i++
+		}
+		if i+1 >= v.len || v.data[i+1].(*Token).ty != TK_IDENT {
+			bad_token(t, "macro name expected")
+		}
+		i++
+		name := v.data[i].(*Token).name
+		if paren {
+			if i+1 >= v.len || v.data[i+1].(*Token).ty != ')' {
+				bad_token(t, "')' expected")
+			}
+			i++
+		}
+
+		if map_get(macros, name) != nil {
+			vec_push(v2, new_int_p(1))
+		} else {
+			vec_push(v2, new_int_p(0))
+		}
+	}
+	return v2
+}
+
+// #if evaluator. Values are 64-bit integers of type intmax_t or
+// uintmax_t, and identifiers remaining after macro expansion are 0.
+var (
+	cexpr_toks *Vector
+	cexpr_pos  int
+)
+
+var cexpr_prec = map[int]int{
+	TK_LOGOR:  1,
+	TK_LOGAND: 2,
+	'|':       3,
+	'^':       4,
+	'&':       5,
+	TK_EQ:     6,
+	TK_NE:     6,
+	'<':       7,
+	'>':       7,
+	TK_LE:     7,
+	TK_GE:     7,
+	TK_SHL:    8,
+	TK_SHR:    8,
+	'+':       9,
+	'-':       9,
+	'*':       10,
+	'/':       10,
+	'%':       10,
+}
+
+func cexpr_next() *Token {
+	t := cexpr_toks.data[cexpr_pos].(*Token)
+	if t.ty != TK_EOF {
+		cexpr_pos++
+	}
+	return t
+}
+
+func cexpr_consume(ty int) bool {
+	if cexpr_toks.data[cexpr_pos].(*Token).ty != ty {
+		return false
+	}
+	cexpr_pos++
+	return true
+}
+
+// If live is false, the operand is not evaluated by the rules of
+// &&, || and ?:, so division by zero is not an error.
+// The second result is true if the value is unsigned (uintmax_t).
+func cexpr_unary(live bool) (int, bool) {
+	t := cexpr_next()
+	switch t.ty {
+	case '+':
+		return cexpr_unary(live)
+	case '-':
+		{
+			val, uns := cexpr_unary(live)
+			return -val, uns
+		}
+	case '!':
+		{
+			val, _ := cexpr_unary(live)
+			return bool_to_int(val == 0), false
+		}
+	case '~':
+		{
+			val, uns := cexpr_unary(live)
+			return ^val, uns
+		}
+	case '(':
+		{
+			val, uns := cexpr_cond(live)
+			if !cexpr_consume(')') {
+				bad_token(t, "unclosed parenthesis")
+			}
+			return val, uns
+		}
+	case TK_NUM:
+		// A literal too large for intmax_t has type uintmax_t.
+		return t.val, t.is_unsigned || t.val < 0
+	case TK_IDENT:
+		return 0, false
+	case TK_EOF:
+		bad_token(t, "missing operand in #if expression")
+	}
+	if map_get(keywords, tokstr(t)) != nil {
+		return 0, false
+	}
+	bad_token(t, "invalid token in #if expression")
+	return 0, false
+}
+
+// Operands are converted to uintmax_t if either of them is unsigned.
+// The result of a shift has the type of its left operand.
+func cexpr_binop(t *Token, x, y int, xu, yu, live bool) (int, bool) {
+	uns := xu || yu
+	switch t.ty {
+	case TK_LOGOR:
+		return bool_to_int(x != 0 || y != 0), false
+	case TK_LOGAND:
+		return bool_to_int(x != 0 && y != 0), false
+	case '|':
+		return x | y, uns
+	case '^':
+		return x ^ y, uns
+	case '&':
+		return x & y, uns
+	case TK_EQ:
+		return bool_to_int(x == y), false
+	case TK_NE:
+		return bool_to_int(x != y), false
+	case '<':
+		if uns {
+			return bool_to_int(uint(x) < uint(y)), false
+		}
+		return bool_to_int(x < y), false
+	case '>':
+		if uns {
+			return bool_to_int(uint(x) > uint(y)), false
+		}
+		return bool_to_int(x > y), false
+	case TK_LE:
+		if uns {
+			return bool_to_int(uint(x) <= uint(y)), false
+		}
+		return bool_to_int(x <= y), false
+	case TK_GE:
+		if uns {
+			return bool_to_int(uint(x) >= uint(y)), false
+		}
+		return bool_to_int(x >= y), false
+	case TK_SHL:
+		return x << uint(y), xu
+	case TK_SHR:
+		if xu {
+			return int(uint(x) >> uint(y)), true
+		}
+		return x >> uint(y), false
+	case '+':
+		return x + y, uns
+	case '-':
+		return x - y, uns
+	case '*':
+		return x * y, uns
+	}
+
+	// '/' or '%'
+	if y == 0 {
+		if live {
+			bad_token(t, "division by zero in #if")
+		}
+		return 0, uns
+	}
+	if uns {
+		if t.ty == '/' {
+			return int(uint(x) / uint(y)), true
+		}
+		return int(uint(x) % uint(y)), true
+	}
+	if t.ty == '/' {
+		return x / y, false
+	}
+	return x % y, false
+}
+
+func cexpr_binary(min int, live bool) (int, bool) {
+	x, xu := cexpr_unary(live)
+	for {
+		t := cexpr_toks.data[cexpr_pos].(*Token)
+		prec := cexpr_prec[t.ty]
+		if prec == 0 || prec < min {
+			return x, xu
+		}
+		cexpr_pos++
+
+		rhs_live := live
+		if t.ty == TK_LOGAND && x == 0 || t.ty == TK_LOGOR && x != 0 {
+			rhs_live = false
+		}
+		y, yu := cexpr_binary(prec+1, rhs_live)
+		x, xu = cexpr_binop(t, x, y, xu, yu, rhs_live)
+	}
+}
+
+func cexpr_cond(live bool) (int, bool) {
+	t := cexpr_toks.data[cexpr_pos].(*Token)
+	cond, cu := cexpr_binary(1, live)
+	if !cexpr_consume('?') {
+		return cond, cu
+	}
+	then, tu := cexpr_cond(live && cond != 0)
+	if !cexpr_consume(':') {
+		bad_token(t, "':' expected")
+	}
+	els, eu := cexpr_cond(live && cond == 0)
+	if cond != 0 {
+		return then, tu || eu
+	}
+	return els, tu || eu
+}
+
+// Reads the rest of an #if or #elif line and evaluates it.
+func read_constexpr(directive *Token) int {
+	v := read_defined(read_until_eol())
+
+	// The end marker points to the directive for error reporting.
+	// It is added before expansion so that a macro invocation doesn't
+	// read arguments past the end of the line.
+	end := new(Token)
+	*end = *directive
+	end.ty = TK_EOF
+	vec_push(v, end)
+
+	v = expand(v)
+	if v.data[0].(*Token).ty == TK_EOF {
+		bad_token(directive, "no expression in directive")
+	}
+
+	cexpr_toks = v
+	cexpr_pos = 0
+	val, _ := cexpr_cond(true)
+	if t := cexpr_next(); t.ty != TK_EOF {
+		bad_token(t, "extra tokens in #if expression")
+	}
+	return val
+}
+
+// Skips tokens until #elif, #else or #endif that belongs to the
+// current conditional. Nested conditionals are skipped as a whole.
+func skip_cond_incl() {
+	depth := 0
+	for !eof() && peek().ty != TK_EOF {
+		t := next()
+		if t.ty != '#' || !is_bol() {
+			continue
+		}
+
+		name := tokstr(peek())
+		if name == "if" || name == "ifdef" || name == "ifndef" {
+			depth++
+			continue
+		}
+		if depth > 0 {
+			if name == "endif" {
+				depth--
+			}
+			continue
+		}
+		if name == "elif" || name == "else" || name == "endif" {
+			ctx_p.pos--
+			return
+		}
+	}
+	c := vec_last(ctx_p.conds).(*Cond)
+	bad_token(c.tok, "unterminated conditional directive")
+}
+
+func push_cond(t *Token, included bool) {
+	c := new(Cond)
+	c.tok = t
+	c.included = included
+	vec_push(ctx_p.conds, c)
+	if !included {
+		skip_cond_incl()
+	}
+}
+
+func last_cond(t *Token) *Cond {
+	if ctx_p.conds.len == 0 {
+		bad_token(t, "#"+tokstr(t)+" without #if")
+	}
+	c := vec_last(ctx_p.conds).(*Cond)
+	if c.in_else {
+		bad_token(t, "#"+tokstr(t)+" after #else")
+	}
+	return c
+}
+
+func elif(t *Token) {
+	c := last_cond(t)
+	if c.included {
+		read_until_eol()
+		skip_cond_incl()
+		return
+	}
+	if read_constexpr(t) != 0 {
+		c.included = true
+	} else {
+		skip_cond_incl()
+	}
+}
+
+func else_p(t *Token) {
+	c := last_cond(t)
+	c.in_else = true
+	expect_eol()
+	if c.included {
+		skip_cond_incl()
+		return
+	}
+	c.included = true
+}
+
+func endif(t *Token) {
+	if ctx_p.conds.len == 0 {
+		bad_token(t, "#endif without #if")
+	}
+	vec_pop(ctx_p.conds)
+	expect_eol()
+}
+
+func include_dirs() []string {
+	var v []string
+	v = append(v, include_paths...)
+	v = append(v, system_include_paths...)
+	return append(v, default_include_paths...)
+}
+
+func file_exists(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && !fi.IsDir()
+}
+
+func abs_path(path string) string {
+	p, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	return p
+}
+
+// Searches a header file. A file included by "..." is searched in the
+// directory of the current file first. Include directories are searched
+// from the index from. Returns the path and the index of the directory
+// where the file is found.
+func search_include(name string, quote bool, from int) (string, int) {
+	if filepath.IsAbs(name) {
+		if file_exists(name) {
+			return name, -1
+		}
+		return "", -1
+	}
+
+	if quote {
+		p := filepath.Join(filepath.Dir(ctx_p.path), name)
+		if file_exists(p) {
+			return p, -1
+		}
+	}
+
+	dirs := include_dirs()
+	for i := from; i < len(dirs); i++ {
+		p := filepath.Join(dirs[i], name)
+		if file_exists(p) {
+			return p, i
+		}
+	}
+	return "", -1
+}
+
+// Reads a header name of #include. It is either a string literal or
+// tokens between '<' and '>'. Returns the name and true if it is a
+// string literal.
+func read_header_name(t *Token) (string, bool) {
+	v := read_until_eol()
+	if v.len > 0 {
+		t2 := v.data[0].(*Token)
+		if t2.ty != TK_STR && t2.ty != '<' {
+			v = expand(v)
+		}
+	}
+
+	if v.len == 1 && v.data[0].(*Token).ty == TK_STR {
+		return v.data[0].(*Token).str, true
+	}
+
+	if v.len < 2 || v.data[0].(*Token).ty != '<' || vec_last(v).(*Token).ty != '>' {
+		bad_token(t, "expected \"FILENAME\" or <FILENAME>")
+	}
+	sb := new_sb()
+	for i := 1; i < v.len-1; i++ {
+		sb_append(sb, tokstr(v.data[i].(*Token)))
+	}
+	return sb_get(sb), false
+}
+
+// Returns the include guard macro of a file, or "" if the file is not
+// guarded. A guarded file starts with #ifndef and ends with the
+// corresponding #endif.
+func guard_macro(tokens *Vector) string {
+	var dirs []*Token
+	for i := 0; i+1 < tokens.len; i++ {
+		t := tokens.data[i].(*Token)
+		if t.ty == '#' && (i == 0 || tokens.data[i-1].(*Token).ty == '\n') {
+			dirs = append(dirs, tokens.data[i+1].(*Token))
+		}
+	}
+
+	// The file must start with "#ifndef NAME".
+	i := 0
+	for i < tokens.len && tokens.data[i].(*Token).ty == '\n' {
+		i++
+	}
+	if i+2 >= tokens.len || tokens.data[i].(*Token).ty != '#' || len(dirs) == 0 ||
+		tokstr(dirs[0]) != "ifndef" || tokens.data[i+2].(*Token).ty != TK_IDENT {
+		return ""
+	}
+	name := tokens.data[i+2].(*Token).name
+
+	// The #endif that closes the #ifndef must be the last directive
+	// followed only by newlines.
+	depth := 0
+	for j, d := range dirs {
+		switch tokstr(d) {
+		case "if", "ifdef", "ifndef":
+			depth++
+		case "elif", "else":
+			if depth == 1 {
+				return ""
+			}
+		case "endif":
+			depth--
+			if depth == 0 && j != len(dirs)-1 {
+				return ""
+			}
+		}
+	}
+	if depth != 0 {
+		return ""
+	}
+
+	last := dirs[len(dirs)-1]
+	for k := 0; k < tokens.len; k++ {
+		if tokens.data[k].(*Token) != last {
+			continue
+		}
+		for k++; k < tokens.len; k++ {
+			if tokens.data[k].(*Token).ty != '\n' {
+				return ""
+			}
+		}
+	}
+	return name
+}
+
+func include(t *Token, is_next bool) {
+	name, quote := read_header_name(t)
+
+	from := 0
+	if is_next {
+		quote = false
+		from = ctx_p.dir + 1
+	}
+	path, dir := search_include(name, quote, from)
+	if path == "" {
+		bad_token(t, format("%s: file not found", name))
+	}
+
+	key := abs_path(path)
+	if map_get(once_files, key) != nil {
+		return
+	}
+	if g := map_get(guards, key); g != nil && find_macro(g.(string)) != nil {
 		return
 	}
-	objlike_macro(name)
+
+	// A file may include itself, so recursion is only bounded by depth.
+	depth := 0
+	for c := ctx_p; c != nil; c = c.next {
+		if c.path != "" {
+			depth++
+		}
+	}
+	if depth > 200 {
+		bad_token(t, "#include nested too deeply")
+	}
+
+	v := scan_file(path, false)
+	if g := guard_macro(v); g != "" {
+		map_put(guards, key, g)
+	}
+	append_p(preprocess(v, path, dir))
+}
+
+// Handles #line and linemarkers such as `# 10 "foo.c"` that -E
+// emits. The line after the directive gets the given line number.
+func line_marker(t *Token, is_line bool) {
+	var v *Vector
+	if is_line {
+		v = expand(read_until_eol())
+	} else {
+		v = new_vec()
+		vec_push(v, t)
+		append_vec(v, read_until_eol())
+	}
+
+	if v.len == 0 || v.data[0].(*Token).ty != TK_NUM {
+		bad_token(t, "line number expected")
+	}
+	delta := v.data[0].(*Token).val - (line(t) + 1)
+
+	path := ""
+	if v.len > 1 {
+		t2 := v.data[1].(*Token)
+		if t2.ty != TK_STR {
+			bad_token(t2, "file name expected")
+		}
+		path = t2.str
+	}
+	// Linemarkers may have flags after the file name.
+	if is_line && v.len > 2 {
+		bad_token(v.data[2].(*Token), "extra tokens at end of directive")
+	}
+
+	for i := ctx_p.pos; i < ctx_p.input.len; i++ {
+		t2 := ctx_p.input.data[i].(*Token)
+		t2.line += delta
+		if path != "" {
+			t2.path = path
+		}
+	}
 }
 
-func include() {
-	t := get(TK_STR, "string expected")
-	path := t.str
-	get('\n', "newline expected")
-	append_p(tokenize(path, false))
+func pragma() {
+	v := read_until_eol()
+	if v.len > 0 && is_ident(v.data[0].(*Token), "once") {
+		map_put(once_files, abs_path(ctx_p.path), true)
+	}
+	// Other pragmas are ignored.
 }
 
-func preprocess(tokens *Vector) *Vector {
+func preprocess(tokens *Vector, path string, dir int) *Vector {
 	if macros == nil {
-		macros = new_map()
+		init_macros()
 	}
 	ctx_p = new_ctx_p(ctx_p, tokens)
+	ctx_p.path = path
+	ctx_p.dir = dir
 
 	for !eof() {
+		from_input := len(ctx_p.pending) == 0
 		t := next()
 
-		if t.ty == TK_IDENT {
-			m := map_get(macros, t.name)
-			if m != nil {
-				apply(m.(*Macro), t)
-			} else {
-				add_p(t)
-			}
+		if t.ty == TK_IDENT && expand_macro(t) {
 			continue
 		}
 
-		if t.ty != '#' {
+		if t.ty != '#' || !from_input || !is_bol() {
 			add_p(t)
 			continue
 		}
 
-		t = get(TK_IDENT, "identifier expected")
+		// Directive names such as "if" may be keywords.
+		t = next()
+		if t.ty == '\n' {
+			continue
+		}
+		name := tokstr(t)
 
-		if strcmp(t.name, "define") == 0 {
+		if strcmp(name, "define") == 0 {
 			define()
-		} else if strcmp(t.name, "include") == 0 {
-			include()
+		} else if strcmp(name, "undef") == 0 {
+			undef()
+		} else if strcmp(name, "include") == 0 {
+			include(t, false)
+		} else if strcmp(name, "include_next") == 0 {
+			include(t, true)
+		} else if strcmp(name, "pragma") == 0 {
+			pragma()
+		} else if strcmp(name, "line") == 0 {
+			line_marker(t, true)
+		} else if t.ty == TK_NUM {
+			line_marker(t, false)
+		} else if strcmp(name, "if") == 0 {
+			push_cond(t, read_constexpr(t) != 0)
+		} else if strcmp(name, "ifdef") == 0 {
+			defined := map_get(macros, ident_p("macro name expected")) != nil
+			expect_eol()
+			push_cond(t, defined)
+		} else if strcmp(name, "ifndef") == 0 {
+			defined := map_get(macros, ident_p("macro name expected")) != nil
+			expect_eol()
+			push_cond(t, !defined)
+		} else if strcmp(name, "elif") == 0 {
+			elif(t)
+		} else if strcmp(name, "else") == 0 {
+			else_p(t)
+		} else if strcmp(name, "endif") == 0 {
+			endif(t)
 		} else {
 			bad_token(t, "unknown directive")
 		}
 	}
 
+	if ctx_p.conds.len > 0 {
+		c := vec_last(ctx_p.conds).(*Cond)
+		bad_token(c.tok, "unterminated conditional directive")
+	}
+
 	v := ctx_p.output
 	ctx_p = ctx_p.next
 	return v
 }
+
+// Returns whitespace before a given token if it is the first token
+// in its line.
+func indent(t *Token) string {
+	s := t.buf[:len(t.buf)-len(t.start)]
+	s = s[strings.LastIndexByte(s, '\n')+1:]
+	if strings.Trim(s, " \t") != "" {
+		return ""
+	}
+	return s
+}
+
+func is_ident_char(c byte) bool {
+	return c == '_' || c == '.' || unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c))
+}
+
+// Returns true if two tokens that were not adjacent in the source
+// would be read as a different token when printed without a space.
+func needs_space(prev, t *Token) bool {
+	if prev.origin == nil && t.origin == nil {
+		return false
+	}
+	a, b := tokstr(prev), tokstr(t)
+	x, y := a[len(a)-1], b[0]
+	if is_ident_char(x) && is_ident_char(y) {
+		return true
+	}
+	if x == '/' && (y == '/' || y == '*') {
+		return true
+	}
+	for _, sym := range symbols {
+		if strings.HasPrefix(sym.name, string(x)+string(y)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Prints a preprocessed token sequence as C source for -E. Tokens are
+// printed at the lines where they or their macro invocations appear.
+// A linemarker is printed when the file changes or many lines are
+// skipped, so that the output can be compiled again.
+func print_preprocessed(tokens *Vector) {
+	w := out
+	path := ""
+	ln := 0
+	var prev *Token
+
+	for i := 0; i < tokens.len; i++ {
+		t := tokens.data[i].(*Token)
+		if t.ty == '\n' {
+			continue
+		}
+
+		o := origin(t)
+		if o.path != path || line(o) < ln || line(o) > ln+8 {
+			if prev != nil {
+				fmt.Fprintf(w, "\n")
+			}
+			fmt.Fprintf(w, "# %d %s\n", line(o), quote(o.path))
+			path = o.path
+			ln = line(o)
+			fmt.Fprintf(w, "%s", indent(o))
+		} else if line(o) > ln {
+			for ; ln < line(o); ln++ {
+				fmt.Fprintf(w, "\n")
+			}
+			fmt.Fprintf(w, "%s", indent(o))
+		} else if t.has_space || needs_space(prev, t) {
+			fmt.Fprintf(w, " ")
+		}
+
+		fmt.Fprintf(w, "%s", tokstr(t))
+		prev = t
+	}
+	fmt.Fprintf(w, "\n")
+}
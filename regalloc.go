@@ -2,81 +2,434 @@ package main
 
 // Register allocator.
 //
-// Before this pass, it is assumedd that we have infinite number of
+// Before this pass, it is assumed that we have infinite number of
 // registers. This pass maps them to a finite number of registers.
 // We actually have only 7 registers.
 //
-// We allocate registers only within a single expression. In other
-// words, there are no registers that live beyond semicolons.
-// This design choice simplifies the implementation a lot, since
-// practically we don't have to thinl about the case in which
-// registers are exhausted and need to be spilled to memory.
-
-var (
-	used       []bool
-	reg_map    [8192]int
-	reg_map_sz = len(reg_map)
+// This is a linear scan allocator. The live range of each register is
+// computed over a whole function from liveness analysis on basic
+// blocks, so a value can stay in a register across statements and
+// loops. Live ranges are visited in order of their starts, and each
+// of them gets a free register. If no register is free, the range
+// that ends last is spilled to a stack slot. Every reference to a
+// spilled register is then rewritten to use a short-lived register
+// that is loaded from or stored to the slot, and allocation is done
+// again.
+//
+// Floating-point registers are allocated in the same way from a
+// separate set of 8 XMM registers.
+
+import (
+	"math/bits"
+	"sort"
 )
 
-func alloc(ir_reg int) int {
-	if reg_map[ir_reg] != -1 {
-		r := reg_map[ir_reg]
-		//assert("used[r])
-		return r
+// A register operand of an IR instruction. r points to the operand
+// in the instruction.
+type Operand struct {
+	r      *int
+	is_fp  bool
+	is_use bool
+	is_def bool
+}
+
+// A live range of a register. An instruction at index i reads its
+// operands at position 2*i and writes its result at 2*i+1, so that
+// the result can reuse a register of an operand that dies there.
+type Interval struct {
+	reg   int
+	start int
+	end   int
+	is_fp bool
+
+	// Registers for spill code live only within one instruction.
+	// They are never spilled.
+	no_spill bool
+
+	// Assigned register, or -1 if spilled
+	phys int
+}
+
+var spill_regs map[int]bool
+
+func operands(ir *IR) []Operand {
+	reg := func(r *int, use, def bool) Operand { return Operand{r, false, use, def} }
+	freg := func(r *int, use, def bool) Operand { return Operand{r, true, use, def} }
+
+	switch ir.op {
+	case IR_IMM, IR_BPREL, IR_LABEL_ADDR, IR_LOAD_SPILL:
+		return []Operand{reg(&ir.lhs, false, true)}
+	case IR_MOV, IR_LOAD:
+		return []Operand{reg(&ir.lhs, false, true), reg(&ir.rhs, true, false)}
+	case IR_STORE, IR_MEMCPY:
+		return []Operand{reg(&ir.lhs, true, false), reg(&ir.rhs, true, false)}
+	case IR_RETURN, IR_SRETURN, IR_IF, IR_UNLESS, IR_JMP_TABLE, IR_STORE_SPILL:
+		return []Operand{reg(&ir.lhs, true, false)}
+	case IR_NEG, IR_CAST:
+		return []Operand{reg(&ir.lhs, true, true)}
+	case IR_ADD, IR_SUB, IR_MUL, IR_XOR:
+		if ir.is_imm {
+			return []Operand{reg(&ir.lhs, true, true)}
+		}
+		return []Operand{reg(&ir.lhs, true, true), reg(&ir.rhs, true, false)}
+	case IR_DIV, IR_MOD, IR_EQ, IR_NE, IR_LT, IR_LE, IR_AND, IR_OR, IR_SHL, IR_SHR:
+		return []Operand{reg(&ir.lhs, true, true), reg(&ir.rhs, true, false)}
+	case IR_FIMM, IR_FLOAD_SPILL:
+		return []Operand{freg(&ir.lhs, false, true)}
+	case IR_FRETURN, IR_FSTORE_SPILL:
+		return []Operand{freg(&ir.lhs, true, false)}
+	case IR_FNEG, IR_F2F:
+		return []Operand{freg(&ir.lhs, true, true)}
+	case IR_FMOV:
+		return []Operand{freg(&ir.lhs, false, true), freg(&ir.rhs, true, false)}
+	case IR_FADD, IR_FSUB, IR_FMUL, IR_FDIV:
+		return []Operand{freg(&ir.lhs, true, true), freg(&ir.rhs, true, false)}
+	case IR_FLOAD, IR_I2F:
+		return []Operand{freg(&ir.lhs, false, true), reg(&ir.rhs, true, false)}
+	case IR_FSTORE:
+		return []Operand{reg(&ir.lhs, true, false), freg(&ir.rhs, true, false)}
+	case IR_F2I:
+		return []Operand{reg(&ir.lhs, false, true), freg(&ir.rhs, true, false)}
+	case IR_FEQ, IR_FNE, IR_FLT, IR_FLE:
+		return []Operand{freg(&ir.lhs, true, false), freg(&ir.rhs, true, false), reg(&ir.dst, false, true)}
+	case IR_CALL, IR_ICALL:
+		{
+			var v []Operand
+			if ir.op == IR_ICALL {
+				v = append(v, reg(&ir.rhs, true, false))
+			}
+			for i := range ir.args {
+				v = append(v, reg(&ir.args[i], true, false))
+			}
+			for i := range ir.fargs {
+				v = append(v, freg(&ir.fargs[i], true, false))
+			}
+			return append(v, Operand{&ir.lhs, ir.is_fp, false, true})
+		}
+	}
+	return nil
+}
+
+func bit_set(s []uint64, i int)       { s[i/64] |= 1 << uint(i%64) }
+func bit_test(s []uint64, i int) bool { return s[i/64]&(1<<uint(i%64)) != 0 }
+
+func for_each_bit(s []uint64, fn func(int)) {
+	for i, w := range s {
+		for w != 0 {
+			fn(i*64 + bits.TrailingZeros64(w))
+			w &= w - 1
+		}
+	}
+}
+
+// Computes registers that are live at the beginning and the end of
+// each basic block. Registers are numbered densely by ids. Results
+// are indexed by block ids.
+func liveness(bbs *Vector, ids map[int]int) ([][]uint64, [][]uint64) {
+	n := (len(ids) + 63) / 64
+	use := make([][]uint64, bbs.len)
+	def := make([][]uint64, bbs.len)
+	live_in := make([][]uint64, bbs.len)
+	live_out := make([][]uint64, bbs.len)
+
+	for i := 0; i < bbs.len; i++ {
+		bb := bbs.data[i].(*BB)
+		use[i] = make([]uint64, n)
+		def[i] = make([]uint64, n)
+		live_in[i] = make([]uint64, n)
+		live_out[i] = make([]uint64, n)
+
+		for j := 0; j < bb.ir.len; j++ {
+			ops := operands(bb.ir.data[j].(*IR))
+			for _, op := range ops {
+				if op.is_use && !bit_test(def[i], ids[*op.r]) {
+					bit_set(use[i], ids[*op.r])
+				}
+			}
+			for _, op := range ops {
+				if op.is_def {
+					bit_set(def[i], ids[*op.r])
+				}
+			}
+		}
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for i := bbs.len - 1; i >= 0; i-- {
+			bb := bbs.data[i].(*BB)
+			for j := 0; j < bb.succ.len; j++ {
+				for k, x := range live_in[bb.succ.data[j].(*BB).id] {
+					live_out[i][k] |= x
+				}
+			}
+			for k := range live_in[i] {
+				x := use[i][k] | (live_out[i][k] &^ def[i][k])
+				if x != live_in[i][k] {
+					live_in[i][k] = x
+					changed = true
+				}
+			}
+		}
+	}
+	return live_in, live_out
+}
+
+// Computes the live range of each register in a function.
+// Instructions are numbered in the order of basic blocks.
+func build_intervals(fn *Function) []*Interval {
+	ids := make(map[int]int)
+	var ivs []*Interval
+
+	extend := func(r, pos int, is_fp bool) {
+		id, ok := ids[r]
+		if !ok {
+			id = len(ivs)
+			ids[r] = id
+			ivs = append(ivs, &Interval{reg: r, start: pos, end: pos, is_fp: is_fp, no_spill: spill_regs[r]})
+		}
+		iv := ivs[id]
+		if pos < iv.start {
+			iv.start = pos
+		}
+		if pos > iv.end {
+			iv.end = pos
+		}
+	}
+
+	starts := make([]int, fn.bbs.len)
+	i := 0
+	for j := 0; j < fn.bbs.len; j++ {
+		bb := fn.bbs.data[j].(*BB)
+		starts[j] = i
+		for k := 0; k < bb.ir.len; k++ {
+			for _, op := range operands(bb.ir.data[k].(*IR)) {
+				if op.is_use {
+					extend(*op.r, 2*i, op.is_fp)
+				}
+				if op.is_def {
+					extend(*op.r, 2*i+1, op.is_fp)
+				}
+			}
+			i++
+		}
+	}
+
+	live_in, live_out := liveness(fn.bbs, ids)
+	for j := 0; j < fn.bbs.len; j++ {
+		bb := fn.bbs.data[j].(*BB)
+		if bb.ir.len == 0 {
+			continue
+		}
+		start, end := starts[j], starts[j]+bb.ir.len
+		for_each_bit(live_in[j], func(id int) {
+			extend(ivs[id].reg, 2*start, ivs[id].is_fp)
+		})
+		for_each_bit(live_out[j], func(id int) {
+			extend(ivs[id].reg, 2*end-1, ivs[id].is_fp)
+		})
+	}
+	return ivs
+}
+
+// Assigns registers to live ranges of one register class. Returns
+// the live ranges that are spilled.
+func linear_scan(ivs []*Interval, nregs int) []*Interval {
+	sort.SliceStable(ivs, func(i, j int) bool { return ivs[i].start < ivs[j].start })
+
+	var active, spilled []*Interval
+	free := make([]bool, nregs)
+	for i := range free {
+		free[i] = true
 	}
 
-	for i := 0; i < num_regs; i++ {
-		if used[i] == true {
+	for _, cur := range ivs {
+		// Expire live ranges that end before this one.
+		j := 0
+		for _, iv := range active {
+			if iv.end < cur.start {
+				free[iv.phys] = true
+			} else {
+				active[j] = iv
+				j++
+			}
+		}
+		active = active[:j]
+
+		cur.phys = -1
+		for r := 0; r < nregs; r++ {
+			if free[r] {
+				cur.phys = r
+				free[r] = false
+				break
+			}
+		}
+		if cur.phys != -1 {
+			active = append(active, cur)
+			continue
+		}
+
+		// Spill the live range that ends last.
+		var victim *Interval
+		if !cur.no_spill {
+			victim = cur
+		}
+		for _, iv := range active {
+			if !iv.no_spill && (victim == nil || iv.end > victim.end) {
+				victim = iv
+			}
+		}
+		if victim == nil {
+			error("register exhausted")
+		}
+		spilled = append(spilled, victim)
+		if victim == cur {
 			continue
 		}
-		reg_map[ir_reg] = i
-		used[i] = true
-		return i
+
+		cur.phys = victim.phys
+		victim.phys = -1
+		for i, iv := range active {
+			if iv == victim {
+				active[i] = cur
+				break
+			}
+		}
+	}
+	return spilled
+}
+
+// Rewrites references to spilled registers. A spilled register is
+// loaded from its stack slot to a new register before an instruction
+// that reads it, and stored to the slot after an instruction that
+// writes it.
+func insert_spill_code(fn *Function, spilled []*Interval) {
+	slots := make(map[int]int)
+	for _, iv := range spilled {
+		fn.stacksize = roundup(fn.stacksize+8, 8)
+		slots[iv.reg] = fn.stacksize
+	}
+
+	for i := 0; i < fn.bbs.len; i++ {
+		bb := fn.bbs.data[i].(*BB)
+		v := new_vec()
+		for j := 0; j < bb.ir.len; j++ {
+			ir := bb.ir.data[j].(*IR)
+			loads, stores := spill_operands(ir, slots)
+			for _, x := range loads {
+				vec_push(v, x)
+			}
+			vec_push(v, ir)
+			for _, x := range stores {
+				vec_push(v, x)
+			}
+		}
+		bb.ir = v
 	}
-	error("register exhausted")
-	return -1
 }
 
-func visit(irv *Vector) {
-	for i := 0; i < irv.len; i++ {
-		ir := irv.data[i].(*IR)
+// Replaces spilled registers in an instruction with new registers.
+// Returns instructions to load them before the instruction and to
+// store them after that.
+func spill_operands(ir *IR, slots map[int]int) ([]*IR, []*IR) {
+	var loads, stores []*IR
+	tmp := make(map[int]int)
+
+	for _, op := range operands(ir) {
+		r := *op.r
+		slot, ok := slots[r]
+		if !ok {
+			continue
+		}
+
+		t, ok := tmp[r]
+		if !ok {
+			t = nreg
+			nreg++
+			tmp[r] = t
+			spill_regs[t] = true
+		}
+		*op.r = t
 
-		switch irinfo[ir.op].ty {
-		case IR_TY_BINARY:
-			ir.lhs = alloc(ir.lhs)
-			if !ir.is_imm {
-				ir.rhs = alloc(ir.rhs)
+		if op.is_use {
+			load := &IR{op: IR_LOAD_SPILL, lhs: t, rhs: slot}
+			if op.is_fp {
+				load.op = IR_FLOAD_SPILL
 			}
-		case IR_TY_REG, IR_TY_REG_IMM, IR_TY_REG_LABEL, IR_TY_LABEL_ADDR:
-			ir.lhs = alloc(ir.lhs)
-		case IR_TY_MEM, IR_TY_REG_REG:
-			ir.lhs = alloc(ir.lhs)
-			ir.rhs = alloc(ir.rhs)
-		case IR_TY_CALL:
-			ir.lhs = alloc(ir.lhs)
-			for i := 0; i < ir.nargs; i++ {
-				ir.args[i] = alloc(ir.args[i])
+			loads = append(loads, load)
+		}
+		if op.is_def {
+			store := &IR{op: IR_STORE_SPILL, lhs: t, rhs: slot}
+			if op.is_fp {
+				store.op = IR_FSTORE_SPILL
 			}
+			stores = append(stores, store)
 		}
+	}
+	return loads, stores
+}
 
-		if ir.op == IR_KILL {
-			//assert(used[ir.lhs])
-			used[ir.lhs] = false
-			ir.op = IR_NOP
+// Floating-point registers that are live across a call are saved by
+// the caller, because no XMM register is callee-saved.
+func set_live_fp(fn *Function, ivs []*Interval) {
+	i := 0
+	for j := 0; j < fn.bbs.len; j++ {
+		bb := fn.bbs.data[j].(*BB)
+		for k := 0; k < bb.ir.len; k, i = k+1, i+1 {
+			ir := bb.ir.data[k].(*IR)
+			if ir.op != IR_CALL && ir.op != IR_ICALL {
+				continue
+			}
+			ir.live_fp = nil
+			for _, iv := range ivs {
+				if iv.is_fp && iv.start < 2*i && iv.end > 2*i+1 {
+					ir.live_fp = append(ir.live_fp, iv.phys)
+				}
+			}
 		}
 	}
 }
 
-func alloc_regs(fns *Vector) {
+func alloc_fn(fn *Function) {
+	spill_regs = make(map[int]bool)
+
+	for {
+		ivs := build_intervals(fn)
 
-	used = make([]bool, num_regs)
+		var ints, floats []*Interval
+		for _, iv := range ivs {
+			if iv.is_fp {
+				floats = append(floats, iv)
+			} else {
+				ints = append(ints, iv)
+			}
+		}
+		spilled := linear_scan(ints, num_regs)
+		spilled = append(spilled, linear_scan(floats, num_fregs)...)
+		if len(spilled) > 0 {
+			insert_spill_code(fn, spilled)
+			continue
+		}
 
-	for i := 0; i < reg_map_sz; i++ {
-		reg_map[i] = -1
+		set_live_fp(fn, ivs)
+		phys := make(map[int]int)
+		for _, iv := range ivs {
+			phys[iv.reg] = iv.phys
+		}
+		for i := 0; i < fn.bbs.len; i++ {
+			bb := fn.bbs.data[i].(*BB)
+			for j := 0; j < bb.ir.len; j++ {
+				for _, op := range operands(bb.ir.data[j].(*IR)) {
+					*op.r = phys[*op.r]
+				}
+			}
+		}
+		return
 	}
+}
 
+func alloc_regs(fns *Vector) {
 	for i := 0; i < fns.len; i++ {
-		fn := fns.data[i].(*Function)
-		visit(fn.ir)
+		alloc_fn(fns.data[i].(*Function))
 	}
 }
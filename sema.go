@@ -19,17 +19,40 @@ package main
 //   for integer and becomes ptr+8 for pointer.
 //
 // - Reject bad assignments, such as `1=2+3`.
+//
+// An erroneous expression is reported and gets the error type, and
+// the analyzer continues with the next one. Checks on an operand of
+// the error type are skipped because it has been reported already.
 
-import (
-	"fmt"
-	"os"
-)
+import "math"
 
 var (
 	globals   *Vector
 	stacksize int
 	str_label int
 	env       *Env
+	ret_ty    *Type
+
+	// Global variables and functions at file scope
+	genv         *Env
+	static_label int
+
+	// True if the current function takes variable arguments
+	is_variadic bool
+
+	// Labeled statements and gotos in the current function
+	labels *Map
+	gotos  *Vector
+
+	// Nesting depth of loops and switches at the current statement
+	nloops    int
+	nswitches int
+
+	// Local variables of the current function
+	locals *Vector
+
+	// Functions that are called without a declaration
+	implicit_fns *Map
 )
 
 type Env struct {
@@ -70,30 +93,44 @@ func swap(p, q **Node) {
 	*q = r
 }
 
+// Arrays decay to pointers to their first elements, and functions
+// decay to pointers to themselves.
 func maybe_decay(base *Node, decay bool) *Node {
-	if !decay || base.ty.ty != ARY {
+	if !decay || base.ty.ty != ARY && base.ty.ty != FUNC {
 		return base
 	}
 
 	node := new(Node)
 	node.op = ND_ADDR
 	node.ty = ptr_to(base.ty.ary_of)
+	if base.ty.ty == FUNC {
+		node.ty = ptr_to(base.ty)
+	}
 	node.expr = base
+	node.tok = base.tok
 	return node
 }
 
+func is_err(node *Node) bool {
+	return node != nil && node.ty != nil && node.ty.ty == ERR
+}
+
+// Returns true if any operand of a given node has the error type.
+func has_err(node *Node) bool {
+	return is_err(node.lhs) || is_err(node.rhs) || is_err(node.expr)
+}
+
 func check_lval(node *Node) {
 	op := node.op
-	if op != ND_LVAR && op != ND_GVAR && op != ND_DEREF && op != ND_DOT {
-		error("not an lvalue: %d (%s)", op, node.name)
+	if op != ND_LVAR && op != ND_GVAR && op != ND_DEREF && op != ND_DOT && !is_err(node) {
+		error_at(node.tok, "lvalue required")
 	}
 }
 
 func new_int(val int) *Node {
 	node := new(Node)
 	node.op = ND_NUM
-	node.ty = new(Type)
-	node.ty.ty = INT
+	node.ty = int_tyf()
 	node.val = val
 	return node
 }
@@ -101,20 +138,616 @@ func new_int(val int) *Node {
 func scale_ptr(node *Node, ty *Type) *Node {
 	e := new(Node)
 	e.op = '*'
-	e.lhs = node
+	e.lhs = conv(node, long_tyf())
 	e.rhs = new_int(ty.ptr_to.size)
+	e.ty = long_tyf()
+	e.tok = node.tok
 	return e
 }
 
+// Converts an arithmetic expression to a given arithmetic type.
+// Integer values of different sizes or signedness need an explicit
+// conversion in the generated code because values are kept sign- or
+// zero-extended to 64 bits in registers.
+func conv(node *Node, ty *Type) *Node {
+	if !is_arith(node.ty) || !is_arith(ty) {
+		return node
+	}
+	if is_flonum(node.ty) == is_flonum(ty) && node.ty.size == ty.size &&
+		node.ty.is_unsigned == ty.is_unsigned {
+		return node
+	}
+	return new_cast(ty, node)
+}
+
+// Converts both operands of a binary operator to their common type.
+func binop_conv(node *Node) *Type {
+	if !is_arith(node.lhs.ty) || !is_arith(node.rhs.ty) {
+		return node.lhs.ty
+	}
+	ty := arith_conv(node.lhs.ty, node.rhs.ty)
+	node.lhs = conv(node.lhs, ty)
+	node.rhs = conv(node.rhs, ty)
+	return ty
+}
+
+// Operands of these operators must have integer types.
+func check_integer(node *Node) {
+	if has_err(node) {
+		return
+	}
+	if node.lhs != nil && !is_integer(node.lhs.ty) && node.lhs.ty.ty != PTR ||
+		node.rhs != nil && !is_integer(node.rhs.ty) && node.rhs.ty.ty != PTR ||
+		node.expr != nil && !is_integer(node.expr.ty) {
+		error_at(node.tok, "invalid operand to an integer operator")
+	}
+}
+
+// Warns about an implicit conversion between a pointer and an
+// integer other than a null pointer constant.
+func check_int_conv(node *Node, ty *Type, what string) {
+	if ty.ty == PTR && is_integer(node.ty) {
+		if val, ok := eval(node); ok && val == 0 {
+			return
+		}
+		warn(node.tok, "int-conversion", "%s makes pointer from integer without a cast", what)
+	} else if is_integer(ty) && node.ty.ty == PTR {
+		warn(node.tok, "int-conversion", "%s makes integer from pointer without a cast", what)
+	}
+}
+
+// Warns about a comparison in which a signed operand is converted to
+// unsigned, unless the operand is known to be non-negative.
+func check_sign_compare(node *Node) {
+	if !is_integer(node.lhs.ty) || !is_integer(node.rhs.ty) {
+		return
+	}
+	lhs := int_promote(node.lhs.ty)
+	rhs := int_promote(node.rhs.ty)
+	if lhs.is_unsigned == rhs.is_unsigned || !arith_conv(lhs, rhs).is_unsigned {
+		return
+	}
+
+	signed := node.lhs
+	if lhs.is_unsigned {
+		signed = node.rhs
+	}
+	if signed.ty.is_unsigned {
+		return
+	}
+	if val, ok := eval(signed); ok && val >= 0 {
+		return
+	}
+	warn(node.tok, "sign-compare", "comparison of integer expressions of different signedness")
+}
+
+// Branches test integer registers, so a floating-point condition is
+// converted to a comparison with zero.
+func as_cond(node *Node) *Node {
+	if !is_flonum(node.ty) {
+		return node
+	}
+	zero := new(Node)
+	zero.op = ND_NUM
+	zero.ty = node.ty
+	ret := new_binop(ND_NE, node, zero)
+	ret.ty = int_tyf()
+	return ret
+}
+
+// Checks case labels of a switch statement. Case values must be
+// constant and distinct, and there must be at most one default.
+func check_cases(node *Node) {
+	seen := make(map[int]bool)
+	has_default := false
+
+	for i := 0; i < node.cases.len; i++ {
+		c := node.cases.data[i].(*Node)
+		if c.op == ND_CASE {
+			c.val = wrap_int(c.val, node.cond.ty)
+		}
+		if c.op == ND_DEFAULT {
+			if has_default {
+				error_at(c.tok, "multiple default labels in one switch")
+			}
+			has_default = true
+			continue
+		}
+
+		if seen[c.val] {
+			error_at(c.tok, "duplicate case value: %d", c.val)
+		}
+		seen[c.val] = true
+	}
+}
+
+// Initializers
+//
+// An initializer of a variable is flattened to a list of ND_INIT
+// nodes, each of which initializes one scalar member at an offset
+// from the beginning of the variable. Braces may be omitted for
+// nested aggregates as the C standard allows.
+
+func new_init(ty *Type, off int, expr *Node) *Node {
+	node := new(Node)
+	node.op = ND_INIT
+	node.ty = ty
+	node.offset = off
+	node.expr = expr
+	return node
+}
+
+func is_aggregate(ty *Type) bool {
+	return ty.ty == ARY || ty.ty == STRUCT
+}
+
+func is_string_init(ty *Type, node *Node) bool {
+	return ty.ty == ARY && ty.ary_of.ty == CHAR && node.op == ND_STR
+}
+
+// Walks all expressions in an initializer list except string literals.
+// String literals are left as-is because they can initialize a char
+// array as well as a pointer.
+func walk_init(node *Node) *Node {
+	if node.op == ND_STR {
+		return node
+	}
+	if node.op == ND_DESIG {
+		if node.expr != nil {
+			node.expr = walk(node.expr, true)
+		}
+		node.init = walk_init(node.init)
+		return node
+	}
+	if node.op != ND_INIT_LIST {
+		return walk(node, true)
+	}
+	for i := 0; i < node.stmts.len; i++ {
+		node.stmts.data[i] = walk_init(node.stmts.data[i].(*Node))
+	}
+	return node
+}
+
+func string_init(v *Vector, ty *Type, off int, node *Node) {
+	n := node.len + 1 // +1 is '\0'
+	if ty.len < 0 {
+		*ty = *ary_of(ty.ary_of, n)
+	}
+	if ty.len < n {
+		n = ty.len
+	}
+	for i := 0; i < n; i++ {
+		c := 0
+		if i < node.len {
+			c = int(node.data[i])
+		}
+		vec_push(v, new_init(ty.ary_of, off+i, new_int(c)))
+	}
+}
+
+// Reads an initializer for a single object of a given type.
+func init_value(v *Vector, ty *Type, off int, node *Node) {
+	if node.op == ND_INIT_LIST {
+		if !is_aggregate(ty) {
+			if node.stmts.len == 0 {
+				error_at(node.tok, "empty scalar initializer")
+				return
+			}
+			init_value(v, ty, off, node.stmts.data[0].(*Node))
+			return
+		}
+
+		// char s[] = {"abc"}
+		if node.stmts.len == 1 && is_string_init(ty, node.stmts.data[0].(*Node)) {
+			string_init(v, ty, off, node.stmts.data[0].(*Node))
+			return
+		}
+
+		i := 0
+		init_aggregate(v, ty, off, node, &i, true)
+		if i < node.stmts.len {
+			error_at(node.stmts.data[i].(*Node).tok, "excess elements in initializer")
+		}
+		return
+	}
+
+	if is_string_init(ty, node) {
+		string_init(v, ty, off, node)
+		return
+	}
+
+	if node.op == ND_STR {
+		node = walk(node, true)
+	}
+	if is_err(node) {
+		return
+	}
+	if ty.ty == ARY || (ty.ty == STRUCT && node.ty.ty != STRUCT) {
+		error_at(node.tok, "invalid initializer")
+		return
+	}
+	check_int_conv(node, ty, "initialization")
+	vec_push(v, new_init(ty, off, conv(node, ty)))
+}
+
+// Reads initializers for members of an aggregate type from a list
+// starting at the i'th element. If braced is false, the aggregate is
+// a member whose braces are omitted. Such a member ends before a
+// designator because designators refer to the braced object.
+func init_aggregate(v *Vector, ty *Type, off int, list *Node, i *int, braced bool) {
+	if ty.ty == ARY {
+		size := ty.ary_of.size
+		n, max := 0, 0
+		for *i < list.stmts.len {
+			node := list.stmts.data[*i].(*Node)
+			if node.op == ND_DESIG {
+				if !braced {
+					break
+				}
+				n = desig_index(ty, node)
+				*i++
+				if n < 0 {
+					continue
+				}
+				init_desig(v, ty.ary_of, off+size*n, node.init)
+			} else {
+				if ty.len >= 0 && n >= ty.len {
+					break
+				}
+				init_member(v, ty.ary_of, off+size*n, list, i)
+			}
+			n++
+			if max < n {
+				max = n
+			}
+		}
+		if ty.len < 0 {
+			*ty = *ary_of(ty.ary_of, max)
+		}
+		return
+	}
+
+	// assert(ty.ty == STRUCT)
+	if ty.members == nil {
+		error_at(list.tok, "initialization of incomplete type")
+		*i = list.stmts.len
+		return
+	}
+	for j := 0; *i < list.stmts.len; j++ {
+		node := list.stmts.data[*i].(*Node)
+		if node.op == ND_DESIG {
+			if !braced {
+				break
+			}
+			j = desig_member(ty, node)
+			*i++
+			if j < 0 {
+				continue
+			}
+			m := ty.members.data[j].(*Node)
+			init_desig(v, m.ty, off+m.ty.offset, node.init)
+			continue
+		}
+
+		// Only one member of a union can be initialized.
+		if j >= ty.members.len || ty.is_union && j > 0 {
+			break
+		}
+		m := ty.members.data[j].(*Node)
+		init_member(v, m.ty, off+m.ty.offset, list, i)
+	}
+}
+
+// Returns the array index designated by a given designator, or -1 on
+// error.
+func desig_index(ty *Type, node *Node) int {
+	if ty.ty != ARY || node.expr == nil {
+		error_at(node.tok, "field name not in record or union initializer")
+		return -1
+	}
+	if is_err(node.expr) {
+		return -1
+	}
+	idx, ok := eval(node.expr)
+	if !ok {
+		error_at(node.tok, "nonconstant array index in initializer")
+		return -1
+	}
+	if idx < 0 || (ty.len >= 0 && idx >= ty.len) {
+		error_at(node.tok, "array index in initializer exceeds array bounds")
+		return -1
+	}
+	return idx
+}
+
+// Returns the index of the struct member designated by a given
+// designator, or -1 on error.
+func desig_member(ty *Type, node *Node) int {
+	if ty.ty != STRUCT || node.expr != nil {
+		error_at(node.tok, "array index in non-array initializer")
+		return -1
+	}
+	if ty.members == nil {
+		error_at(node.tok, "initialization of incomplete type")
+		return -1
+	}
+	for j := 0; j < ty.members.len; j++ {
+		if ty.members.data[j].(*Node).name == node.name {
+			return j
+		}
+	}
+	error_at(node.tok, "unknown field '%s' specified in initializer", node.name)
+	return -1
+}
+
+// Reads the rest of a chained designator such as `[2].b` in `.a[2].b = 1`.
+func init_desig(v *Vector, ty *Type, off int, node *Node) {
+	if node.op != ND_DESIG {
+		init_value(v, ty, off, node)
+		return
+	}
+
+	if ty.ty == ARY {
+		idx := desig_index(ty, node)
+		if idx >= 0 {
+			init_desig(v, ty.ary_of, off+ty.ary_of.size*idx, node.init)
+		}
+		return
+	}
+
+	j := desig_member(ty, node)
+	if j < 0 {
+		return
+	}
+	m := ty.members.data[j].(*Node)
+	init_desig(v, m.ty, off+m.ty.offset, node.init)
+}
+
+// Reads an initializer for a member. If the member is an aggregate
+// and the next element is not enclosed in braces, the following
+// elements are used to initialize the members of the member.
+func init_member(v *Vector, ty *Type, off int, list *Node, i *int) {
+	node := list.stmts.data[*i].(*Node)
+	if !is_aggregate(ty) || node.op == ND_INIT_LIST || is_string_init(ty, node) ||
+		(ty.ty == STRUCT && node.op != ND_STR && node.ty.ty == STRUCT) {
+		*i++
+		init_value(v, ty, off, node)
+		return
+	}
+	init_aggregate(v, ty, off, list, i, false)
+}
+
+// Flattens an initializer of a variable. If the variable is an array
+// of unknown length, the length is determined by the initializer.
+func flatten_init(node *Node) *Vector {
+	if node.ty.ty == ARY && node.ty.len < 0 {
+		node.ty = ary_of(node.ty.ary_of, -1)
+	}
+
+	v := new_vec()
+	init_value(v, node.ty, 0, walk_init(node.init))
+	if node.ty.len < 0 {
+		error_at(node.tok, "array size missing in '%s'", node.name)
+	}
+	return v
+}
+
+// Returns the address of a global lvalue as a label and an offset.
+func eval_addr(node *Node) (string, int) {
+	switch node.op {
+	case ND_GVAR:
+		return node.name, 0
+	case ND_DOT:
+		{
+			label, off := eval_addr(node.expr)
+			return label, off + node.offset
+		}
+	case ND_DEREF:
+		return eval_reloc(node.expr)
+	}
+	error_at(node.tok, "initializer element is not constant")
+	return "", 0
+}
+
+// Evaluates an initializer of a global variable. The result is either
+// an integer constant or an address of a label plus an offset.
+func eval_reloc(node *Node) (string, int) {
+	if val, ok := eval(node); ok {
+		return "", val
+	}
+
+	switch node.op {
+	case ND_ADDR:
+		return eval_addr(node.expr)
+	case ND_CAST:
+		if node.ty.size == 8 {
+			return eval_reloc(node.expr)
+		}
+	case '+', '-':
+		{
+			label, off := eval_reloc(node.lhs)
+			val, ok := eval(node.rhs)
+			if label == "" || !ok {
+				break
+			}
+			if node.op == '-' {
+				val = -val
+			}
+			return label, off + val
+		}
+	}
+	error_at(node.tok, "initializer element is not constant")
+	return "", 0
+}
+
+func global_init(node *Node) *Vector {
+	v := flatten_init(node)
+	for i := 0; i < v.len; i++ {
+		init := v.data[i].(*Node)
+		if is_err(init.expr) {
+			continue
+		}
+		if init.ty.ty == STRUCT {
+			error_at(init.expr.tok, "initializer element is not constant")
+			continue
+		}
+
+		// A floating-point number is emitted as its bit pattern.
+		if is_flonum(init.ty) {
+			f, ok := eval_flonum(init.expr)
+			if !ok {
+				error_at(init.expr.tok, "initializer element is not constant")
+			}
+			if init.ty.ty == FLOAT {
+				init.val = int(math.Float32bits(float32(f)))
+			} else {
+				init.val = int(math.Float64bits(f))
+			}
+			continue
+		}
+
+		init.name, init.val = eval_reloc(init.expr)
+		if init.name != "" && init.ty.size != 8 {
+			error_at(init.expr.tok, "initializer element is not computable at load time")
+		}
+		if init.name == "" {
+			init.val = wrap_int(init.val, init.ty)
+		}
+	}
+	return v
+}
+
+// Labels have function scope, so a goto can refer to a label that
+// appears later in the function. Gotos are resolved after the whole
+// function body is visited.
+func resolve_gotos() {
+	for i := 0; i < gotos.len; i++ {
+		node := gotos.data[i].(*Node)
+		target := map_get(labels, node.name)
+		if target == nil {
+			error_at(node.tok, "use of undeclared label: %s", node.name)
+			continue
+		}
+		node.target = target.(*Node)
+	}
+}
+
+// These library functions never return.
+var noreturn_fns = map[string]bool{"exit": true, "_Exit": true, "abort": true}
+
+// Returns true if a break statement in a given statement exits the
+// statement. Breaks in nested loops and switches are not counted.
+func has_break(node *Node) bool {
+	if node == nil {
+		return false
+	}
+	switch node.op {
+	case ND_BREAK:
+		return true
+	case ND_COMP_STMT:
+		for i := 0; i < node.stmts.len; i++ {
+			if has_break(node.stmts.data[i].(*Node)) {
+				return true
+			}
+		}
+	case ND_IF:
+		return has_break(node.then) || has_break(node.els)
+	case ND_CASE, ND_DEFAULT, ND_LABEL:
+		return has_break(node.body)
+	}
+	return false
+}
+
+// Returns true if a continue statement in a given statement continues
+// the enclosing loop. Continues in nested loops are not counted.
+func has_continue(node *Node) bool {
+	if node == nil {
+		return false
+	}
+	switch node.op {
+	case ND_CONTINUE:
+		return true
+	case ND_COMP_STMT:
+		for i := 0; i < node.stmts.len; i++ {
+			if has_continue(node.stmts.data[i].(*Node)) {
+				return true
+			}
+		}
+	case ND_IF:
+		return has_continue(node.then) || has_continue(node.els)
+	case ND_SWITCH, ND_CASE, ND_DEFAULT, ND_LABEL:
+		return has_continue(node.body)
+	}
+	return false
+}
+
+func is_const_true(node *Node) bool {
+	if node == nil {
+		return true
+	}
+	val, ok := eval(node)
+	return ok && val != 0
+}
+
+// Returns true if control may reach the end of a given statement.
+// This is conservative: a statement is assumed to fall through
+// unless it is obviously not.
+func falls_through(node *Node) bool {
+	switch node.op {
+	case ND_RETURN, ND_GOTO:
+		return false
+	case ND_COMP_STMT:
+		if node.stmts.len == 0 {
+			return true
+		}
+		return falls_through(node.stmts.data[node.stmts.len-1].(*Node))
+	case ND_IF:
+		return node.els == nil || falls_through(node.then) || falls_through(node.els)
+	case ND_FOR:
+		return !is_const_true(node.cond) || has_break(node.body)
+	case ND_DO_WHILE:
+		// The body runs at least once, so the condition is evaluated
+		// only if the body can complete.
+		if has_break(node.body) {
+			return true
+		}
+		return (falls_through(node.body) || has_continue(node.body)) && !is_const_true(node.cond)
+	case ND_SWITCH:
+		for i := 0; i < node.cases.len; i++ {
+			if node.cases.data[i].(*Node).op == ND_DEFAULT {
+				return has_break(node.body) || falls_through(node.body)
+			}
+		}
+		return true
+	case ND_CASE, ND_DEFAULT, ND_LABEL:
+		return falls_through(node.body)
+	case ND_EXPR_STMT:
+		e := node.expr
+		return e.op != ND_CALL || e.expr != nil || !noreturn_fns[e.name]
+	}
+	return true
+}
+
 func walk(node *Node, decay bool) *Node {
 	switch node.op {
-	case ND_NUM, ND_NULL, ND_BREAK:
+	case ND_NUM, ND_NULL:
+		return node
+	case ND_BREAK:
+		if nloops == 0 && nswitches == 0 {
+			error_at(node.tok, "stray 'break' statement")
+		}
+		return node
+	case ND_CONTINUE:
+		if nloops == 0 {
+			error_at(node.tok, "stray 'continue' statement")
+		}
 		return node
 	case ND_STR:
 		{
 			// A string literal is converted to a reference to an anonymous
 			// global variable of type char array.
 			v := new_global(node.ty, format(".L.str%d", str_label), node.data, node.len)
+			v.is_static = true
 			str_label++
 			vec_push(globals, v)
 
@@ -122,20 +755,28 @@ func walk(node *Node, decay bool) *Node {
 			ret.op = ND_GVAR
 			ret.ty = node.ty
 			ret.name = v.name
+			ret.tok = node.tok
 			return maybe_decay(ret, decay)
 		}
 	case ND_IDENT:
 		{
 			v := find_var(node.name)
 			if v == nil {
-				error("undefined variable: %s", node.name)
+				// Declared with the error type so that it is reported once.
+				error_at(node.tok, "undefined variable: %s", node.name)
+				v = new(Var)
+				v.ty = err_tyf()
+				v.is_local = true
+				map_put(env.vars, node.name, v)
 			}
+			v.used = true
 
 			if v.is_local {
 				ret := new(Node)
 				ret.op = ND_LVAR
 				ret.offset = v.offset
 				ret.ty = v.ty
+				ret.tok = node.tok
 				return maybe_decay(ret, decay)
 			}
 
@@ -143,26 +784,60 @@ func walk(node *Node, decay bool) *Node {
 			ret.op = ND_GVAR
 			ret.ty = v.ty
 			ret.name = v.name
+			ret.tok = node.tok
 			return maybe_decay(ret, decay)
 		}
 	case ND_VARDEF:
 		{
+			if !node.is_extern {
+				check_shadow(node)
+			}
+
+			// A static local variable is a global variable with a
+			// unique name. An extern declaration refers to a global
+			// variable.
+			if node.is_static {
+				v := new_global(node.ty, format(".L.%s.%d", node.name, static_label), "", 0)
+				static_label++
+				v.is_static = true
+				v.tok = node.tok
+				if node.init != nil {
+					v.inits = global_init(node)
+				}
+				vec_push(globals, v)
+				add_local(v)
+				map_put(env.vars, node.name, v)
+				return &null_stmt
+			}
+			if node.is_extern {
+				map_put(env.vars, node.name, declare_global(node))
+				return &null_stmt
+			}
+
+			if node.init != nil {
+				node.inits = flatten_init(node)
+			}
+
+			// A struct is passed and returned in 8-byte chunks,
+			// so its slot is rounded up to a multiple of 8 bytes.
 			stacksize = roundup(stacksize, node.ty.align)
-			stacksize += node.ty.size
+			if node.ty.ty == STRUCT {
+				stacksize += roundup(node.ty.size, 8)
+			} else {
+				stacksize += node.ty.size
+			}
 			node.offset = stacksize
 			v := new(Var)
 			v.ty = node.ty
 			v.is_local = true
 			v.offset = stacksize
+			v.tok = node.tok
+			add_local(v)
 			map_put(env.vars, node.name, v)
-
-			if node.init != nil {
-				node.init = walk(node.init, true)
-			}
 			return node
 		}
 	case ND_IF:
-		node.cond = walk(node.cond, true)
+		node.cond = as_cond(walk(node.cond, true))
 		node.then = walk(node.then, true)
 		if node.els != nil {
 			node.els = walk(node.els, true)
@@ -172,34 +847,90 @@ func walk(node *Node, decay bool) *Node {
 		env = new_env(env)
 		node.init = walk(node.init, true)
 		if node.cond != nil {
-			node.cond = walk(node.cond, true)
+			node.cond = as_cond(walk(node.cond, true))
 		}
 		if node.inc != nil {
 			node.inc = walk(node.inc, true)
 		}
+		nloops++
 		node.body = walk(node.body, true)
+		nloops--
 		env = env.next
 		return node
 	case ND_DO_WHILE:
+		node.cond = as_cond(walk(node.cond, true))
+		nloops++
+		node.body = walk(node.body, true)
+		nloops--
+		return node
+	case ND_SWITCH:
 		node.cond = walk(node.cond, true)
+		if !is_integer(node.cond.ty) && !is_err(node.cond) {
+			error_at(node.cond.tok, "switch quantity is not an integer")
+		}
+		node.cond = conv(node.cond, int_promote(node.cond.ty))
+		nswitches++
+		node.body = walk(node.body, true)
+		nswitches--
+		check_cases(node)
+		return node
+	case ND_CASE:
+		{
+			node.expr = walk(node.expr, true)
+			val, ok := eval(node.expr)
+			if !ok && !is_err(node.expr) {
+				error_at(node.tok, "case label does not reduce to an integer constant")
+			}
+			node.val = val
+			node.body = walk(node.body, true)
+			return node
+		}
+	case ND_DEFAULT:
+		node.body = walk(node.body, true)
+		return node
+	case ND_LABEL:
+		if map_get(labels, node.name) != nil {
+			error_at(node.tok, "duplicate label: %s", node.name)
+		}
+		map_put(labels, node.name, node)
 		node.body = walk(node.body, true)
 		return node
+	case ND_GOTO:
+		vec_push(gotos, node)
+		return node
 	case '+', '-':
 		node.lhs = walk(node.lhs, true)
 		node.rhs = walk(node.rhs, true)
+		if has_err(node) {
+			node.ty = err_tyf()
+			return node
+		}
 
-		if node.rhs.ty.ty == PTR {
+		// The difference of two pointers is the number of elements
+		// between them.
+		if node.op == '-' && node.lhs.ty.ty == PTR && node.rhs.ty.ty == PTR {
+			node.ty = long_tyf()
+			ret := new_binop('/', node, new_int(node.lhs.ty.ptr_to.size))
+			ret.ty = long_tyf()
+			return ret
+		}
+
+		if node.op == '+' && node.rhs.ty.ty == PTR {
 			swap(&node.lhs, &node.rhs)
 		}
 		if node.rhs.ty.ty == PTR {
-			error("pointer %c pointer' is not defined", node.op)
+			error_at(node.tok, "invalid operands to binary %c", node.op)
+			node.ty = err_tyf()
+			return node
 		}
 
 		if node.lhs.ty.ty == PTR {
 			node.rhs = scale_ptr(node.rhs, node.lhs.ty)
+			node.ty = node.lhs.ty
+			return node
 		}
 
-		node.ty = node.lhs.ty
+		node.ty = binop_conv(node)
 		return node
 	case ND_ADD_EQ, ND_SUB_EQ:
 		node.lhs = walk(node.lhs, false)
@@ -209,24 +940,56 @@ func walk(node *Node, decay bool) *Node {
 
 		if node.lhs.ty.ty == PTR {
 			node.rhs = scale_ptr(node.rhs, node.lhs.ty)
+			return node
+		}
+		if is_arith(node.lhs.ty) && is_arith(node.rhs.ty) {
+			node.rhs = conv(node.rhs, arith_conv(node.lhs.ty, node.rhs.ty))
 		}
 		return node
-	case '=', ND_MUL_EQ, ND_DIV_EQ, ND_MOD_EQ, ND_SHL_EQ, ND_SHR_EQ, ND_BITAND_EQ, ND_XOR_EQ, ND_BITOR_EQ:
+	case '=':
 		node.lhs = walk(node.lhs, false)
 		check_lval(node.lhs)
 		node.rhs = walk(node.rhs, true)
+		check_int_conv(node.rhs, node.lhs.ty, "assignment")
+		node.rhs = conv(node.rhs, node.lhs.ty)
+		node.ty = node.lhs.ty
+		return node
+	case ND_MUL_EQ, ND_DIV_EQ, ND_MOD_EQ, ND_BITAND_EQ, ND_XOR_EQ, ND_BITOR_EQ:
+		node.lhs = walk(node.lhs, false)
+		check_lval(node.lhs)
+		node.rhs = walk(node.rhs, true)
+		node.ty = node.lhs.ty
+		if node.op != ND_MUL_EQ && node.op != ND_DIV_EQ {
+			check_integer(node)
+		}
+		if is_arith(node.lhs.ty) && is_arith(node.rhs.ty) {
+			node.rhs = conv(node.rhs, arith_conv(node.lhs.ty, node.rhs.ty))
+		}
+		return node
+	case ND_SHL_EQ, ND_SHR_EQ:
+		node.lhs = walk(node.lhs, false)
+		check_lval(node.lhs)
+		node.rhs = walk(node.rhs, true)
+		check_integer(node)
+		node.rhs = conv(node.rhs, int_promote(node.rhs.ty))
 		node.ty = node.lhs.ty
 		return node
 
 	case ND_DOT:
 		node.expr = walk(node.expr, true)
+		node.ty = err_tyf()
+		if is_err(node.expr) {
+			return node
+		}
 		if node.expr.ty.ty != STRUCT {
-			error("struct expected before '.'")
+			error_at(node.tok, "struct expected before '.'")
+			return node
 		}
 
 		ty := node.expr.ty
 		if ty.members == nil {
-			error("incomplete type")
+			error_at(node.tok, "incomplete type")
+			return node
 		}
 		for i := 0; i < ty.members.len; i++ {
 			m := ty.members.data[i].(*Node)
@@ -237,73 +1000,207 @@ func walk(node *Node, decay bool) *Node {
 			node.offset = m.ty.offset
 			return maybe_decay(node, decay)
 		}
-		error("member missing: %s", node.name)
+		error_at(node.tok, "member missing: %s", node.name)
+		return node
 	case '?':
-		node.cond = walk(node.cond, true)
+		node.cond = as_cond(walk(node.cond, true))
 		node.then = walk(node.then, true)
 		node.els = walk(node.els, true)
 		node.ty = node.then.ty
+		if is_arith(node.then.ty) && is_arith(node.els.ty) {
+			node.ty = arith_conv(node.then.ty, node.els.ty)
+			node.then = conv(node.then, node.ty)
+			node.els = conv(node.els, node.ty)
+		}
+		return node
+	case '*', '/', '%', '|', '^', '&':
+		node.lhs = walk(node.lhs, true)
+		node.rhs = walk(node.rhs, true)
+		if node.op != '*' && node.op != '/' {
+			check_integer(node)
+		}
+		node.ty = binop_conv(node)
+		return node
+	case '<', ND_EQ, ND_NE, ND_LE:
+		node.lhs = walk(node.lhs, true)
+		node.rhs = walk(node.rhs, true)
+		check_sign_compare(node)
+		binop_conv(node)
+		node.ty = int_tyf()
 		return node
-	case '*', '/', '%', '<', '|', '^', '&', ND_EQ, ND_NE, ND_LE, ND_SHL, ND_SHR, ND_LOGAND, ND_LOGOR:
+	case ND_SHL, ND_SHR:
 		node.lhs = walk(node.lhs, true)
 		node.rhs = walk(node.rhs, true)
+		check_integer(node)
+		node.lhs = conv(node.lhs, int_promote(node.lhs.ty))
+		node.rhs = conv(node.rhs, int_promote(node.rhs.ty))
 		node.ty = node.lhs.ty
 		return node
+	case ND_LOGAND, ND_LOGOR:
+		node.lhs = as_cond(walk(node.lhs, true))
+		node.rhs = as_cond(walk(node.rhs, true))
+		node.ty = int_tyf()
+		return node
 	case ',':
 		node.lhs = walk(node.lhs, true)
 		node.rhs = walk(node.rhs, true)
 		node.ty = node.rhs.ty
 		return node
-	case ND_POST_INC, ND_POST_DEC, ND_NEG, '!', '~':
+	case ND_POST_INC, ND_POST_DEC:
 		node.expr = walk(node.expr, true)
 		node.ty = node.expr.ty
 		return node
-	case ND_ADDR:
+	case ND_NEG, '~':
+		node.expr = walk(node.expr, true)
+		if node.op == '~' {
+			check_integer(node)
+		}
+		node.expr = conv(node.expr, int_promote(node.expr.ty))
+		node.ty = node.expr.ty
+		return node
+	case '!':
+		node.expr = as_cond(walk(node.expr, true))
+		node.ty = int_tyf()
+		return node
+	case ND_CAST:
 		node.expr = walk(node.expr, true)
+		if is_err(node.expr) {
+			return node
+		}
+		if node.ty.ty == STRUCT || node.expr.ty.ty == STRUCT {
+			error_at(node.tok, "invalid cast to or from a struct")
+		} else if is_flonum(node.ty) && !is_arith(node.expr.ty) || is_flonum(node.expr.ty) && !is_arith(node.ty) {
+			error_at(node.tok, "invalid cast between a pointer and a floating-point number")
+		}
+		return node
+	case ND_ADDR:
+		node.expr = walk(node.expr, false)
+		if node.expr.ty.ty == FUNC {
+			// &func is the same as func.
+			return maybe_decay(node.expr, true)
+		}
 		check_lval(node.expr)
 		node.ty = ptr_to(node.expr.ty)
 		return node
 	case ND_DEREF:
 		node.expr = walk(node.expr, true)
+		node.ty = err_tyf()
+		if is_err(node.expr) {
+			return node
+		}
 
 		if node.expr.ty.ty != PTR {
-			error("operand must be a pointer")
+			error_at(node.tok, "operand must be a pointer")
+			return node
 		}
 
 		if node.expr.ty.ptr_to.ty == VOID {
-			error("cannot dereference void pointer")
+			error_at(node.tok, "cannot dereference void pointer")
+			return node
 		}
 
 		node.ty = node.expr.ty.ptr_to
 		return maybe_decay(node, decay)
-	case ND_RETURN, ND_EXPR_STMT:
+	case ND_RETURN:
+		node.expr = walk(node.expr, true)
+		if ret_ty != nil {
+			check_int_conv(node.expr, ret_ty, "return")
+			node.expr = conv(node.expr, ret_ty)
+		} else {
+			// A statement expression has type int.
+			node.expr = conv(node.expr, int_tyf())
+		}
+		return node
+	case ND_EXPR_STMT:
 		node.expr = walk(node.expr, true)
 		return node
 	case ND_SIZEOF:
 		{
 			expr := walk(node.expr, false)
-			return new_int(expr.ty.size)
+			return new_size(expr.ty.size)
 		}
 	case ND_ALIGNOF:
 		{
 			expr := walk(node.expr, false)
-			return new_int(expr.ty.align)
+			return new_size(expr.ty.align)
 		}
 	case ND_CALL:
 		{
-			v := find_var(node.name)
-			if v != nil && v.ty.ty == FUNC {
-				node.ty = v.ty.returning
+			// A variable holding a function pointer is called
+			// indirectly.
+			if node.expr == nil {
+				if v := find_var(node.name); v != nil && v.ty.ty != FUNC {
+					node.expr = new(Node)
+					node.expr.op = ND_IDENT
+					node.expr.name = node.name
+				}
+			}
+
+			var fn *Type
+			if node.expr != nil {
+				node.expr = walk(node.expr, true)
+				ty := node.expr.ty
+				if ty.ty == PTR && ty.ptr_to.ty == FUNC {
+					fn = ty.ptr_to
+				} else if ty.ty != ERR {
+					error_at(node.tok, "called object is not a function")
+				}
+			} else if v := find_var(node.name); v != nil {
+				fn = v.ty
 			} else {
-				fmt.Fprintf(os.Stderr, "bad function: %s\n", node.name)
-				node.ty = &int_ty
+				// An undeclared function is implicitly declared as
+				// a function returning int.
+				if map_get(implicit_fns, node.name) == nil {
+					warn(node.tok, "implicit-function-declaration", "implicit declaration of function '%s'", node.name)
+					map_put(implicit_fns, node.name, true)
+				}
+				fn = new(Type)
+				fn.ty = FUNC
+				fn.returning = int_tyf()
 			}
 
+			if fn != nil {
+				node.ty = fn.returning
+			} else {
+				node.ty = err_tyf()
+			}
+
+			// Arguments are converted to the parameter types. If there
+			// is no prototype, float arguments are promoted to double.
+			var params *Vector
+			if fn != nil {
+				params = fn.params
+			}
 			for i := 0; i < node.args.len; i++ {
-				node.args.data[i] = walk(node.args.data[i].(*Node), true)
+				arg := walk(node.args.data[i].(*Node), true)
+				if params != nil && i < params.len {
+					check_int_conv(arg, params.data[i].(*Type), format("passing argument %d of '%s'", i+1, node.name))
+					arg = conv(arg, params.data[i].(*Type))
+				} else if arg.ty.ty == FLOAT {
+					arg = conv(arg, double_tyf())
+				}
+				node.args.data[i] = arg
 			}
 			return node
 		}
+	case ND_VA_START:
+		node.expr = walk(node.expr, true)
+		if !is_variadic {
+			error_at(node.tok, "va_start used in function with fixed arguments")
+		}
+		node.ty = void_tyf()
+		return node
+	case ND_VA_ARG:
+		node.expr = walk(node.expr, true)
+		if node.ty.ty == STRUCT || node.ty.ty == ARY {
+			error_at(node.tok, "va_arg of an aggregate type is not supported")
+		}
+		return node
+	case ND_VA_COPY:
+		node.lhs = walk(node.lhs, true)
+		node.rhs = walk(node.rhs, true)
+		node.ty = void_tyf()
+		return node
 	case ND_COMP_STMT:
 		{
 			env = new_env(env)
@@ -314,45 +1211,152 @@ func walk(node *Node, decay bool) *Node {
 			return node
 		}
 	case ND_STMT_EXPR:
-		node.body = walk(node.body, true)
-		node.ty = &int_ty
-		return node
+		{
+			// "return" in a statement expression doesn't return from
+			// the function.
+			orig := ret_ty
+			ret_ty = nil
+			node.body = walk(node.body, true)
+			ret_ty = orig
+			node.ty = &int_ty
+			return node
+		}
 	default:
 		//assert(0 && "unknouwn node type")
 	}
 	return nil
 }
 
+func add_local(v *Var) {
+	if locals != nil {
+		vec_push(locals, v)
+	}
+}
+
+// Warns if a local variable hides a variable in an outer scope.
+func check_shadow(node *Node) {
+	if map_get(env.vars, node.name) != nil {
+		return
+	}
+	v := find_var(node.name)
+	if v == nil || v.ty.ty == FUNC || v.ty.ty == ERR {
+		return
+	}
+	if map_get(genv.vars, node.name) != v {
+		warn(node.tok, "shadow", "declaration of '%s' shadows a previous local", node.name)
+	} else {
+		warn(node.tok, "shadow", "declaration of '%s' shadows a global declaration", node.name)
+	}
+}
+
+// Declares a global variable or a function. All declarations of the
+// same name refer to one Var, which gets an initializer from the
+// declaration that has one. A variable declared without "extern" or
+// an initializer is a tentative definition, which is zero-filled if
+// no other definition is given.
+func declare_global(node *Node) *Var {
+	var inits *Vector
+	if node.op == ND_VARDEF && node.init != nil {
+		inits = global_init(node)
+	}
+
+	if v := map_get(genv.vars, node.name); v != nil {
+		v := v.(*Var)
+		if (v.ty.ty == FUNC) != (node.ty.ty == FUNC) {
+			error_at(node.tok, "'%s' redeclared as different kind of symbol", node.name)
+			return v
+		}
+		if v.ty.size != 0 && node.ty.size != 0 && v.ty.size != node.ty.size {
+			error_at(node.tok, "conflicting types for '%s'", node.name)
+			return v
+		}
+		if inits != nil {
+			if v.inits != nil {
+				error_at(node.tok, "redefinition of '%s'", node.name)
+			}
+			v.inits = inits
+		}
+		// An incomplete array type is completed by a later declaration.
+		if v.ty.size == 0 {
+			v.ty = node.ty
+		}
+		v.is_extern = v.is_extern && node.is_extern
+		v.is_static = v.is_static || node.is_static
+		return v
+	}
+
+	v := new_global(node.ty, node.name, "", 0)
+	v.is_extern = node.is_extern
+	v.is_static = node.is_static
+	v.inits = inits
+	if node.ty.ty != FUNC {
+		vec_push(globals, v)
+	}
+	map_put(genv.vars, node.name, v)
+	return v
+}
+
 func sema(nodes *Vector) *Vector {
 	env = new_env(nil)
+	genv = env
 	globals = new_vec()
+	implicit_fns = new_map()
 
 	for i := 0; i < nodes.len; i++ {
 		node := nodes.data[i].(*Node)
 
 		if node.op == ND_VARDEF {
-			v := new_global(node.ty, node.name, node.data, node.len)
-			v.is_extern = node.is_extern
-			vec_push(globals, v)
-			map_put(env.vars, node.name, v)
+			// A declaration without a type such as `x = 5;` has
+			// been reported by the parser. The variable is declared
+			// with the error type so that its uses are not reported.
+			if node.ty.ty == ERR {
+				if map_get(genv.vars, node.name) == nil {
+					map_put(genv.vars, node.name, new_global(node.ty, node.name, "", 0))
+				}
+				continue
+			}
+			declare_global(node)
 			continue
 		}
 
 		//assert(node.op == ND_FUNC || node.op == ND_FUNC)
 
-		v := new_global(node.ty, node.name, "", 0)
-		map_put(env.vars, node.name, v)
+		// A function declared static has internal linkage even if its
+		// definition doesn't say static.
+		v := declare_global(node)
+		node.is_static = v.is_static
 
 		if node.op == ND_DECL {
 			continue
 		}
 
 		stacksize = 0
+		ret_ty = node.ty.returning
+		is_variadic = node.ty.is_variadic
+		labels = new_map()
+		gotos = new_vec()
 
+		// Parameters have their own scope, and they are not checked
+		// for unused variables.
+		env = new_env(genv)
+		locals = nil
 		for i := 0; i < node.args.len; i++ {
 			node.args.data[i] = walk(node.args.data[i].(*Node), true)
 		}
+		locals = new_vec()
 		node.body = walk(node.body, true)
+		env = genv
+		resolve_gotos()
+
+		for i := 0; i < locals.len; i++ {
+			v := locals.data[i].(*Var)
+			if !v.used {
+				warn(v.tok, "unused-variable", "unused variable '%s'", v.tok.name)
+			}
+		}
+		if ret_ty.ty != VOID && node.name != "main" && falls_through(node.body) {
+			warn(node.tok, "return-type", "control reaches end of non-void function")
+		}
 
 		node.stacksize = stacksize
 	}
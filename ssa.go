@@ -0,0 +1,625 @@
+package main
+
+// SSA form
+//
+// With -O1, the IR of each function is converted to static single
+// assignment form, optimized, and converted back before register
+// allocation. In SSA form, every register is written by exactly one
+// instruction. Where different definitions of a register meet, a phi
+// node at the beginning of the block selects one of them depending on
+// the predecessor that control came from.
+//
+// Most IR instructions update lhs in place. In SSA form, they write
+// their results to dst instead, so that lhs keeps its old value.
+//
+// Local variables whose addresses are never taken are moved from
+// stack slots to registers before the conversion, so that their
+// values take part in the optimization.
+
+import "sort"
+
+// Returns the register operands of an instruction in SSA form. An
+// operand that is updated in place is split into a use of lhs and a
+// definition of dst.
+func ssa_operands(ir *IR) []Operand {
+	if ir.op == IR_PHI {
+		v := []Operand{{&ir.lhs, ir.is_fp, false, true}}
+		for i := range ir.args {
+			v = append(v, Operand{&ir.args[i], ir.is_fp, true, false})
+		}
+		return v
+	}
+
+	var v []Operand
+	for _, op := range operands(ir) {
+		if op.is_use && op.is_def {
+			v = append(v, Operand{op.r, op.is_fp, true, false})
+			v = append(v, Operand{&ir.dst, op.is_fp, false, true})
+			continue
+		}
+		v = append(v, op)
+	}
+	return v
+}
+
+// Returns the register written by an instruction in SSA form, or nil.
+func ssa_def(ir *IR) *Operand {
+	for _, op := range ssa_operands(ir) {
+		if op.is_def {
+			return &op
+		}
+	}
+	return nil
+}
+
+func is_two_address(ir *IR) bool {
+	for _, op := range operands(ir) {
+		if op.is_use && op.is_def {
+			return true
+		}
+	}
+	return false
+}
+
+func new_mov(dst, src int, is_fp bool) *IR {
+	if is_fp {
+		return &IR{op: IR_FMOV, lhs: dst, rhs: src}
+	}
+	return &IR{op: IR_MOV, lhs: dst, rhs: src}
+}
+
+// Returns the number of labels and phi nodes at the beginning of a
+// block.
+func bb_head(bb *BB) int {
+	i := 0
+	for i < bb.ir.len {
+		op := bb.ir.data[i].(*IR).op
+		if op != IR_LABEL && op != IR_PHI {
+			break
+		}
+		i++
+	}
+	return i
+}
+
+// Inserts an instruction at the end of a block, before a jump if any.
+func append_before_jump(bb *BB, ir *IR) {
+	if bb.ir.len == 0 || !is_terminator(vec_last(bb.ir).(*IR)) {
+		vec_push(bb.ir, ir)
+		return
+	}
+	last := vec_pop(bb.ir)
+	vec_push(bb.ir, ir)
+	vec_push(bb.ir, last)
+}
+
+// Dominators
+
+func postorder(bb *BB, seen map[*BB]bool, order *[]*BB) {
+	seen[bb] = true
+	for i := 0; i < bb.succ.len; i++ {
+		if s := bb.succ.data[i].(*BB); !seen[s] {
+			postorder(s, seen, order)
+		}
+	}
+	*order = append(*order, bb)
+}
+
+// Computes the immediate dominator of each block by the algorithm of
+// Cooper, Harvey and Kennedy. The result is indexed by block ids. The
+// entry block is its own immediate dominator.
+func dominators(bbs *Vector) []*BB {
+	var order []*BB
+	postorder(bbs.data[0].(*BB), make(map[*BB]bool), &order)
+	num := make([]int, bbs.len)
+	for i, bb := range order {
+		num[bb.id] = i
+	}
+
+	idom := make([]*BB, bbs.len)
+	entry := bbs.data[0].(*BB)
+	idom[entry.id] = entry
+
+	intersect := func(a, b *BB) *BB {
+		for a != b {
+			for num[a.id] < num[b.id] {
+				a = idom[a.id]
+			}
+			for num[b.id] < num[a.id] {
+				b = idom[b.id]
+			}
+		}
+		return a
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for i := len(order) - 2; i >= 0; i-- {
+			bb := order[i]
+			var x *BB
+			for j := 0; j < bb.pred.len; j++ {
+				p := bb.pred.data[j].(*BB)
+				if idom[p.id] == nil {
+					continue
+				}
+				if x == nil {
+					x = p
+				} else {
+					x = intersect(p, x)
+				}
+			}
+			if idom[bb.id] != x {
+				idom[bb.id] = x
+				changed = true
+			}
+		}
+	}
+	return idom
+}
+
+// Returns the children of each block in the dominator tree.
+func dom_tree(bbs *Vector, idom []*BB) [][]*BB {
+	kids := make([][]*BB, bbs.len)
+	for i := 1; i < bbs.len; i++ {
+		bb := bbs.data[i].(*BB)
+		kids[idom[bb.id].id] = append(kids[idom[bb.id].id], bb)
+	}
+	return kids
+}
+
+// Returns the dominance frontier of each block.
+func frontiers(bbs *Vector, idom []*BB) [][]*BB {
+	df := make([][]*BB, bbs.len)
+	for i := 0; i < bbs.len; i++ {
+		bb := bbs.data[i].(*BB)
+		if bb.pred.len < 2 {
+			continue
+		}
+		for j := 0; j < bb.pred.len; j++ {
+			for x := bb.pred.data[j].(*BB); x != idom[bb.id]; x = idom[x.id] {
+				if len(df[x.id]) == 0 || df[x.id][len(df[x.id])-1] != bb {
+					df[x.id] = append(df[x.id], bb)
+				}
+			}
+		}
+	}
+	return df
+}
+
+// Adds an empty entry block if the first block is a target of a jump,
+// so that the entry block has no predecessors.
+func ensure_entry(fn *Function) {
+	if fn.bbs.data[0].(*BB).pred.len == 0 {
+		return
+	}
+	v := new_vec()
+	vec_push(v, new_bb())
+	for i := 0; i < fn.bbs.len; i++ {
+		vec_push(v, fn.bbs.data[i])
+	}
+	fn.bbs = link_bbs(v)
+}
+
+// Promotion of local variables
+
+// Promotes local variables to registers. A variable is promoted if it
+// is a scalar and its stack slot is accessed only by loads and stores
+// of its size through addresses made by BPREL. This runs on SSA form,
+// in which a register holding an address has no other value. Loads
+// and stores of a variable become copies from and to a new register,
+// which is not in SSA form yet. Returns the new registers.
+func mem2reg(fn *Function) map[int]bool {
+	type Slot struct {
+		size  int
+		is_fp bool
+		typed bool // is_fp is known
+		bad   bool
+		reg   int
+	}
+
+	slots := make(map[int]*Slot)
+	for off, size := range fn.lvars {
+		if size == 1 || size == 2 || size == 4 || size == 8 {
+			slots[off] = &Slot{size: size}
+		}
+	}
+
+	// Returns the slot that contains an address, or nil.
+	owner := func(off int) (int, *Slot) {
+		for o, s := range slots {
+			if o-s.size < off && off <= o {
+				return o, s
+			}
+		}
+		return 0, nil
+	}
+
+	access := func(s *Slot, size int, is_fp bool) {
+		if size != s.size || (s.typed && s.is_fp != is_fp) {
+			s.bad = true
+		}
+		s.is_fp = is_fp
+		s.typed = true
+	}
+
+	// Find registers that hold addresses of slots. Parameters are
+	// stored to their slots by *_ARG instructions.
+	addr := make(map[int]*Slot)
+	for i := 0; i < fn.bbs.len; i++ {
+		bb := fn.bbs.data[i].(*BB)
+		for j := 0; j < bb.ir.len; j++ {
+			ir := bb.ir.data[j].(*IR)
+			switch ir.op {
+			case IR_BPREL:
+				if o, s := owner(ir.rhs); s != nil {
+					s.bad = s.bad || o != ir.rhs
+					addr[ir.lhs] = s
+				}
+			case IR_STORE_ARG, IR_FSTORE_ARG, IR_STORE_STACK_ARG:
+				if o, s := owner(ir.lhs); s != nil {
+					s.bad = s.bad || o != ir.lhs
+					if ir.op == IR_STORE_STACK_ARG {
+						s.bad = s.bad || ir.size != s.size
+					} else {
+						access(s, ir.size, ir.op == IR_FSTORE_ARG)
+					}
+				}
+			}
+		}
+	}
+
+	// Check that each address is used only by loads and stores.
+	for i := 0; i < fn.bbs.len; i++ {
+		bb := fn.bbs.data[i].(*BB)
+		for j := 0; j < bb.ir.len; j++ {
+			ir := bb.ir.data[j].(*IR)
+			for _, op := range ssa_operands(ir) {
+				s := addr[*op.r]
+				if s == nil || op.is_def {
+					continue
+				}
+				switch {
+				case ir.op == IR_LOAD && op.r == &ir.rhs:
+					access(s, ir.size, false)
+				case ir.op == IR_FLOAD && op.r == &ir.rhs:
+					access(s, ir.size, true)
+				case ir.op == IR_STORE && op.r == &ir.lhs:
+					access(s, ir.size, false)
+				case ir.op == IR_FSTORE && op.r == &ir.lhs:
+					access(s, ir.size, true)
+				default:
+					s.bad = true
+				}
+			}
+		}
+	}
+
+	var offs []int
+	for off, s := range slots {
+		if !s.bad && s.typed {
+			offs = append(offs, off)
+		}
+	}
+	if len(offs) == 0 {
+		return nil
+	}
+	sort.Ints(offs)
+	vars := make(map[int]bool)
+	for _, off := range offs {
+		slots[off].reg = nreg
+		vars[nreg] = true
+		nreg++
+	}
+
+	promoted := func(r int) *Slot {
+		if s := addr[r]; s != nil && !s.bad && s.typed {
+			return s
+		}
+		return nil
+	}
+
+	for i := 0; i < fn.bbs.len; i++ {
+		bb := fn.bbs.data[i].(*BB)
+		v := new_vec()
+		for j := 0; j < bb.ir.len; j++ {
+			ir := bb.ir.data[j].(*IR)
+			switch ir.op {
+			case IR_BPREL:
+				if promoted(ir.lhs) != nil {
+					continue
+				}
+			case IR_LOAD, IR_FLOAD:
+				s := promoted(ir.rhs)
+				if s == nil {
+					break
+				}
+				if s.is_fp || s.size == 8 {
+					vec_push(v, new_mov(ir.lhs, s.reg, s.is_fp))
+					continue
+				}
+				// Only the lower bytes of a variable are meaningful.
+				t := nreg
+				nreg++
+				vec_push(v, new_mov(t, s.reg, false))
+				vec_push(v, &IR{op: IR_CAST, lhs: t, dst: ir.lhs, size: s.size, is_unsigned: ir.is_unsigned})
+				continue
+			case IR_STORE, IR_FSTORE:
+				if s := promoted(ir.lhs); s != nil {
+					vec_push(v, new_mov(s.reg, ir.rhs, s.is_fp))
+					continue
+				}
+			}
+			vec_push(v, ir)
+		}
+		bb.ir = v
+	}
+
+	// Load promoted parameters after they are stored to the stack at
+	// the beginning of the entry block.
+	entry := fn.bbs.data[0].(*BB)
+	n := 0
+	for j := 0; j < entry.ir.len; j++ {
+		switch entry.ir.data[j].(*IR).op {
+		case IR_STORE_ARG, IR_FSTORE_ARG, IR_STORE_STACK_ARG:
+			n = j + 1
+		}
+	}
+
+	v := new_vec()
+	for j := 0; j < n; j++ {
+		vec_push(v, entry.ir.data[j])
+	}
+	for j := 0; j < n; j++ {
+		ir := entry.ir.data[j].(*IR)
+		if ir.op != IR_STORE_ARG && ir.op != IR_FSTORE_ARG && ir.op != IR_STORE_STACK_ARG {
+			continue
+		}
+		s := slots[ir.lhs]
+		if s == nil || s.bad || !s.typed {
+			continue
+		}
+		r := nreg
+		nreg++
+		vec_push(v, &IR{op: IR_BPREL, lhs: r, rhs: ir.lhs})
+		if s.is_fp {
+			vec_push(v, &IR{op: IR_FLOAD, lhs: s.reg, rhs: r, size: s.size})
+		} else {
+			vec_push(v, &IR{op: IR_LOAD, lhs: s.reg, rhs: r, size: s.size})
+		}
+	}
+	for j := n; j < entry.ir.len; j++ {
+		vec_push(v, entry.ir.data[j])
+	}
+	entry.ir = v
+	return vars
+}
+
+// Construction
+
+// Renames registers so that each of them is defined once, inserting
+// phi nodes where definitions meet. If regs is not nil, only the
+// registers in it are renamed. A register that is used before it is
+// defined gets zero.
+func rename_regs(fn *Function, regs map[int]bool) {
+	idom := dominators(fn.bbs)
+	kids := dom_tree(fn.bbs, idom)
+	df := frontiers(fn.bbs, idom)
+
+	// Find registers that are live across blocks and the blocks that
+	// define them.
+	defsites := make(map[int][]*BB)
+	is_fp := make(map[int]bool)
+	global := make(map[int]bool)
+	for i := 0; i < fn.bbs.len; i++ {
+		bb := fn.bbs.data[i].(*BB)
+		defined := make(map[int]bool)
+		for j := 0; j < bb.ir.len; j++ {
+			ops := ssa_operands(bb.ir.data[j].(*IR))
+			for _, op := range ops {
+				if op.is_use && !defined[*op.r] && (regs == nil || regs[*op.r]) {
+					global[*op.r] = true
+				}
+			}
+			for _, op := range ops {
+				r := *op.r
+				if op.is_def && !defined[r] && (regs == nil || regs[r]) {
+					defined[r] = true
+					defsites[r] = append(defsites[r], bb)
+					is_fp[r] = op.is_fp
+				}
+			}
+		}
+	}
+
+	var order []int
+	for r := range global {
+		order = append(order, r)
+	}
+	sort.Ints(order)
+
+	// Insert phi nodes at the iterated dominance frontier of the
+	// blocks that define a register.
+	phi_reg := make(map[*IR]int)
+	for _, r := range order {
+		has_phi := make(map[*BB]bool)
+		work := append([]*BB{}, defsites[r]...)
+		for len(work) > 0 {
+			bb := work[len(work)-1]
+			work = work[:len(work)-1]
+			for _, d := range df[bb.id] {
+				if has_phi[d] {
+					continue
+				}
+				has_phi[d] = true
+				phi := &IR{op: IR_PHI, lhs: r, is_fp: is_fp[r]}
+				phi.args = make([]int, d.pred.len)
+				for k := 0; k < d.pred.len; k++ {
+					phi.preds = append(phi.preds, d.pred.data[k].(*BB))
+				}
+				phi_reg[phi] = r
+				insert_phi(d, phi)
+				work = append(work, d)
+			}
+		}
+	}
+
+	// Rename definitions and uses in the order of the dominator tree.
+	stack := make(map[int][]int)
+	undef := make(map[int]int)
+	var undef_ir []*IR
+
+	top := func(r int, is_fp bool) int {
+		if s := stack[r]; len(s) > 0 {
+			return s[len(s)-1]
+		}
+		if u, ok := undef[r]; ok {
+			return u
+		}
+		u := nreg
+		nreg++
+		undef[r] = u
+		if is_fp {
+			undef_ir = append(undef_ir, &IR{op: IR_FIMM, lhs: u, size: 8})
+		} else {
+			undef_ir = append(undef_ir, &IR{op: IR_IMM, lhs: u})
+		}
+		return u
+	}
+
+	var rename func(bb *BB)
+	rename = func(bb *BB) {
+		var pushed []int
+		for i := 0; i < bb.ir.len; i++ {
+			ir := bb.ir.data[i].(*IR)
+			if r, ok := phi_reg[ir]; ok {
+				ir.lhs = nreg
+				nreg++
+				stack[r] = append(stack[r], ir.lhs)
+				pushed = append(pushed, r)
+				continue
+			}
+
+			ops := ssa_operands(ir)
+			for _, op := range ops {
+				if op.is_use && (regs == nil || regs[*op.r]) {
+					*op.r = top(*op.r, op.is_fp)
+				}
+			}
+			for _, op := range ops {
+				if op.is_def && (regs == nil || regs[*op.r]) {
+					r := *op.r
+					*op.r = nreg
+					nreg++
+					stack[r] = append(stack[r], *op.r)
+					pushed = append(pushed, r)
+				}
+			}
+		}
+
+		for i := 0; i < bb.succ.len; i++ {
+			s := bb.succ.data[i].(*BB)
+			for j := 0; j < s.ir.len; j++ {
+				phi := s.ir.data[j].(*IR)
+				r, ok := phi_reg[phi]
+				if !ok {
+					continue
+				}
+				for k, p := range phi.preds {
+					if p == bb {
+						phi.args[k] = top(r, phi.is_fp)
+					}
+				}
+			}
+		}
+
+		for _, kid := range kids[bb.id] {
+			rename(kid)
+		}
+		for _, r := range pushed {
+			stack[r] = stack[r][:len(stack[r])-1]
+		}
+	}
+	rename(fn.bbs.data[0].(*BB))
+
+	entry := fn.bbs.data[0].(*BB)
+	v := new_vec()
+	for _, ir := range undef_ir {
+		vec_push(v, ir)
+	}
+	for i := 0; i < entry.ir.len; i++ {
+		vec_push(v, entry.ir.data[i])
+	}
+	entry.ir = v
+}
+
+// Inserts a phi node after labels and other phi nodes of a block.
+func insert_phi(bb *BB, phi *IR) {
+	n := bb_head(bb)
+	v := new_vec()
+	for i := 0; i < n; i++ {
+		vec_push(v, bb.ir.data[i])
+	}
+	vec_push(v, phi)
+	for i := n; i < bb.ir.len; i++ {
+		vec_push(v, bb.ir.data[i])
+	}
+	bb.ir = v
+}
+
+// Converts the IR of a function to SSA form.
+func to_ssa(fn *Function) {
+	ensure_entry(fn)
+	for i := 0; i < fn.bbs.len; i++ {
+		bb := fn.bbs.data[i].(*BB)
+		for j := 0; j < bb.ir.len; j++ {
+			if ir := bb.ir.data[j].(*IR); is_two_address(ir) {
+				ir.dst = ir.lhs
+			}
+		}
+	}
+	rename_regs(fn, nil)
+	if vars := mem2reg(fn); vars != nil {
+		rename_regs(fn, vars)
+	}
+}
+
+// Destruction
+
+// Converts the IR of a function back from SSA form. A phi node becomes
+// a copy from a new register, which is set at the end of each
+// predecessor. Instructions that update lhs in place get a copy of
+// their operand.
+func from_ssa(fn *Function) {
+	for i := 0; i < fn.bbs.len; i++ {
+		bb := fn.bbs.data[i].(*BB)
+		for j := 0; j < bb.ir.len; j++ {
+			phi := bb.ir.data[j].(*IR)
+			if phi.op != IR_PHI {
+				continue
+			}
+			t := nreg
+			nreg++
+			for k, p := range phi.preds {
+				append_before_jump(p, new_mov(t, phi.args[k], phi.is_fp))
+			}
+			bb.ir.data[j] = new_mov(phi.lhs, t, phi.is_fp)
+		}
+	}
+
+	for i := 0; i < fn.bbs.len; i++ {
+		bb := fn.bbs.data[i].(*BB)
+		v := new_vec()
+		for j := 0; j < bb.ir.len; j++ {
+			ir := bb.ir.data[j].(*IR)
+			if is_two_address(ir) {
+				if ir.dst != ir.lhs {
+					vec_push(v, new_mov(ir.dst, ir.lhs, ssa_def(ir).is_fp))
+					ir.lhs = ir.dst
+				}
+				ir.dst = 0
+			}
+			vec_push(v, ir)
+		}
+		bb.ir = v
+	}
+}
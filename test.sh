@@ -4,7 +4,7 @@ try() {
     expected="$1"
     input="$2"
 
-    ./9ccgo "$input" > tmp.s
+    echo "$input" | ./9ccgo -S -o tmp.s -
     gcc -static -o tmp tmp.s tmp-test.o
     ./tmp
     actual="$?"
@@ -128,5 +128,247 @@ try 45 'int main() {int x=0; int y=0; do {y = y+x;x=x+1;} while( x <10); return
 try 5 'extern int global_arr[1]; int main() { return global_arr[0];}'
 
 try 8 'int main() {return 3 + ({return 5;});}'
+
+# Checks that compiling an input fails with a diagnostic that matches
+# a given extended regular expression.
+try_err() {
+    opts="$1"
+    pattern="$2"
+    input="$3"
+
+    if echo "$input" | ./9ccgo $opts -S -o tmp.s - 2>tmp.err; then
+        echo "$input: compile error expected"
+        exit 1
+    fi
+    if grep -Eq -- "$pattern" tmp.err; then
+        echo "$input => /$pattern/"
+    else
+        echo "$input: /$pattern/ expected, but got:"
+        cat tmp.err
+        exit 1
+    fi
+}
+
+# Checks that compiling an input fails with a given number of errors.
+try_nerr() {
+    opts="$1"
+    count="$2"
+    input="$3"
+
+    if echo "$input" | ./9ccgo $opts -S -o tmp.s - 2>tmp.err; then
+        echo "$input: compile error expected"
+        exit 1
+    fi
+    actual=$(grep -c ': error: ' tmp.err)
+    if [ "$actual" == "$count" ]; then
+        echo "$input => $actual errors"
+    else
+        echo "$input: $count errors expected, but got $actual"
+        cat tmp.err
+        exit 1
+    fi
+}
+
+try_nerr '' 3 'int f() { return 1 +; } int g() { return y; } int h() { int a = 1 return a; }'
+try_nerr '' 3 'int main() { int a = x; int b = y; return z; }'
+try_nerr '-fmax-errors=1' 1 'int main() { int a = x; int b = y; return z; }'
+try_err '-fmax-errors=1' 'compilation terminated due to -fmax-errors=1\.' 'int f() { return 1 +; } int g() { return y; }'
+
+# Checks that compiling an input succeeds and that the diagnostics
+# match a given extended regular expression, or are empty if the
+# pattern is empty.
+try_warn() {
+    opts="$1"
+    pattern="$2"
+    input="$3"
+
+    if ! echo "$input" | ./9ccgo $opts -S -o tmp.s - 2>tmp.err; then
+        echo "$input: compile error not expected"
+        cat tmp.err
+        exit 1
+    fi
+    if [ -z "$pattern" ]; then
+        if [ -s tmp.err ]; then
+            echo "$input: no diagnostics expected, but got:"
+            cat tmp.err
+            exit 1
+        fi
+    elif ! grep -Eq -- "$pattern" tmp.err; then
+        echo "$input: /$pattern/ expected, but got:"
+        cat tmp.err
+        exit 1
+    fi
+    echo "$input => /$pattern/"
+}
+
+try_warn '' "-:1:21: warning: implicit declaration of function 'foo' \[-Wimplicit-function-declaration\]" 'int main() { return foo(); }'
+try_warn '' 'warning: initialization makes pointer from integer without a cast \[-Wint-conversion\]' 'int main() { int *p = 1; return 0; }'
+try_warn '' '' 'int f() { }'
+try_warn '-Wreturn-type' 'warning: control reaches end of non-void function \[-Wreturn-type\]' 'int f() { }'
+try_warn '' '' 'int main() { int x; return 0; }'
+try_warn '-Wunused-variable' "warning: unused variable 'x' \[-Wunused-variable\]" 'int main() { int x; return 0; }'
+try_warn '' '' 'int x; int main() { int x = 1; return x; }'
+try_warn '-Wshadow' "warning: declaration of 'x' shadows a global declaration \[-Wshadow\]" 'int x; int main() { int x = 1; return x; }'
+try_warn '' '' 'int main() { int a = -1; unsigned b = 1; return a < b; }'
+try_warn '-Wsign-compare' 'warning: comparison of integer expressions of different signedness \[-Wsign-compare\]' 'int main() { int a = -1; unsigned b = 1; return a < b; }'
+try_warn '-Wall' '\[-Wunused-variable\]' 'int f() { int x; }'
+try_warn '-Wall' '\[-Wreturn-type\]' 'int f() { int x; }'
+try_warn '-Wall -Wno-return-type' '' 'int f() { }'
+try_warn '-Wno-implicit-function-declaration' '' 'int main() { return foo(); }'
+try_warn '-Wno-int-conversion' '' 'int main() { int *p = 1; return 0; }'
+try_err '-Werror' "error: implicit declaration of function 'foo' \[-Werror=implicit-function-declaration\]" 'int main() { return foo(); }'
+try_err '-Wshadow -Werror' '\[-Werror=shadow\]' 'int x; int main() { int x = 1; return x; }'
+try_warn '-Werror -Wno-error' 'warning: .*\[-Wimplicit-function-declaration\]' 'int main() { return foo(); }'
+
+# Checks the number of basic blocks in the -dump-cfg output and that
+# it has the given edges.
+try_cfg() {
+    blocks="$1"
+    input="$2"
+    shift 2
+
+    echo "$input" | ./9ccgo -dump-cfg -S -o tmp.s - 2>tmp.dot || exit 1
+    actual=$(grep -c '\[label="bb' tmp.dot)
+    if [ "$actual" != "$blocks" ]; then
+        echo "$input: $blocks blocks expected, but got $actual"
+        exit 1
+    fi
+    for edge in "$@"; do
+        if ! grep -qF " $edge;" tmp.dot; then
+            echo "$input: edge $edge expected"
+            cat tmp.dot
+            exit 1
+        fi
+    done
+    echo "$input => $blocks blocks, $# edges"
+}
+
+try_cfg 9 'int f(int n) { int s = 0; for (int i = 0; i < n; i++) { if (i & 1) s += i; else s -= 1; } return s; }' \
+    'f0_bb0 -> f0_bb1' 'f0_bb1 -> f0_bb2' 'f0_bb1 -> f0_bb7' \
+    'f0_bb2 -> f0_bb3' 'f0_bb2 -> f0_bb4' 'f0_bb3 -> f0_bb5' 'f0_bb4 -> f0_bb5' \
+    'f0_bb5 -> f0_bb6' 'f0_bb6 -> f0_bb1' 'f0_bb7 -> f0_bb8'
+
+
+# Checks the number of lines of the IR dump at -O1 that match
+# a given extended regular expression.
+try_ir() {
+    count="$1"
+    pattern="$2"
+    input="$3"
+
+    echo "$input" | ./9ccgo -O1 -dump-ir1 -S -o tmp.s - 2>tmp.ir || exit 1
+    actual=$(grep -cE "$pattern" tmp.ir)
+    if [ "$actual" == "$count" ]; then
+        echo "$input => $actual x /$pattern/"
+    else
+        echo "$input: $count x /$pattern/ expected, but got $actual"
+        cat tmp.ir
+        exit 1
+    fi
+}
+
+# SCCP removes a branch whose condition is constant after propagation.
+try_ir 0 'BR|IMM r[0-9]+, 9$' 'int main() { int x = 3; int y; if (x < 5) y = 2; else y = 9; return y; }'
+# GVN merges a redundant addition.
+try_ir 1 'ADD' 'int f(int a, int b) { return (a + b) * (a + b); }'
+# DCE removes a dead value unless it has side effects.
+try_ir 0 'DIV' 'int f(int a) { int x = a / 3; x = 5; return x; }'
+try_ir 1 '= h\(\)' 'int h(); int f() { int x = h(); x = 5; return x; }'
+try_ir 1 'STORE4' 'int g; int f(int a) { g = a; return 0; }'
+
+# Compiles an input to assembly with given options and checks that the
+# output matches a Perl regular expression over the whole file.
+try_asm() {
+    opts="$1"
+    pattern="$2"
+    input="$3"
+
+    echo "$input" | ./9ccgo $opts -S -o tmp.s - || exit 1
+    if grep -Pzq "$pattern" tmp.s; then
+        echo "$input => /$pattern/"
+    else
+        echo "$input: /$pattern/ expected"
+        exit 1
+    fi
+}
+
+
+# The peephole optimizer fuses a comparison and a branch, and removes
+# push/pop pairs that save dead registers around a call.
+try_asm '-O1' 'cmp r\w+, r\w+\n\tjge \.L\d+\n' 'int f(int a, int b) { if (a < b) return 1; return 2; }'
+try_asm '-O1' '\A(?![\s\S]*\tset)' 'int f(int a, int b) { if (a < b) return 1; return 2; }'
+try_asm '' '\tpush r10\n\tpush r11\n' 'int h(int); int f(int a) { return h(a) + 1; }'
+try_asm '-O1' '\A(?![\s\S]*\tpush r1[01]\n)' 'int h(int); int f(int a) { return h(a) + 1; }'
+try_asm '-O1' '\tpush r10\n\tpush r11\n\tmov rax, 0\n\tcall h\n\tpop r11\n\tpop r10\n' 'int h(int); int f(int *p, int *q) { return *p * (*q + h(1)); }'
+
+# The label of a global in a given section
+section() {
+    echo "\\.$1\\n(?:(?!\\.(?:data|bss|text)\\n).*\\n)*$2:"
+}
+
+try_asm '' "$(section bss x)" 'int x = 0; int main() { return x; }'
+try_asm '' "$(section bss a)" 'int a[100] = {0}; int main() { return a[0]; }'
+try_asm '' "$(section bss s)" 'static int s = 0; int main() { return s; }'
+try_asm '' "$(section data y)" 'int y = 1; int main() { return y; }'
+try_asm '' '\.comm t, 4, 4' 'int t; int main() { return t; }'
+
+echo '#include "tmp-self.h"' > tmp-self.h
+try_err '-I.' 'tmp-self.h:1:.*#include nested too deeply' '#include "tmp-self.h"'
+
+try_err '' '-:1:47: error: duplicate case value: 1' 'int f(int x) { switch (x) { case 1: return 0; case 1: return 1; } return 0; }'
+try_err '' '-:1:48: error: multiple default labels' 'int f(int x) { switch (x) { default: return 0; default: return 1; } }'
+
+try_err '' "-:1:14: error: stray 'break' statement" 'int main() { break; return 0; }'
+try_err '' "-:1:35: error: stray 'continue' statement" 'int main() { switch (1) { case 1: continue; } return 0; }'
+try_nerr '' 2 'int main() { break; continue; }'
+try_nerr '-fmax-errors=1' 1 'int main() { break; continue; }'
+try 3 'int main() { int x = 0; for (;;) { switch (x) { case 3: return x; } x++; continue; } }'
+
+try_err '' '-:1:8: error: type name expected' 'int x; x = 5;'
+
+try 9 'f(int a) { return a; } int main() { return f(9); }'
+try 0 'f(int a) {} int main() { f(1); return 0; }'
+
+try_nerr '' 1 'x;'
+try_nerr '' 1 'g6[];'
+try_nerr '' 2 'x; g6[]; int main() { return x + g6[0]; }'
+try_nerr '' 2 'int main(){struct{a'
+try_nerr '' 1 'int f(x) { return 0; }'
+try_nerr '' 1 'g(); int main() { return g(y); }'
+try_nerr '' 1 'g(); int main() { return (long)g() + (g(), y); }'
+try_nerr '' 1 'char *s = "ab'
+
+try_err '' '-:2:2: error: unterminated macro argument list' $'#define A(x) x\n#if A(\n#endif'
+try_err '' '-:2:11: error: unterminated macro argument list' $'#define A(x) x\nint y = A('
+
+# The driver compiles every input even if one of them fails, and it
+# doesn't link or leave temporary files behind.
+echo 'int f() { return x; }' > tmp-bad1.c
+echo 'int g() { return y; }' > tmp-bad2.c
+echo 'int main() { return 0; }' > tmp-good.c
+mkdir -p tmp-dir
+rm -f tmp-out
+if TMPDIR=tmp-dir ./9ccgo -o tmp-out tmp-bad1.c tmp-good.c tmp-bad2.c tmp-bad.x 2>tmp.err; then
+    echo "driver: compile error expected"
+    exit 1
+fi
+for pattern in 'tmp-bad1.c:1:18: error' 'tmp-bad2.c:1:18: error' 'tmp-bad.x: unknown file type'; do
+    if ! grep -q "$pattern" tmp.err; then
+        echo "driver: /$pattern/ expected, but got:"
+        cat tmp.err
+        exit 1
+    fi
+done
+if [ -e tmp-out ] || [ -n "$(ls tmp-dir)" ]; then
+    echo "driver: no output or temporary files expected"
+    exit 1
+fi
+rmdir tmp-dir
+echo "driver => OK"
+
+try_warn '-Wreturn-type' '' 'int f(int x) { do { return 1; } while (0); }'
+try_warn '-Wreturn-type' '' 'int f(int x) { do { x++; } while (1); }'
+try_warn '-Wreturn-type' '\[-Wreturn-type\]' 'int f(int x) { do { if (x) continue; return 1; } while (x); }'
+try_warn '-Wreturn-type' '\[-Wreturn-type\]' 'int f(int x) { do { if (x) break; return 1; } while (1); }'
 echo OK
 
@@ -2,3 +2,48 @@
 
 int global_arr[1] = {5};
 
+
+double gcc_fsum(int a, double b, float c, long d, double e) { return a + b + c + d + e; }
+float gcc_half(float x) { return x / 2; }
+long gcc_sum10(long a, long b, long c, long d, long e, long f, long g, long h, long i, long j) {
+  return a + b * 2 + c * 3 + d * 4 + e * 5 + f * 6 + g * 7 + h * 8 + i * 9 + j * 10;
+}
+double gcc_mix(int a, double b, int c, double d, int e, double f, int g, double h, int i, double j,
+               int k, double l, int m, double n, int o, double p, int q, double r, int s) {
+  return a + b + c + d + e + f + g + h + i + j + k + l + m + n + o + p + q + r + s;
+}
+
+struct gs1 { char a; short b; };
+struct gs2 { long a; double b; };
+struct gs3 { float a, b; double c; };
+struct gs4 { long a, b, c; };
+struct gs5 { char c[3]; };
+
+struct gs2 gcc_mk2(long a, double b) { return (struct gs2){a, b}; }
+struct gs3 gcc_mk3(float a, float b, double c) { return (struct gs3){a, b, c}; }
+struct gs4 gcc_mk4(long a, long b, long c) { return (struct gs4){a, b, c}; }
+struct gs5 gcc_mk5(char *s) { return (struct gs5){{s[0], s[1], s[2]}}; }
+long gcc_sum_s(struct gs1 x, struct gs2 y, struct gs3 z, struct gs4 w) {
+  return x.a + x.b + y.a + y.b + z.a + z.b + z.c + w.a + w.b + w.c;
+}
+long gcc_sum_s7(struct gs2 a, struct gs2 b, struct gs2 c, struct gs2 d, struct gs2 e, struct gs2 f, struct gs2 g) {
+  return a.a + b.a + c.a + d.a + e.a + f.a + g.a * 10 + g.b * 100;
+}
+
+struct gs2 cc_mk2(long a, double b);
+struct gs4 cc_mk4(long a, long b, long c);
+long cc_sum_s(struct gs1 x, struct gs2 y, struct gs3 z, struct gs4 w);
+long gcc_callback(void) {
+  struct gs2 a = cc_mk2(1, 2.5);
+  struct gs4 b = cc_mk4(3, 4, 5);
+  struct gs1 x = {1, 2};
+  struct gs3 z = {0.5, 1.5, 3};
+  return a.a * 1000 + (long)(a.b * 10) * 100 + b.a + b.b + b.c + cc_sum_s(x, a, z, b);
+}
+
+int dup_name(void) { return 1; }
+int dup_var = 10;
+int gcc_dup_name(void) { return dup_name() * 100 + dup_var; }
+int tent_common;
+extern int cc_exported;
+int gcc_read_common(void) { return tent_common + cc_exported; }
@@ -0,0 +1,7 @@
+// A header with an include guard
+#ifndef GUARD_H
+#define GUARD_H
+
+int guard_var = 1;
+
+#endif /* GUARD_H */
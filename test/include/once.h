@@ -0,0 +1,3 @@
+#pragma once
+
+int once_var = 2;
@@ -0,0 +1,7 @@
+// A header that includes itself once more
+#ifndef ONCE_MORE
+#define ONCE_MORE
+#include "self.h"
+#else
+#define SELF_INCLUDED
+#endif
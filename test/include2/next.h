@@ -0,0 +1 @@
+#define NEXT_SECOND 2
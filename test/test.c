@@ -3,6 +3,16 @@ extern void *stderr;
 int printf();
 int fprintf();
 int exit();
+int strcmp();
+int atoi();
+int vsprintf();
+void qsort(void *base, long n, long size, int (*cmp)(void *, void *));
+
+typedef __builtin_va_list va_list;
+#define va_start(ap, last) __builtin_va_start(ap, last)
+#define va_arg(ap, ty) __builtin_va_arg(ap, ty)
+#define va_copy(dst, src) __builtin_va_copy(dst, src)
+#define va_end(ap) __builtin_va_end(ap)
 
 #define EXPECT(expected, expr)                                  \
   do {                                                          \
@@ -32,6 +42,252 @@ int var2[5];
 extern int global_arr[1];
 typedef int myint;
 
+int g1 = 3;
+char g2 = 'x';
+int g3[] = {1, 2, 3};
+int g4[5] = {1, 2};
+char g5[] = "foo";
+char g6[10] = "bar";
+char *g7 = "baz";
+char *g8[] = {"ab", "cd", "ef"};
+int g9[2][3] = {{1, 2, 3}, {4, 5, 6}};
+int g10[2][3] = {1, 2, 3, 4};
+struct { int a; char b; int c[2]; } g11 = {5, 'y', {7, 8}};
+struct { char a; int *b; } g12[] = {{1, &g1}, 2, g3 + 1};
+int *g13 = &g3[2];
+char *g14 = g5 + 1;
+int g15 = 2 * 3 + (4 < 5);
+struct { int a; int b; int c; } g16 = {.c = 3, .a = 1};
+int g17[10] = {[2] = 5, 6, [8] = 9};
+long g18 = 5000000000;
+short g19[] = {-1, 2};
+unsigned char g20 = 255;
+
+long lsub(long a, long b) { return a - b; }
+short sadd(short a, short b) { return a + b; }
+unsigned udiv(unsigned a, unsigned b) { return a / b; }
+double g21 = 1.5;
+float g22[] = {0.5, 1 + 1.25f, -2};
+struct { int a; double b; } g23 = {1, 2.5e1};
+double g24 = (int)3.9 + .5;
+
+enum { E0, E1, E5 = 5, E6, EN = -2, EM } g25 = E6;
+enum color { RED = 1 << 2, GREEN, BLUE = GREEN * 2 };
+union { int i; char c[6]; } g26 = {0x01020304};
+int g27[E5] = {[E1] = BLUE};
+int g28 = 0;
+int g29[100] = {0};
+static long g30 = 0;
+
+int enum_case(enum color c) {
+  switch (c) {
+  case RED: return 1;
+  case GREEN: return 2;
+  case BLUE: return 3;
+  }
+  return 0;
+}
+
+enum { SH_A = 1, SH_B = 4 };
+int shadow_param(int SH_A) { return SH_A; }
+
+long gcc_sum10(long a, long b, long c, long d, long e, long f, long g, long h, long i, long j);
+double gcc_mix(int a, double b, int c, double d, int e, double f, int g, double h, int i, double j,
+               int k, double l, int m, double n, int o, double p, int q, double r, int s);
+int sum8(int a, int b, int c, int d, int e, int f, int g, int h) {
+  return a + b * 2 + c * 3 + d * 4 + e * 5 + f * 6 + g * 7 + h * 8;
+}
+double fsum10(double a, double b, double c, double d, double e, float f, double g, double h, int x, double i, double j) {
+  return a + b + c + d + e + f + g + h + i * x + j;
+}
+char narrow9(int a, int b, int c, int d, int e, int f, char g, short h, char i) { return g + h + i; }
+
+double gcc_fsum(int a, double b, float c, long d, double e);
+float gcc_half(float x);
+double fadd(double a, double b) { return a + b; }
+float fmix(int a, float b, long c, double d) { return a * b + c - d; }
+int isum7(double a, double b, double c, double d, double e, double f, double g) {
+  return a + b + c + d + e + f + g;
+}
+int ftoi(double x) { return x; }
+double fcall(double x) { return fadd(x, 1) * fadd(x, 2); }
+
+int va_isum(int n, ...) {
+  va_list ap;
+  va_start(ap, n);
+  int sum = 0;
+  for (int i = 0; i < n; i++)
+    sum = sum + va_arg(ap, int);
+  va_end(ap);
+  return sum;
+}
+
+// Reads ints for 'i', longs for 'l' and doubles for 'd'.
+double va_mix(double x, char *fmt, ...) {
+  va_list ap;
+  va_start(ap, fmt);
+  for (; *fmt; fmt++) {
+    if (*fmt == 'i')
+      x = x + va_arg(ap, int);
+    else if (*fmt == 'l')
+      x = x + va_arg(ap, long);
+    else
+      x = x + va_arg(ap, double);
+  }
+  va_end(ap);
+  return x;
+}
+
+int va_twice(int n, ...) {
+  va_list ap;
+  va_list ap2;
+  va_start(ap, n);
+  va_copy(ap2, ap);
+  int sum = 0;
+  for (int i = 0; i < n; i++)
+    sum = sum + va_arg(ap, int);
+  for (int i = 0; i < n; i++)
+    sum = sum + va_arg(ap2, int);
+  va_end(ap);
+  va_end(ap2);
+  return sum;
+}
+
+int va_fmt(char *buf, char *fmt, ...) {
+  va_list ap;
+  va_start(ap, fmt);
+  int n = vsprintf(buf, fmt, ap);
+  va_end(ap);
+  return n;
+}
+
+struct gs1 {
+  char a;
+  short b;
+};
+struct gs2 {
+  long a;
+  double b;
+};
+struct gs3 {
+  float a;
+  float b;
+  double c;
+};
+struct gs4 {
+  long a;
+  long b;
+  long c;
+};
+struct gs5 {
+  char c[3];
+};
+struct big {
+  int x[10];
+};
+
+struct gs2 gcc_mk2(long a, double b);
+struct gs3 gcc_mk3(float a, float b, double c);
+struct gs4 gcc_mk4(long a, long b, long c);
+struct gs5 gcc_mk5(char *s);
+long gcc_sum_s(struct gs1 x, struct gs2 y, struct gs3 z, struct gs4 w);
+long gcc_sum_s7(struct gs2 a, struct gs2 b, struct gs2 c, struct gs2 d, struct gs2 e, struct gs2 f, struct gs2 g);
+long gcc_callback();
+
+struct gs2 cc_mk2(long a, double b) {
+  struct gs2 s;
+  s.a = a;
+  s.b = b;
+  return s;
+}
+struct gs4 cc_mk4(long a, long b, long c) {
+  struct gs4 s = {a, b, c};
+  return s;
+}
+long cc_sum_s(struct gs1 x, struct gs2 y, struct gs3 z, struct gs4 w) {
+  return x.a + x.b + y.a + y.b + z.a + z.b + z.c + w.a + w.b + w.c;
+}
+struct big cc_rev(struct big b, int n) {
+  struct big r;
+  for (int i = 0; i < 10; i++)
+    r.x[i] = b.x[9 - i] * n;
+  return r;
+}
+
+typedef int (*binop_t)(int, int);
+int (*g_op)(int, int) = plus;
+binop_t g_ops[] = {plus, mul, &plus};
+struct ops {
+  double (*f)(double, double);
+  binop_t g;
+};
+
+int apply(int (*f)(int, int), int x, int y) { return f(x, y); }
+int int_cmp(void *a, void *b) { return *(int *)a - *(int *)b; }
+int sorted(int *a, int n) {
+  qsort(a, n, sizeof(int), int_cmp);
+  for (int i = 1; i < n; i++)
+    if (a[i - 1] > a[i])
+      return 0;
+  return 1;
+}
+
+#define STR(x) #x
+#define XSTR(x) STR(x)
+#define LINE() __LINE__
+#define VA_COUNT(...) VA_COUNT_(__VA_ARGS__, 3, 2, 1, 0)
+#define VA_COUNT_(a, b, c, n, ...) n
+#define VA_SUM(...) va_isum(VA_COUNT(__VA_ARGS__), __VA_ARGS__)
+#define PASTE(a, b) a##b
+
+static int dup_name(void);
+int dup_name(void) { return 2; }
+static int dup_var = 20;
+int gcc_dup_name();
+int gcc_read_common();
+
+int tent;
+int tent;
+int tent = 7;
+int tent;
+int tent_common;
+int cc_exported = 5;
+
+int spill_loop(int n) {
+  int s = 0;
+  for (int i = 0; i < n; i++)
+    s += i + (1 + (2 + (3 + (4 + (5 + (6 + (7 + add(i, 1, 1, 1, 1, 1))))))));
+  return s;
+}
+
+int static_counter() {
+  static int n;
+  static int m = 10;
+  return ++n * 100 + m++;
+}
+
+int neg_case(int x) {
+  switch (x) {
+  case -2: return 1;
+  case -1: return 2;
+  default: return 3;
+  }
+}
+
+int long_case(long x) {
+  switch (x) {
+  case -0x7fffffffffffffffL - 1: return 1;
+  case 0: return 2;
+  case 1: return 3;
+  case 0x7fffffffffffffffL: return 4;
+  }
+  return 5;
+}
+
+int clobber(int x) { int a = x * 3; int b = a + 7; return a * b - x; }
+int live_across_call(int *p, int *q) { return *p * (*q + clobber(1)); }
+
+
 // Single-line comment test
 
 
@@ -226,6 +482,343 @@ int main() {
   EXPECT(6, ({ int i=5; i^=3; return i;}));
   EXPECT(7, ({ int i=5; i|=3; return i;}));
 
+  EXPECT(5, ({ int x=0; switch(3) { case 2: x=2; break; case 3: x=5; break; } return x; }));
+  EXPECT(6, ({ int x=0; switch(3) { case 3: x=5; case 4: x=x+1; } return x; }));
+  EXPECT(7, ({ int x=0; switch(9) { case 1: x=1; break; default: x=7; } return x; }));
+  EXPECT(0, ({ int x=0; switch(9) { case 1: x=1; break; } return x; }));
+  EXPECT(8, ({ int x=0; switch(-2) { case 5: x=1; break; case -2: x=8; break; } return x; }));
+  EXPECT(31, ({ int x=0; for (int i=0; i<8; i++) switch(i) { case 0: case 1: x++; break; case 2: x+=2; break; case 3: x+=4; break; case 4: x+=8; break; default: x+=5; } return x; }));
+  EXPECT(99, ({ int x=0; switch(10) { case 1: x=1; break; case 2: x=2; break; case 3: x=3; break; case 4: x=4; break; default: x=99; } return x; }));
+  EXPECT(3, ({ int x=0; switch(1) { case 0: case 1: { x=3; break; } x=4; } return x; }));
+
+  EXPECT(25, ({ int x=0; for (int i=0; i<10; i++) { if (i%2==0) continue; x+=i; } return x; }));
+  EXPECT(25, ({ int x=0; int i=0; while (i<10) { i++; if (i%2==0) continue; x+=i; } return x; }));
+  EXPECT(20, ({ int x=0; int i=0; do { i++; if (i%2==1) continue; x+=i; } while (i<8); return x; }));
+  EXPECT(10, ({ int x=0; for (int i=0; i<5; i++) switch (i) { case 1: continue; default: x+=i; } return x+1; }));
+  EXPECT(1, long_case(-0x7fffffffffffffffL - 1));
+  EXPECT(2, long_case(0));
+  EXPECT(3, long_case(1));
+  EXPECT(4, long_case(0x7fffffffffffffffL));
+  EXPECT(5, long_case(2));
+  EXPECT(5, long_case(-1));
+  EXPECT(3, ({ int x=0; goto l1; x=5; l1: x+=3; return x; }));
+  EXPECT(10, ({ int i=0; l2: i++; if (i<10) goto l2; return i; }));
+  EXPECT(4, ({ int x=1; goto l5; l4: x*=2; goto l6; l5: x+=1; goto l4; l6: return x; }));
+  EXPECT(1, ({ int x=0; if (1) goto l7; else x=2; l7: return x+1; }));
+
+  EXPECT(3, g1);
+  EXPECT('x', g2);
+  EXPECT(12, sizeof(g3));
+  EXPECT(6, g3[0] + g3[1] + g3[2]);
+  EXPECT(3, g4[0] + g4[1] + g4[2] + g4[3] + g4[4]);
+  EXPECT(4, sizeof(g5));
+  EXPECT('o', g5[2]);
+  EXPECT(0, g5[3]);
+  EXPECT(10, sizeof(g6));
+  EXPECT('r', g6[2]);
+  EXPECT(0, g6[9]);
+  EXPECT('z', g7[2]);
+  EXPECT(24, sizeof(g8));
+  EXPECT('d', g8[1][1]);
+  EXPECT('e', g8[2][0]);
+  EXPECT(6, g9[1][2]);
+  EXPECT(4, g9[1][0]);
+  EXPECT(4, g10[1][0]);
+  EXPECT(0, g10[1][1]);
+  EXPECT(5, g11.a);
+  EXPECT('y', g11.b);
+  EXPECT(8, g11.c[1]);
+  EXPECT(32, sizeof(g12));
+  EXPECT(3, *g12[0].b);
+  EXPECT(2, g12[1].a);
+  EXPECT(2, *g12[1].b);
+  EXPECT(3, *g13);
+  EXPECT('o', *g14);
+  EXPECT(7, g15);
+  EXPECT(4, g16.a + g16.b + g16.c);
+  EXPECT(6, g17[3]);
+  EXPECT(20, g17[2] + g17[3] + g17[8] + g17[9]);
+
+  EXPECT(6, ({ int x[3] = {1, 2, 3}; return x[0] + x[1] + x[2]; }));
+  EXPECT(3, ({ int x[5] = {1, 2}; return x[0] + x[1] + x[2] + x[3] + x[4]; }));
+  EXPECT(16, ({ int x[] = {1, 2, 3, 4}; return sizeof(x) + x[3] - 4; }));
+  EXPECT(4, ({ char s[] = "abc"; return sizeof(s); }));
+  EXPECT('c', ({ char s[] = "abc"; return s[2]; }));
+  EXPECT(0, ({ char s[10] = "abc"; return s[3] + s[9]; }));
+  EXPECT(6, ({ int x[2][3] = {{1, 2}, {3}}; return x[0][0] + x[0][1] + x[0][2] + x[1][0] + x[1][2]; }));
+  EXPECT(6, ({ int x[2][3] = {1, 2, 3, 4, 5, 6}; return x[1][2]; }));
+  EXPECT(3, ({ struct { int x; int y; } p = {.y = 2, .x = 1}; return p.x + p.y; }));
+  EXPECT(2, ({ struct { int x; int y; } p = {.y = 2}; return p.x + p.y; }));
+  EXPECT(10, ({ struct { int x; char c; int y[3]; } p = {1, 'a', {2, 3, 4}}; return p.x + p.y[0] + p.y[1] + p.y[2]; }));
+  EXPECT(9, ({ int x[5] = {[1] = 2, 3, [4] = 4}; return x[0] + x[1] + x[2] + x[3] + x[4]; }));
+  EXPECT(8, ({ int x[] = {[7] = 1}; return sizeof(x) / sizeof(x[0]); }));
+  EXPECT(7, ({ struct { int a; struct { int b; int c; } s; } p = {.s.c = 7}; return p.a + p.s.b + p.s.c; }));
+  EXPECT(5, ({ struct { int a; int b; } p[2] = {[1].b = 5}; return p[0].a + p[0].b + p[1].a + p[1].b; }));
+  EXPECT(3, ({ int x = {3}; return x; }));
+  EXPECT(0, ({ char x[13] = {1}; return x[1] + x[4] + x[8] + x[12]; }));
+  EXPECT(98, ({ char *s[] = {"abc", "bcd"}; return s[1][0]; }));
+
+  EXPECT(8, sizeof(long));
+  EXPECT(2, sizeof(short));
+  EXPECT(8, sizeof(long long));
+  EXPECT(4, sizeof(unsigned));
+  EXPECT(2, sizeof(unsigned short int));
+  EXPECT(1, sizeof(signed char));
+  EXPECT(8, sizeof(long int *));
+  EXPECT(12, sizeof(short[6]));
+  EXPECT(8, _Alignof(long));
+  EXPECT(4, sizeof(1));
+  EXPECT(8, sizeof(1L));
+  EXPECT(8, sizeof(5000000000));
+  EXPECT(4, sizeof(1U));
+  EXPECT(8, sizeof(1UL));
+  EXPECT(8, sizeof(sizeof(int)));
+  EXPECT(8, sizeof(1 + 1L));
+  EXPECT(4, sizeof((char)1 + (char)1));
+  EXPECT(1, 5000000000 > 4000000000);
+  EXPECT(1, g18 == 5000000000);
+  EXPECT(1, g18 / 1000000000 == 5);
+  EXPECT(-1, g19[0]);
+  EXPECT(255, g20);
+  EXPECT(1, ({ long x = 1; return x << 40 == 1099511627776; }));
+  EXPECT(-3, lsub(2, 5));
+  EXPECT(1, lsub(10000000000, 1) == 9999999999);
+  EXPECT(7, sadd(3, 4));
+  EXPECT(-2, sadd(32767, 32767));
+  EXPECT(3, udiv(7, 2));
+  EXPECT(1, udiv(-1, 2) == 2147483647);
+  EXPECT(-1, ({ char x = 255; return x; }));
+  EXPECT(255, ({ unsigned char x = 255; return x; }));
+  EXPECT(-1, ({ signed char x = -1; return x; }));
+  EXPECT(0, ({ unsigned char x = 255; x++; return x; }));
+  EXPECT(-32768, ({ short x = 32767; x += 1; return x; }));
+  EXPECT(65535, ({ unsigned short x = -1; return x; }));
+  EXPECT(1, ({ int x = 2147483647; return x + 1 < 0; }));
+  EXPECT(1, ({ int x = -1; return x < 0; }));
+  EXPECT(0, ({ unsigned x = -1; return x < 0; }));
+  EXPECT(1, ({ unsigned x = -1; return x > 1; }));
+  EXPECT(0, -1 < 0U);
+  EXPECT(1, -1 < 0L);
+  EXPECT(1, ({ int x = -8; return x >> 1 == -4; }));
+  EXPECT(1, ({ unsigned x = -8; return x >> 1 == 2147483644; }));
+  EXPECT(-3, ({ int x = -7; return x / 2; }));
+  EXPECT(-1, ({ int x = -7; return x % 2; }));
+  EXPECT(1, ({ unsigned x = -7; return x % 2; }));
+  EXPECT(1, ({ long x = -1; return (unsigned)x == 4294967295U; }));
+  EXPECT(-1, (int)4294967295U);
+  EXPECT(1, (long)-1 == -1L);
+  EXPECT(1, (unsigned long)(unsigned)-1 == 4294967295);
+  EXPECT(1, (char)257);
+  EXPECT(-128, (char)128);
+  EXPECT(128, (unsigned char)128);
+  EXPECT(-1, (short)65535);
+  EXPECT(1, ({ long x = (int)-1; return x == -1; }));
+  EXPECT(10, ({ long x = 10; int *p = &x; return *p; }));
+  EXPECT(1, neg_case(-2));
+  EXPECT(2, neg_case(-1));
+  EXPECT(3, neg_case(5));
+  EXPECT(1, 0xffffffff == 4294967295L);
+  EXPECT(8, sizeof(0xffffffffff));
+  EXPECT(4, sizeof(0xffffffff));
+  EXPECT(1, 0xffffffff > 0);
+  EXPECT(1, 0x7fffffffffffffff > 0);
+
+  EXPECT(4, sizeof(float));
+  EXPECT(8, sizeof(double));
+  EXPECT(8, sizeof(1.0));
+  EXPECT(4, sizeof(1.0f));
+  EXPECT(8, sizeof(1.0f + 1.0));
+  EXPECT(4, sizeof(1.0f + 1));
+  EXPECT(3, (int)3.99);
+  EXPECT(-3, (int)-3.99);
+  EXPECT(1, 0.1 + 0.2 != 0.3);
+  EXPECT(1, 0.1f + 0.2f == 0.3f);
+  EXPECT(1, 1.5 < 2.5);
+  EXPECT(0, 1.5 > 2.5);
+  EXPECT(1, 2.5 >= 2.5);
+  EXPECT(1, 2.5 <= 2.5);
+  EXPECT(1, .5 == 0.5);
+  EXPECT(1, 1e3 == 1000);
+  EXPECT(1, 1.5e-1 == 0.15);
+  EXPECT(1, 0x1p4 == 16);
+  EXPECT(1, 0x1.8p1 == 3);
+  EXPECT(5, (int)(10.0 / 2));
+  EXPECT(7, (int)(3.5 * 2));
+  EXPECT(2, (int)(5.5 - 3.5));
+  EXPECT(-2, (int)-2.5);
+  EXPECT(1, -1.5 < 0);
+  EXPECT(0, !1.5);
+  EXPECT(1, !0.0);
+  EXPECT(1, 0.5 && 1);
+  EXPECT(1, 0.0 || 0.1);
+  EXPECT(3, 0.5 ? 3 : 4);
+  EXPECT(1, ({ double x = 0.0 / 0.0; return x != x; }));
+  EXPECT(0, ({ double x = 0.0 / 0.0; return x == x || x < 1 || x >= 1; }));
+  EXPECT(1, ({ double x = 1; int y = 2; return x / y == 0.5; }));
+  EXPECT(1, ({ unsigned long x = -1; double y = x; return y == 18446744073709551616.0; }));
+  EXPECT(1, ({ double x = 1e19; unsigned long y = x; return y == 10000000000000000000UL; }));
+  EXPECT(1, ({ unsigned x = -1; double y = x; return y == 4294967295.0; }));
+  EXPECT(200, ({ float x = 200.7f; unsigned char c = x; return c; }));
+  EXPECT(1, ({ float f = 1.1f; double d = f; return d != 1.1; }));
+  EXPECT(1, ({ double d = 1.1; float f = d; return f == 1.1f; }));
+  EXPECT(1, g21 == 1.5);
+  EXPECT(1, g22[0] == 0.5 && g22[1] == 2.25 && g22[2] == -2);
+  EXPECT(1, g23.a == 1 && g23.b == 25);
+  EXPECT(1, g24 == 3.5);
+  EXPECT(1, ({ double x[3] = {1, 2.5}; return x[0] + x[1] + x[2] == 3.5; }));
+  EXPECT(1, ({ struct { char c; float f; } s = {1, 2.5}; return s.c + s.f == 3.5; }));
+  EXPECT(1, ({ double x = 1; x += 0.5; x *= 4; x -= 1; x /= 2; return x == 2.5; }));
+  EXPECT(7, ({ int x = 3; x += 4.9; return x; }));
+  EXPECT(1, ({ double x = 1.5; x++; ++x; return x == 3.5; }));
+  EXPECT(1, ({ float x = 1.5f; return x-- == 1.5f && x == 0.5f; }));
+  EXPECT(1, ({ double x = 2; double *p = &x; *p = *p * 3; return x == 6; }));
+  EXPECT(1, ({ double x = 1; double y = -x; return y == -1; }));
+  EXPECT(1, fadd(1.25, 2) == 3.25);
+  EXPECT(1, fmix(2, 1.5f, 10, 0.5) == 12.5f);
+  EXPECT(28, isum7(1, 2, 3, 4, 5, 6, 7));
+  EXPECT(-4, ftoi(-4.5));
+  EXPECT(12, (int)fcall(2));
+  EXPECT(1, gcc_fsum(1, 2.5, 0.25f, 4, 8.125) == 15.875);
+  EXPECT(1, gcc_half(3) == 1.5f);
+  EXPECT(1, ({ double x = 2; return fadd(x, fadd(x, 1)) * x == 10; }));
+  EXPECT(1, ({ double a = 1; double b = 2; double c = 3; return a + fadd(b, c) * (b - fadd(a, a)) + c == 4; }));
+  EXPECT(1, ({ double x = 2.5; return (1 ? x : 1) == 2.5; }));
+  EXPECT(1, ({ int i = 0; double s = 0; for (; i < 10; i++) s += 0.5; return s == 5; }));
+
+  EXPECT(0, E0);
+  EXPECT(1, E1);
+  EXPECT(5, E5);
+  EXPECT(6, E6);
+  EXPECT(-2, EN);
+  EXPECT(-1, EM);
+  EXPECT(6, g25);
+  EXPECT(4, RED);
+  EXPECT(5, GREEN);
+  EXPECT(10, BLUE);
+  EXPECT(4, sizeof(enum color));
+  EXPECT(20, sizeof(g27));
+  EXPECT(10, g27[1]);
+  EXPECT(0, g28 + g29[0] + g29[99] + g30);
+  EXPECT(400, sizeof(g29));
+  EXPECT(7, ({ g29[50] = 7; g30 = g29[50]; return g30; }));
+  EXPECT(2, enum_case(GREEN));
+  EXPECT(3, enum_case(10));
+  EXPECT(3, ({ enum { A, B, C, } x = C; return x + 1; }));
+  EXPECT(7, ({ enum t { X = 7 }; enum t y = X; return y; }));
+  EXPECT(2, ({ enum { X = 1 }; int r = X; { enum { X = 2 }; r = X; } return r; }));
+  EXPECT(9, shadow_param(9));
+  EXPECT(5, ({ int SH_A = 5; return SH_A; }));
+  EXPECT(1, ({ { int SH_A = 5; } return SH_A; }));
+  EXPECT(3, ({ int X = 3; { enum { X = 10 }; } return X; }));
+  EXPECT(4, ({ { enum { SH_B = 7 }; } return SH_B; }));
+  EXPECT(6, ({ int r = 0; for (int SH_B = 6; SH_B;) { r = SH_B; SH_B = 0; } return r; }));
+  EXPECT(4, ({ for (int SH_B = 6; 0;); return SH_B; }));
+  EXPECT(8, sizeof(g26));
+  EXPECT(4, g26.c[0]);
+  EXPECT(1, g26.c[3]);
+  EXPECT(0, g26.c[5]);
+  EXPECT(8, sizeof(union { char c; double d; }));
+  EXPECT(12, sizeof(union { char c[9]; int i; }));
+  EXPECT(4, _Alignof(union { char c[9]; int i; }));
+  EXPECT(3, ({ union { int i; char c; } u; u.i = 0x103; return u.c; }));
+  EXPECT(1, ({ union { int i; float f; } u; u.f = 1.0; return u.i == 0x3f800000; }));
+  EXPECT(513, ({ union { short s; char c[2]; } u = {.c = {1, 2}}; return u.s; }));
+  EXPECT(0, ({ union { char c; long l; } u = {1}; return u.l >> 8; }));
+  EXPECT(8, ({ struct { char a; union { int b; char c; } u; } s; s.u.b = 8; return sizeof(s) + s.u.c - 8; }));
+
+  EXPECT(204, sum8(1, 2, 3, 4, 5, 6, 7, 8));
+  EXPECT(204, sum8(1, 2, 3, 4, 5, 6, 7, one() + 7));
+  EXPECT(204, sum8(1, 2, 3, 4, 5, 6, sum8(1, 0, 0, 0, 0, 0, 0, 0) + 6, 8));
+  EXPECT(385, gcc_sum10(1, 2, 3, 4, 5, 6, 7, 8, 9, 10));
+  EXPECT(1, gcc_sum10(1, 2, 3, 4, 5, 6, 7, 8, 9, 10000000000) == 100000000285);
+  EXPECT(190, (int)gcc_mix(1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19));
+  EXPECT(65, (int)fsum10(1, 2, 3, 4, 5, 6, 7, 8, 2, 9.5, 10.5));
+  EXPECT(-6, narrow9(0, 0, 0, 0, 0, 0, -1, -2, -3));
+  EXPECT(7, ({ int x = 1; printf("%d %d %d %d %d %d %d\n", x, x + 1, x + 2, x + 3, x + 4, x + 5, x + 6); return x + 6; }));
+  EXPECT(24, sizeof(va_list));
+  EXPECT(0, va_isum(0));
+  EXPECT(6, va_isum(3, 1, 2, 3));
+  EXPECT(55, va_isum(10, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10));
+  EXPECT(21, (int)va_mix(1.5, "idl", 2, 3.5, 4l) + 10);
+  EXPECT(66, (int)va_mix(0, "ddddddddddid", 1.0, 2.0, 3.0, 4.0, 5.0, 6.0, 7.0, 8.0, 9.0, 10.0, 1, 10.0));
+  EXPECT(42, (int)va_mix(0, "iiiiiidddddl", 1, 2, 3, 4, 5, 6, 1.5, 2.5, 3.0, 4.0, 5.0, 5l));
+  EXPECT(30, va_twice(4, 1, 2, 3, 9));
+  EXPECT(0, ({ char buf[32]; va_fmt(buf, "%d %s %.1f", 5, "ab", 2.5); return strcmp(buf, "5 ab 2.5"); }));
+  EXPECT(3, ({ char buf[32]; return va_fmt(buf, "%ld", 123l); }));
+  EXPECT(1, ({ struct gs2 s = gcc_mk2(7, 1.5); return s.a == 7 && s.b == 1.5; }));
+  EXPECT(5, ({ struct gs3 s = gcc_mk3(1, 1.5, 2.5); return s.a + s.b + s.c; }));
+  EXPECT(3, gcc_mk4(1, 2, 3).c);
+  EXPECT(99, gcc_mk5("abc").c[2]);
+  EXPECT(23, ({ struct gs1 x = {1, 2}; struct gs2 y = {1, 2.5}; struct gs3 z = {0.5, 1.5, 3}; struct gs4 w = {3, 4, 5}; return gcc_sum_s(x, y, z, w); }));
+  EXPECT(23, ({ struct gs1 x = {1, 2}; struct gs3 z = {0.5, 1.5, 3}; return cc_sum_s(x, cc_mk2(1, 2.5), z, cc_mk4(3, 4, 5)); }));
+  EXPECT(141, ({ struct gs2 a = {1, 0}; struct gs2 b = {2, 0}; struct gs2 c = {3, 0}; struct gs2 d = {4, 0}; struct gs2 e = {5, 0}; struct gs2 f = {6, 0}; return gcc_sum_s7(a, b, c, d, e, f, gcc_mk2(7, 0.5)); }));
+  EXPECT(3535, gcc_callback());
+  EXPECT(6, ({ struct gs4 a = {1, 2, 3}; struct gs4 b; b = a; return b.a + b.b + b.c; }));
+  EXPECT(3, ({ struct gs5 a = {{1, 2, 3}}; struct gs5 b; struct gs5 c; c = b = a; return c.c[2]; }));
+  EXPECT(20, ({ struct big b; for (int i = 0; i < 10; i++) b.x[i] = i; struct big r = cc_rev(b, 2); return r.x[0] + r.x[9] + b.x[9] - 9 + r.x[8]; }));
+  EXPECT(7, ({ int (*f)(int, int) = plus; return f(3, 4); }));
+  EXPECT(12, ({ int (*f)(int, int) = &mul; return (*f)(3, 4); }));
+  EXPECT(9, g_op(4, 5));
+  EXPECT(20, g_ops[1](4, 5) + g_ops[2](4, 7) - g_ops[0](1, 10));
+  EXPECT(15, apply(mul, 3, 5));
+  EXPECT(8, apply(plus, 3, 5));
+  EXPECT(3, ({ struct ops o; o.f = fadd; o.g = plus; return o.f(0.5, 1.5) + o.g(0, 1); }));
+  EXPECT(8, sizeof(int (*)(int)));
+  EXPECT(1, ({ int a[] = {5, 3, 9, 1, 7}; return sorted(a, 5) && a[0] == 1 && a[4] == 9; }));
+  EXPECT(1, ({ binop_t f = plus; return f == g_op; }));
+  EXPECT(0, strcmp(STR(a + b), "a + b"));
+  EXPECT(0, strcmp(STR("a\n"), "\"a\\n\""));
+  EXPECT(0, strcmp(XSTR(PASTE(1, 2)), "12"));
+  EXPECT(0, strcmp(STR(PASTE(1,  2)), "PASTE(1, 2)"));
+  EXPECT(0, strcmp(STR( a  /* c */ b ), "a b"));
+  EXPECT(1, LINE() == __LINE__);
+  EXPECT(9, VA_SUM(2, 3, 4));
+  EXPECT(5, VA_SUM(5));
+  EXPECT(3, PASTE(on, e)() + PASTE(tw, o)());
+  EXPECT(0, strcmp(__FILE__, "test/test.c"));
+  EXPECT(__LINE__, atoi(XSTR(__LINE__)));
+  EXPECT(1, __COUNTER__ + 1 == __COUNTER__);
+  EXPECT(12, sizeof(__DATE__));
+  EXPECT(9, sizeof(__TIME__));
+  EXPECT(201112, __STDC_VERSION__);
+  EXPECT(1, __STDC__ && __x86_64__ && __linux__);
+  EXPECT(2, dup_name());
+  EXPECT(20, dup_var);
+  EXPECT(110, gcc_dup_name());
+  EXPECT(7, tent);
+  EXPECT(12, ({ tent_common = 7; return gcc_read_common(); }));
+  EXPECT(110, static_counter());
+  EXPECT(211, static_counter());
+  EXPECT(3, ({ extern int g1; return g1; }));
+  EXPECT(4, ({ static int s = 4; return s++; }));
+  EXPECT(55, 1+(2+(3+(4+(5+(6+(7+(8+(9+(10))))))))));
+  EXPECT(-275, (1+(2+(3+(4+(5+(6+(7+(8+(9+(10))))))))))*(2-(3-(4-(5-(6-(7-(8-(9-(10-11))))))))));
+  EXPECT(105, spill_loop(3));
+  EXPECT(7, 1 + 2 * 3);
+  EXPECT(1, 0xffffffffU + 1 == 0);
+  EXPECT(1, -1U / 2 == 2147483647);
+  EXPECT(1, -1U >> 1 == 2147483647);
+  EXPECT(-1, -1 >> 1);
+  EXPECT(1, -1UL > 0);
+  EXPECT(255, (unsigned char)-1);
+  EXPECT(-3, -7 / 2);
+  EXPECT(-1, -7 % 2);
+  EXPECT(1, -7U % 2);
+  EXPECT(1, (1L << 40) >> 40);
+  EXPECT(5, 0 ? 1 / 0 : 5);
+  EXPECT(0, 0 && 1 / 0);
+  EXPECT(1, 1 || 1 % 0);
+  EXPECT(3, ({ int x = 3; if (0) x = 1 / 0; return x; }));
+  EXPECT(5, ({ int x = 5; return x * 1 + 0 - 0; }));
+  EXPECT(6, ({ int x = 6; return (x << 0) | 0; }));
+  EXPECT(2, ({ int a[2] = {1, 2}; int *p = a; return *(p + 0 + 1); }));
+  EXPECT(24, ({ int a[2 * 3]; return sizeof(a); }));
+  EXPECT(8, ({ char a[sizeof(int) * 2]; return sizeof(a); }));
+  EXPECT(3, ({ char a[-1U >> 30]; return sizeof(a); }));
+  EXPECT(69, (int)(1.5+(2.5+(3.5+(4.5+(5.5+(6.5+(7.5+(8.5+(9.5+(10.5+(fsum10(1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1)-(1.0)))))))))))));
+
+  EXPECT(64, ({ int p = 2; int q = 3; return live_across_call(&p, &q); }));
+
   printf("OK\n");
   return 0;
 }
@@ -10,4 +10,154 @@ to this line
 **
 */
 
-#include "test/test1.inc"
+#include "test1.inc"
+
+#define ONE 1
+#define TWO 1 + 1
+
+#if 0
+this line is skipped
+#if 1
+so is this one
+#endif
+#elif 1
+int cond0;
+#elif 1 +
+#else
+#endif
+
+#if TWO * 3 == 4 && defined ONE && !defined(THREE)
+int cond1;
+#else
+syntax error
+#endif
+
+#ifdef THREE
+syntax error
+#elif !defined TWO ? 1 / 0 : 0
+syntax error
+#elif (1 ? 0 || UNDEFINED : 1 / 0) == 0 && 7 % 4 == 3
+int cond2;
+#else
+syntax error
+#endif
+
+#ifndef ONE
+syntax error
+#else
+# if -1 < 0 && ~0 == -1 && 1 << 4 >> 2 == 4 && (3 ^ 5) == 6 && '0' == 48
+int cond3;
+# endif
+#endif
+
+#
+
+#define THREE (TWO + ONE)
+#define PAREN (1 + 2)
+#if THREE != 3 || PAREN * 2 != 6
+syntax error
+#endif
+
+// A macro is not expanded again in its own expansion.
+#define foo foo + 1
+#define A B + 1
+#define B A + 2
+#if foo != 1 || A != 3 || B != 3
+syntax error
+#endif
+
+#define CAT(a, b) a ## b
+#define XCAT(a, b) CAT(a, b)
+#define N 5
+#if CAT(1, 2) != 12 || XCAT(N, 0) != 50 || CAT(N, 0) != 0 || CAT(, 5) != 5 || CAT(5, ) != 5
+syntax error
+#endif
+int CAT(x, 1);
+CAT(in, t) x2;
+#undef N
+#ifdef N
+syntax error
+#endif
+#define N 7
+#if N != 7
+syntax error
+#endif
+
+#define COUNT(...) COUNT_(__VA_ARGS__, 3, 2, 1, 0)
+#define COUNT_(a, b, c, n, ...) n
+#define OPT(x, ...) x __VA_OPT__(+ __VA_ARGS__)
+#define F(x, ...) x + COUNT(__VA_ARGS__)
+#if COUNT(x) != 1 || COUNT(x, y) != 2 || COUNT(x, (y, z), w) != 3
+syntax error
+#endif
+#if OPT(1) != 1 || OPT(1, 2 * 3) != 7 || F(4, a, b) != 6
+syntax error
+#endif
+
+// A function-like macro name without arguments is not expanded.
+#define G(x) syntax error
+int G;
+#define APPLY(f, x) f(x)
+#define INC(x) x + 1
+#if APPLY(INC, APPLY(INC, 1)) != 3
+syntax error
+#endif
+
+#include <guard.h>
+#include "include/guard.h"
+#include <once.h>
+#include "include/once.h"
+#define ONCE_H <once.h>
+#include ONCE_H
+#include <next.h>
+#if NEXT_FIRST + NEXT_SECOND != 3
+syntax error
+#endif
+
+#if !defined __STDC__ || __STDC_VERSION__ < 201112L || !__x86_64__ || !__linux__
+syntax error
+#endif
+#if !defined __9CCGO__ || !defined __FILE__ || !defined __LINE__
+syntax error
+#endif
+#if __COUNTER__ != 0 || __COUNTER__ != 1
+syntax error
+#endif
+#if __LINE__ != 126
+syntax error
+#endif
+#undef __COUNTER__
+#ifdef __COUNTER__
+syntax error
+#endif
+
+// Macros given by -D and -U in the Makefile
+#if CMD_ONE != 1 || CMD_VAL * 2 != 8 || CMD_F(CMD_VAL) != 10
+syntax error
+#endif
+#ifdef CMD_GONE
+syntax error
+#endif
+
+#line 500
+#if __LINE__ != 500
+syntax error
+#endif
+# 600 "test/token.c" 2
+#if __LINE__ != 600
+syntax error
+#endif
+
+// Operands are converted to uintmax_t if either of them is unsigned.
+#if -1 < 0u || -1 / 2u != 0x7fffffffffffffff || -1 % 3U != 0
+syntax error
+#elif (0u - 1) >> 63 != 1 || -1 >> 63 != -1 || 0xffffffffffffffff < 0
+syntax error
+#elif (1 ? -1 : 0u) < 0 || !(-1 < 0)
+syntax error
+#endif
+
+#include <self.h>
+#ifndef SELF_INCLUDED
+syntax error
+#endif
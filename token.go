@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"os"
 	"strconv"
 	"strings"
@@ -12,10 +11,11 @@ import (
 var (
 	input_file string
 	buf        string
-	filename   string
 	keywords   *Map
 	ctx        *Context
 	symbols    = []Keyword{
+		{name: "...", ty: TK_ELLIPSIS},
+		{name: "##", ty: TK_HASHHASH},
 		{name: "<<=", ty: TK_SHL_EQ},
 		{name: ">>=", ty: TK_SHR_EQ},
 		{name: "!=", ty: TK_NE},
@@ -62,6 +62,11 @@ type Context struct {
 	pos    string
 	tokens *Vector
 	next   *Context
+
+	// The current line number, and true if whitespace or a comment
+	// has been skipped since the last token.
+	line  int
+	space bool
 }
 
 func read_file(path string) string {
@@ -69,7 +74,7 @@ func read_file(path string) string {
 	if path != "-" {
 		f2, err := os.Open(path)
 		if err != nil {
-			log.Fatal(err)
+			error("%s", err)
 		}
 		f = f2
 		defer f2.Close()
@@ -103,68 +108,17 @@ func new_ctx(next *Context, path, buf string) *Context {
 	ctx.pos = ctx.buf
 	ctx.tokens = new_vec()
 	ctx.next = next
+	ctx.line = 1
 	return ctx
 }
 
-// Error reporting
-
-// Finds a line pointed by a given pointer from the input line
-// to print it out.
-func print_line(buf, path, pos string) {
-	curline, s := buf, buf
-	line, col := 0, 0
-
-	for i, c := range buf {
-
-		if c == '\n' {
-			curline = buf[i+1:]
-			line++
-			col = 0
-			s = buf[i+1:]
-			continue
-		}
-
-		if s != pos {
-			col++
-			s = buf[i+1:]
-			continue
-		}
-
-		fmt.Fprintf(os.Stderr, "error at %s:%d:%d\n\n", path, line+1, col+1)
-		for i, c2 := range curline {
-			if c2 == '\n' {
-				curline = curline[:i]
-				break
-			}
-		}
-		fmt.Fprintf(os.Stderr, "%s\n", curline)
-
-		for i := 0; i < col-1; i++ {
-			fmt.Fprintf(os.Stderr, " ")
-		}
-		fmt.Fprintf(os.Stderr, "^\n\n")
-		return
-	}
-}
-
-func bad_token(t *Token, msg string) {
-	print_line(t.buf, t.path, t.start)
-	error(msg)
-}
-
 func tokstr(t *Token) string {
 	// assert(t.start && t.end)
 	return strndup(t.start, len(t.start)-len(t.end))
 }
 
 func line(t *Token) int {
-	n := 1
-	for i := 0; i < len(t.buf)-len(t.end); i++ {
-		if rune(t.buf[i]) == '\n' {
-			n++
-		}
-	}
-	return n
+	return t.line
 }
 
 // Atomic unit in the grammer is called "token".
@@ -178,6 +132,9 @@ func add_t(ty int, start string) *Token {
 	t.start = start
 	t.path = ctx.path
 	t.buf = ctx.buf
+	t.line = ctx.line
+	t.has_space = ctx.space
+	ctx.space = false
 	vec_push(ctx.tokens, t)
 	return t
 }
@@ -186,17 +143,31 @@ func keyword_map() *Map {
 	kmap := new_map()
 	map_puti(kmap, "_Alignof", TK_ALIGNOF)
 	map_puti(kmap, "break", TK_BREAK)
+	map_puti(kmap, "case", TK_CASE)
 	map_puti(kmap, "char", TK_CHAR)
+	map_puti(kmap, "continue", TK_CONTINUE)
+	map_puti(kmap, "default", TK_DEFAULT)
 	map_puti(kmap, "do", TK_DO)
+	map_puti(kmap, "double", TK_DOUBLE)
 	map_puti(kmap, "else", TK_ELSE)
+	map_puti(kmap, "enum", TK_ENUM)
 	map_puti(kmap, "extern", TK_EXTERN)
+	map_puti(kmap, "float", TK_FLOAT)
 	map_puti(kmap, "for", TK_FOR)
+	map_puti(kmap, "goto", TK_GOTO)
 	map_puti(kmap, "if", TK_IF)
 	map_puti(kmap, "int", TK_INT)
+	map_puti(kmap, "long", TK_LONG)
 	map_puti(kmap, "return", TK_RETURN)
+	map_puti(kmap, "short", TK_SHORT)
+	map_puti(kmap, "signed", TK_SIGNED)
 	map_puti(kmap, "sizeof", TK_SIZEOF)
+	map_puti(kmap, "static", TK_STATIC)
 	map_puti(kmap, "struct", TK_STRUCT)
+	map_puti(kmap, "switch", TK_SWITCH)
 	map_puti(kmap, "typedef", TK_TYPEDEF)
+	map_puti(kmap, "union", TK_UNION)
+	map_puti(kmap, "unsigned", TK_UNSIGNED)
 	map_puti(kmap, "void", TK_VOID)
 	map_puti(kmap, "while", TK_WHILE)
 	return kmap
@@ -208,8 +179,7 @@ func block_comment(pos string) string {
 			return s[2:]
 		}
 	}
-	print_line(buf, filename, pos)
-	error("unclosed comment")
+	error_pos(ctx.buf, ctx.path, pos, "unclosed comment")
 	return ""
 }
 
@@ -254,7 +224,7 @@ func string_literal(p string) string {
 	p = p[1:]
 	sb := new_sb()
 
-	for rune(p[0]) != '"' {
+	for len(p) == 0 || p[0] != '"' {
 		if len(p) == 0 {
 			goto err
 		}
@@ -271,7 +241,7 @@ func string_literal(p string) string {
 		}
 		esc := escaped[rune(p[0])]
 		if esc != 0 {
-			sb_add(sb, string(esc))
+			sb_add(sb, string(rune(esc)))
 		} else {
 			sb_add(sb, string(p[0]))
 		}
@@ -326,7 +296,6 @@ func hexadecimal(p string) string {
 			return p
 		}
 	}
-	return ""
 }
 
 func octal(p string) string {
@@ -353,14 +322,85 @@ func decimal(p string) string {
 	return p
 }
 
+// Reads an integer suffix such as "U", "L", "UL" or "LL".
+func int_suffix(t *Token, p string) string {
+	for len(p) != 0 && strchr("uUlL", rune(p[0])) != "" {
+		if p[0] == 'u' || p[0] == 'U' {
+			t.is_unsigned = true
+		} else {
+			t.is_long = true
+		}
+		p = p[1:]
+	}
+	t.end = p
+	return p
+}
+
+// Returns the length of a preprocessing number at the beginning of p.
+// A preprocessing number includes signs after an exponent character.
+func ppnum_len(p string) int {
+	n := 0
+	for n < len(p) {
+		c := rune(p[n])
+		if n > 0 && strchr("eEpP", c) != "" && n+1 < len(p) && (p[n+1] == '+' || p[n+1] == '-') {
+			n += 2
+			continue
+		}
+		if !isalpha(c) && !unicode.IsDigit(c) && c != '.' && c != '_' {
+			break
+		}
+		n++
+	}
+	return n
+}
+
+func is_flonum_literal(s string) bool {
+	if strncasecmp(s, "0x", 2) == 0 {
+		return strings.ContainsAny(s, ".pP")
+	}
+	return strings.ContainsAny(s, ".eE")
+}
+
+// Reads a floating-point literal such as "1.5", ".5e-3f" or "0x1p-2".
+func flonum(p string, n int) string {
+	t := add_t(TK_FNUM, p)
+	s := p[:n]
+
+	is_hex := strncasecmp(s, "0x", 2) == 0
+	if c := s[len(s)-1]; strchr("fFlL", rune(c)) != "" && (!is_hex || strings.ContainsAny(s, "pP")) {
+		t.is_float = c == 'f' || c == 'F'
+		s = s[:len(s)-1]
+	}
+
+	// Overflow yields an infinity, which is not an error in C.
+	val, err := strconv.ParseFloat(s, 64)
+	if strings.Contains(s, "_") || err != nil && err.(*strconv.NumError).Err != strconv.ErrRange {
+		bad_token(t, "invalid floating constant")
+	}
+	t.fval = val
+	if t.is_float {
+		t.fval = float64(float32(val))
+	}
+
+	p = p[n:]
+	t.end = p
+	return p
+}
+
 func number(p string) string {
-	if strncasecmp(p, "0x", 2) == 0 {
-		return hexadecimal(p)
+	if n := ppnum_len(p); is_flonum_literal(p[:n]) {
+		return flonum(p, n)
 	}
-	if p[0] == '0' {
-		return octal(p)
+
+	if strncasecmp(p, "0x", 2) == 0 {
+		p = hexadecimal(p)
+	} else if p[0] == '0' {
+		p = octal(p)
+	} else {
+		p = decimal(p)
 	}
-	return decimal(p)
+	t := vec_last(ctx.tokens).(*Token)
+	return int_suffix(t, p)
 }
 
 // Tokenized input is stored to this array
@@ -375,12 +415,14 @@ loop:
 			t := add_t(int(c), p)
 			p = p[1:]
 			t.end = p
+			ctx.line++
 			continue
 		}
 
 		// Whitespace
 		if unicode.IsSpace(c) {
 			p = p[1:]
+			ctx.space = true
 			continue
 		}
 
@@ -390,12 +432,16 @@ loop:
 				p = p[1:]
 				c = rune(p[0])
 			}
+			ctx.space = true
 			continue
 		}
 
 		// Block comment
 		if strncmp(p, "/*", 2) == 0 {
-			p = block_comment(p)
+			q := block_comment(p)
+			ctx.line += strings.Count(p[:len(p)-len(q)], "\n")
+			ctx.space = true
+			p = q
 			continue
 		}
 
@@ -411,6 +457,12 @@ loop:
 			continue
 		}
 
+		// Floating-point literal starting with a period
+		if c == '.' && len(p) > 1 && unicode.IsDigit(rune(p[1])) {
+			p = number(p)
+			continue
+		}
+
 		// Multi-letter symbol
 		for _, sym := range symbols {
 			length := len(sym.name)
@@ -446,8 +498,7 @@ loop:
 			continue
 		}
 
-		print_line(ctx.buf, ctx.path, p)
-		error("cannot tokenize")
+		error_pos(ctx.buf, ctx.path, p, "cannot tokenize")
 	}
 }
 
@@ -455,8 +506,25 @@ func canonicalize_newline(p string) string {
 	return strings.Replace(p, "\r\n", "\n", -1)
 }
 
+// Removes backslash-newlines. The same number of newlines are inserted
+// at the end of the logical line to keep line numbers.
 func remove_backslash_newline(p string) string {
-	return strings.Replace(p, "\\\n", "", -1)
+	b := make([]byte, 0, len(p))
+	n := 0
+	for i := 0; i < len(p); i++ {
+		if p[i] == '\\' && i+1 < len(p) && p[i+1] == '\n' {
+			n++
+			i++
+			continue
+		}
+		b = append(b, p[i])
+		if p[i] == '\n' {
+			for ; n > 0; n-- {
+				b = append(b, '\n')
+			}
+		}
+	}
+	return string(b)
 }
 
 func strip_newline_tokens(tokens *Vector) *Vector {
@@ -495,7 +563,8 @@ func join_string_literals(tokens *Vector) *Vector {
 	return v
 }
 
-func tokenize(path string, add_eof bool) *Vector {
+// Reads a file and splits it into tokens without preprocessing.
+func scan_file(path string, add_eof bool) *Vector {
 	if keywords == nil {
 		keywords = keyword_map()
 	}
@@ -512,31 +581,73 @@ func tokenize(path string, add_eof bool) *Vector {
 
 	v := ctx.tokens
 	ctx = ctx.next
+	return v
+}
 
-	v = preprocess(v)
+func tokenize(path string, add_eof bool) *Vector {
+	v := scan_file(path, add_eof)
+	v = preprocess(v, path, -1)
 	v = strip_newline_tokens(v)
 	return join_string_literals(v)
 }
 
+// Scans a given string. Newline tokens are kept so that the result
+// can be preprocessed.
+func scan_str(s, path string) *Vector {
+	if keywords == nil {
+		keywords = keyword_map()
+	}
+
+	orig := buf
+	buf = s + "\n"
+	ctx = new_ctx(ctx, path, buf)
+	scan()
+	v := ctx.tokens
+	ctx = ctx.next
+	buf = orig
+	return v
+}
+
+// Tokenizes a given string without preprocessing. This is used to
+// re-lex a token made by the ## operator.
+func tokenize_str(s, path string) *Vector {
+	return strip_newline_tokens(scan_str(s, path))
+}
+
 // debug
 func print_tokens(tokens *Vector) {
 	m := map[int]string{
 		TK_NUM:       "TK_NUM      ",
+		TK_FNUM:      "TK_FNUM     ",
 		TK_STR:       "TK_STR      ",
 		TK_IDENT:     "TK_IDENT    ",
 		TK_ARROW:     "TK_ARROW    ",
 		TK_EXTERN:    "TK_EXTERN   ",
+		TK_STATIC:    "TK_STATIC   ",
 		TK_TYPEDEF:   "TK_TYPEDEF  ",
 		TK_INT:       "TK_INT      ",
 		TK_CHAR:      "TK_CHAR     ",
+		TK_SHORT:     "TK_SHORT    ",
+		TK_LONG:      "TK_LONG     ",
+		TK_SIGNED:    "TK_SIGNED   ",
+		TK_UNSIGNED:  "TK_UNSIGNED ",
+		TK_FLOAT:     "TK_FLOAT    ",
+		TK_DOUBLE:    "TK_DOUBLE   ",
 		TK_VOID:      "TK_VOID     ",
 		TK_STRUCT:    "TK_STRUCT   ",
+		TK_UNION:     "TK_UNION    ",
+		TK_ENUM:      "TK_ENUM     ",
 		TK_IF:        "TK_IF       ",
 		TK_ELSE:      "TK_ELSE     ",
 		TK_FOR:       "TK_FOR      ",
 		TK_DO:        "TK_DO       ",
 		TK_WHILE:     "TK_WHILE    ",
 		TK_BREAK:     "TK_BREAK    ",
+		TK_SWITCH:    "TK_SWITCH   ",
+		TK_CASE:      "TK_CASE     ",
+		TK_DEFAULT:   "TK_DEFAULT  ",
+		TK_CONTINUE:  "TK_CONTINUE ",
+		TK_GOTO:      "TK_GOTO     ",
 		TK_EQ:        "TK_EQ       ",
 		TK_NE:        "TK_NE       ",
 		TK_LE:        "TK_LE       ",
@@ -560,6 +671,8 @@ func print_tokens(tokens *Vector) {
 		TK_RETURN:    "TK_RETURN   ",
 		TK_SIZEOF:    "TK_SIZEOF   ",
 		TK_ALIGNOF:   "TK_ALIGNOF  ",
+		TK_ELLIPSIS:  "TK_ELLIPSIS ",
+		TK_HASHHASH:  "TK_HASHHASH ",
 		TK_PARAM:     "TK_PARAM    ",
 		TK_EOF:       "TK_EOF      ",
 	}
@@ -576,6 +689,8 @@ func print_tokens(tokens *Vector) {
 		val := ""
 		if t.ty == TK_NUM {
 			val = strconv.Itoa(t.val)
+		} else if t.ty == TK_FNUM {
+			val = strconv.FormatFloat(t.fval, 'g', -1, 64)
 		} else {
 			val = t.name
 		}
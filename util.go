@@ -60,7 +60,11 @@ func ptr_to(base *Type) *Type {
 	return ty
 }
 
+// An array of the error type is the error type.
 func ary_of(base *Type, length int) *Type {
+	if base.ty == ERR {
+		return base
+	}
 	ty := new(Type)
 	ty.ty = ARY
 	ty.size = base.size * length
@@ -70,6 +74,81 @@ func ary_of(base *Type, length int) *Type {
 	return ty
 }
 
+func is_integer(ty *Type) bool {
+	return ty.ty == CHAR || ty.ty == SHORT || ty.ty == INT || ty.ty == LONG
+}
+
+func is_flonum(ty *Type) bool {
+	return ty.ty == FLOAT || ty.ty == DOUBLE
+}
+
+func is_arith(ty *Type) bool {
+	return is_integer(ty) || is_flonum(ty)
+}
+
+// Pointers are compared as unsigned integers.
+func is_unsigned(ty *Type) bool {
+	return ty.is_unsigned || ty.ty == PTR
+}
+
+// Integer promotion. Integer types narrower than int are converted
+// to int because int can represent all values of them.
+func int_promote(ty *Type) *Type {
+	if is_integer(ty) && ty.size < 4 {
+		return int_tyf()
+	}
+	return ty
+}
+
+// Usual arithmetic conversion. Returns the common type of two
+// arithmetic operands. If either is a floating-point number, the
+// result is the wider floating-point type. If one is unsigned and its
+// rank is not lower than the other's, the result is unsigned.
+func arith_conv(t1, t2 *Type) *Type {
+	if t1.ty == DOUBLE || t2.ty == DOUBLE {
+		return double_tyf()
+	}
+	if t1.ty == FLOAT || t2.ty == FLOAT {
+		return float_tyf()
+	}
+
+	t1 = int_promote(t1)
+	t2 = int_promote(t2)
+	if t1.size != t2.size {
+		if t1.size < t2.size {
+			return t2
+		}
+		return t1
+	}
+	if t2.is_unsigned {
+		return t2
+	}
+	return t1
+}
+
+// Truncates an integer to a given type and sign- or zero-extends
+// the result to 64 bits.
+func wrap_int(val int, ty *Type) int {
+	switch ty.size {
+	case 1:
+		if ty.is_unsigned {
+			return int(uint8(val))
+		}
+		return int(int8(val))
+	case 2:
+		if ty.is_unsigned {
+			return int(uint16(val))
+		}
+		return int(int16(val))
+	case 4:
+		if ty.is_unsigned {
+			return int(uint32(val))
+		}
+		return int(int32(val))
+	}
+	return val
+}
+
 func size_of(ty *Type) int {
 	if ty.ty == CHAR {
 		return 1
@@ -221,6 +300,17 @@ func vec_push(v *Vector, elem interface{}) {
 	v.len++
 }
 
+func vec_pop(v *Vector) interface{} {
+	// assert(v.len > 0)
+	v.len--
+	return v.data[v.len]
+}
+
+func vec_last(v *Vector) interface{} {
+	// assert(v.len > 0)
+	return v.data[v.len-1]
+}
+
 // An error reporting function
 func error(format string, a ...interface{}) {
 	fmt.Fprintf(os.Stderr, format, a...)
@@ -361,6 +451,10 @@ func vec_test() {
 	expect_test(file, line+8, 0, vec.data[0].(int))
 	expect_test(file, line+9, 50, vec.data[50].(int))
 	expect_test(file, line+10, 99, vec.data[99].(int))
+
+	expect_test(file, line+12, 99, vec_last(vec).(int))
+	expect_test(file, line+13, 99, vec_pop(vec).(int))
+	expect_test(file, line+14, 99, vec.len)
 }
 
 func map_test() {